@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+
+	scst "github.com/Tualua/pk_ctladm/pk_scst"
+)
+
+const CTLADM_CONFIG_PATH string = "/etc/ctladm.conf"
+
+type Config struct {
+	RemovePurge        bool
+	RemoveDeleteTarget bool
+	RemoveZfs          string
+	ScstRoot           string
+}
+
+var config = Config{
+	RemoveZfs: "none",
+	ScstRoot:  scst.SCST_ROOT_PATH,
+}
+
+func parseConfigBool(val string) (res bool, err error) {
+	switch strings.ToLower(val) {
+	case "yes", "on", "true", "1":
+		res = true
+	case "no", "off", "false", "0":
+		res = false
+	default:
+		err = fmt.Errorf("invalid boolean value %s", val)
+	}
+	return
+}
+
+func LoadConfig(configPath string) (err error) {
+	var (
+		configFile *os.File
+	)
+	if configFile, err = os.Open(configPath); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			err = nil
+		}
+		return
+	}
+	defer configFile.Close()
+	scanner := bufio.NewScanner(configFile)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, val, found := strings.Cut(line, "=")
+		if !found {
+			return fmt.Errorf("%s:%d: expected key = value", configPath, lineNum)
+		}
+		key = strings.TrimSpace(key)
+		val = strings.Trim(strings.TrimSpace(val), "\"")
+		switch key {
+		case "remove_purge":
+			config.RemovePurge, err = parseConfigBool(val)
+		case "remove_delete_target":
+			config.RemoveDeleteTarget, err = parseConfigBool(val)
+		case "remove_zfs":
+			switch val {
+			case "none", "destroy", "snapshot":
+				config.RemoveZfs = val
+			default:
+				err = fmt.Errorf("invalid value %s, expected none, destroy or snapshot", val)
+			}
+		case "scst_root":
+			config.ScstRoot = val
+		default:
+			err = fmt.Errorf("unknown key %s", key)
+		}
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", configPath, lineNum, err)
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,336 @@
+// Command conformance checks that ctladm produces the same XML as FreeBSD
+// ctladm. It builds an SCST tree with the simulator that is equivalent to the
+// CTL configuration the reference outputs in testdata describe, runs ctladm
+// against it and diffs both documents element by element. The reference
+// outputs are hand-written, see testdata/README.
+//
+// Usage, from the repository root:
+//
+//	go run ./conformance [-ctladm path]
+//
+// A ctladm given with -ctladm must be built with -tags scstsim.
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	scst "github.com/Tualua/pk_ctladm/pk_scst"
+	scstsim "github.com/Tualua/pk_ctladm/pk_scstsim"
+)
+
+//go:embed testdata/*.xml
+var testdata embed.FS
+
+const IQN string = "iqn.2022-10.net.playkey.sds"
+
+// The INQUIRY identification CTL gives a LUN configured without vendor,
+// product and revision options.
+const (
+	CTL_VENDOR   string = "FREEBSD"
+	CTL_PRODUCT  string = "CTLDISK"
+	CTL_REVISION string = "0001"
+)
+
+type Case struct {
+	Name      string
+	Args      []string
+	Reference string
+}
+
+var Cases = []Case{
+	{Name: "devlist", Args: []string{"devlist", "-x"}, Reference: "testdata/devlist.xml"},
+	{Name: "portlist", Args: []string{"portlist", "-x"}, Reference: "testdata/portlist.xml"},
+}
+
+type Volume struct {
+	Name       string
+	Size       int64
+	Blocksize  string
+	Serial     string
+	RelId      string
+	Initiators []string
+}
+
+// Volumes is the configuration the reference outputs describe: one
+// ctld target per zvol, each with the zvol as LUN 0.
+var Volumes = []Volume{
+	{Name: "vol1", Size: 10 << 20, Blocksize: "512", Serial: "SDS0001", RelId: "1",
+		Initiators: []string{"iqn.1994-09.org.freebsd:host1"}},
+	{Name: "vol2", Size: 20 << 20, Blocksize: "4096", Serial: "SDS0002", RelId: "2",
+		Initiators: []string{"iqn.1994-09.org.freebsd:host2", "iqn.1994-09.org.freebsd:host3"}},
+}
+
+func mgmt(sim *scstsim.ScstSim, name string, cmd string) (err error) {
+	if err = sim.WriteFile(name, []byte(cmd)); err != nil {
+		err = fmt.Errorf("%s: %s: %w", name, cmd, err)
+	}
+	return
+}
+
+// BuildFixture creates the zvols under work/dev/zvol and the SCST tree of
+// Volumes under work/scst.
+func BuildFixture(work string) (err error) {
+	var (
+		sim *scstsim.ScstSim
+	)
+	if sim, err = scstsim.New(filepath.Join(work, "scst")); err != nil {
+		return
+	}
+	for _, vol := range Volumes {
+		file := filepath.Join(work, "dev/zvol/tank/games", vol.Name)
+		wwn := IQN + ":" + vol.Name
+		target := path.Join(scst.SCST_ISCSI_TARGETS, wwn)
+		group := path.Join(target, "ini_groups", "allowed_ini")
+		if err = os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return
+		}
+		if err = os.WriteFile(file, nil, 0644); err != nil {
+			return
+		}
+		if err = os.Truncate(file, vol.Size); err != nil {
+			return
+		}
+		for _, cmd := range [][2]string{
+			{scst.ScstHandlerMgmt(scst.SCST_HANDLER_BLOCKIO), fmt.Sprintf("add_device %s filename=%s; blocksize=%s", vol.Name, file, vol.Blocksize)},
+			{path.Join(scst.SCST_DEVICES, vol.Name, "usn"), vol.Serial},
+			{path.Join(scst.SCST_DEVICES, vol.Name, "threads_num"), "14"},
+			{path.Join(scst.SCST_DEVICES, vol.Name, "t10_vend_id"), CTL_VENDOR},
+			{path.Join(scst.SCST_DEVICES, vol.Name, "prod_id"), CTL_PRODUCT},
+			{path.Join(scst.SCST_DEVICES, vol.Name, "prod_rev_lvl"), CTL_REVISION},
+			{path.Join(scst.SCST_ISCSI_TARGETS, "mgmt"), "add_target " + wwn},
+			{path.Join(target, "rel_tgt_id"), vol.RelId},
+			{path.Join(target, "ini_groups", "mgmt"), "create allowed_ini"},
+			{path.Join(group, "luns", "mgmt"), "add " + vol.Name + " 0"},
+			{path.Join(target, "enabled"), "1"},
+		} {
+			if err = mgmt(sim, cmd[0], cmd[1]); err != nil {
+				return
+			}
+		}
+		for i, initiator := range vol.Initiators {
+			if _, err = sim.AddSession(wwn, initiator, fmt.Sprintf("10.0.%s.%d", vol.RelId, i+11)); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+func RunCtladm(ctladm string, work string, args []string) (res []byte, err error) {
+	var (
+		stderr bytes.Buffer
+	)
+	cmd := exec.Command(ctladm, args...)
+	cmd.Dir = work
+	cmd.Env = append(os.Environ(),
+		"CTLADM_SCST_ROOT="+filepath.Join(work, "scst"),
+		"CTLADM_CONFIG="+filepath.Join(work, "ctladm.conf"),
+		"CTLADM_DEBUG=true",
+	)
+	cmd.Stderr = &stderr
+	if res, err = cmd.Output(); err != nil {
+		err = fmt.Errorf("ctladm %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	// Paths in the fixture are relative to work, in the reference to /.
+	res = bytes.ReplaceAll(res, []byte(work), nil)
+	return
+}
+
+type Node struct {
+	Name     string
+	Attrs    []string
+	Text     string
+	Children []*Node
+}
+
+func (n *Node) Label() (res string) {
+	res = n.Name
+	if len(n.Attrs) > 0 {
+		res += "[" + strings.Join(n.Attrs, ",") + "]"
+	}
+	return
+}
+
+func (n *Node) Child(name string) *Node {
+	for _, child := range n.Children {
+		if child.Name == name {
+			return child
+		}
+	}
+	return nil
+}
+
+func ParseXml(data []byte) (root *Node, err error) {
+	var (
+		stack []*Node
+		tok   xml.Token
+	)
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		if tok, err = dec.Token(); err == io.EOF {
+			err = nil
+			break
+		} else if err != nil {
+			return
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			node := &Node{Name: t.Name.Local}
+			for _, attr := range t.Attr {
+				node.Attrs = append(node.Attrs, attr.Name.Local+"="+attr.Value)
+			}
+			sort.Strings(node.Attrs)
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.Children = append(parent.Children, node)
+			} else if root == nil {
+				root = node
+			} else {
+				return nil, fmt.Errorf("more than one root element")
+			}
+			stack = append(stack, node)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].Text += string(t)
+			}
+		}
+	}
+	if root == nil {
+		err = fmt.Errorf("no root element")
+	}
+	return
+}
+
+func Trim(n *Node) {
+	n.Text = strings.TrimSpace(n.Text)
+	for _, child := range n.Children {
+		Trim(child)
+	}
+}
+
+// DropNonIscsiPorts removes the ioctl and camsim ports FreeBSD always lists,
+// ctladm only exports iSCSI targets.
+func DropNonIscsiPorts(n *Node) {
+	var (
+		ports []*Node
+	)
+	for _, child := range n.Children {
+		if child.Name == "targ_port" {
+			if frontend := child.Child("frontend_type"); frontend == nil || frontend.Text != "iscsi" {
+				continue
+			}
+		}
+		ports = append(ports, child)
+	}
+	n.Children = ports
+}
+
+func Diff(prefix string, want *Node, got *Node) (res []string) {
+	where := prefix + "/" + want.Label()
+	if want.Label() != got.Label() {
+		return []string{fmt.Sprintf("%s: got element %s", where, got.Label())}
+	}
+	if want.Text != got.Text {
+		res = append(res, fmt.Sprintf("%s: got %q, want %q", where, got.Text, want.Text))
+	}
+	for i := 0; i < len(want.Children) || i < len(got.Children); i++ {
+		switch {
+		case i >= len(got.Children):
+			res = append(res, fmt.Sprintf("%s: missing %s", where, want.Children[i].Label()))
+		case i >= len(want.Children):
+			res = append(res, fmt.Sprintf("%s: unexpected %s", where, got.Children[i].Label()))
+		default:
+			res = append(res, Diff(where, want.Children[i], got.Children[i])...)
+		}
+	}
+	return
+}
+
+func RunCase(ctladm string, c Case) (res []string, err error) {
+	var (
+		work      string
+		reference []byte
+		output    []byte
+		want      *Node
+		got       *Node
+	)
+	if work, err = os.MkdirTemp("", "ctladm-conformance-"); err != nil {
+		return
+	}
+	defer os.RemoveAll(work)
+	if err = BuildFixture(work); err != nil {
+		return nil, fmt.Errorf("fixture: %w", err)
+	}
+	if reference, err = testdata.ReadFile(c.Reference); err != nil {
+		return
+	}
+	if want, err = ParseXml(reference); err != nil {
+		return nil, fmt.Errorf("%s: %w", c.Reference, err)
+	}
+	if output, err = RunCtladm(ctladm, work, c.Args); err != nil {
+		return
+	}
+	if got, err = ParseXml(output); err != nil {
+		return nil, fmt.Errorf("ctladm output: %w", err)
+	}
+	Trim(want)
+	Trim(got)
+	DropNonIscsiPorts(want)
+	res = Diff("", want, got)
+	return
+}
+
+func run() (failed bool) {
+	ctladm := flag.String("ctladm", "", "ctladm binary built with -tags scstsim, built from the current directory when empty")
+	flag.Parse()
+	if *ctladm == "" {
+		dir, err := os.MkdirTemp("", "ctladm-build-")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return true
+		}
+		defer os.RemoveAll(dir)
+		*ctladm = filepath.Join(dir, "ctladm")
+		cmd := exec.Command("go", "build", "-tags", "scstsim", "-o", *ctladm, ".")
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			fmt.Fprintf(os.Stderr, "building ctladm: %v\n", err)
+			return true
+		}
+	}
+	for _, c := range Cases {
+		if diffs, err := RunCase(*ctladm, c); err != nil {
+			fmt.Printf("FAIL: %s: %v\n", c.Name, err)
+			failed = true
+		} else if len(diffs) > 0 {
+			fmt.Printf("FAIL: %s\n", c.Name)
+			for _, diff := range diffs {
+				fmt.Printf("\t%s\n", diff)
+			}
+			failed = true
+		} else {
+			fmt.Printf("ok: %s\n", c.Name)
+		}
+	}
+	return
+}
+
+func main() {
+	if run() {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	ctlcompat "github.com/Tualua/pk_ctladm/pk_ctlcompat"
+)
+
+// Exit codes follow sysexits(3), anything unclassified exits with 1 like
+// FreeBSD ctladm does.
+const (
+	EXIT_OK       int = 0
+	EXIT_FAILURE  int = 1
+	EXIT_USAGE    int = 64
+	EXIT_NOINPUT  int = 66
+	EXIT_TEMPFAIL int = 75
+)
+
+// ExitCode maps the kind of err to an exit code. Only bad command lines and
+// options that do not validate are usage errors, SCST refusing a write is a
+// plain failure.
+func ExitCode(err error) int {
+	switch ctlcompat.ErrorKind(err) {
+	case nil:
+		if err == nil {
+			return EXIT_OK
+		}
+		return EXIT_FAILURE
+	case ctlcompat.ErrUsage, ctlcompat.ErrInvalid:
+		return EXIT_USAGE
+	case ctlcompat.ErrNotFound:
+		return EXIT_NOINPUT
+	case ctlcompat.ErrBusy:
+		return EXIT_TEMPFAIL
+	}
+	return EXIT_FAILURE
+}
+
+func ReportError(command string, err error) int {
+	log.Errorf("%s: %v", command, err)
+	fmt.Fprintf(os.Stderr, "ctladm: %s\n", err)
+	return ExitCode(err)
+}
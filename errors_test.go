@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"syscall"
+	"testing"
+
+	ctlcompat "github.com/Tualua/pk_ctladm/pk_ctlcompat"
+	zfs "github.com/Tualua/pk_ctladm/pk_zfs"
+)
+
+func TestExitCode(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		want int
+	}{
+		{nil, EXIT_OK},
+		{errors.New("failed"), EXIT_FAILURE},
+		{fmt.Errorf("cannot add device: %w", syscall.EINVAL), EXIT_FAILURE},
+		{ctlcompat.CtlErrorf(ctlcompat.ErrUsage, "LUN ID must be specified"), EXIT_USAGE},
+		{ctlcompat.CtlErrorf(ctlcompat.ErrInvalid, "invalid ctld_name"), EXIT_USAGE},
+		{ctlcompat.CtlErrorf(ctlcompat.ErrNotFound, "port 9 not found"), EXIT_NOINPUT},
+		{fmt.Errorf("cannot read: %w", fs.ErrNotExist), EXIT_NOINPUT},
+		{fmt.Errorf("LUN removal error: %w", &zfs.ZfsError{Kind: zfs.ErrNotFound, Err: errors.New("dataset does not exist")}), EXIT_NOINPUT},
+		{ctlcompat.CtlErrorf(ctlcompat.ErrBusy, "requested LUN ID 5 is already in use"), EXIT_TEMPFAIL},
+		{fmt.Errorf("cannot close session: %w", syscall.EBUSY), EXIT_TEMPFAIL},
+		{fmt.Errorf("LUN removal error: %w", &zfs.ZfsError{Kind: zfs.ErrBusy, Err: errors.New("dataset is busy")}), EXIT_TEMPFAIL},
+		{fmt.Errorf("LUN creation error: %w", &zfs.ZfsError{Kind: zfs.ErrExists, Err: errors.New("dataset already exists")}), EXIT_TEMPFAIL},
+	} {
+		if got := ExitCode(c.err); got != c.want {
+			t.Errorf("ExitCode(%v) = %d, want %d", c.err, got, c.want)
+		}
+	}
+}
@@ -4,6 +4,7 @@ go 1.19
 
 require (
 	github.com/Tualua/pk_ctladm/pk_scst v0.0.0-20221006061759-514390471c0c
+	github.com/Tualua/pk_ctladm/pk_zfs v0.0.0-00010101000000-000000000000
 	github.com/akamensky/argparse v1.4.0
 )
 
@@ -13,3 +14,5 @@ require (
 )
 
 replace github.com/Tualua/pk_ctladm/pk_scst v0.0.0-20221006061759-514390471c0c => ./pk_scst
+
+replace github.com/Tualua/pk_ctladm/pk_zfs => ./pk_zfs
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"text/template"
+
+	ctlcompat "github.com/Tualua/pk_ctladm/pk_ctlcompat"
+)
+
+const (
+	FORMAT_TEXT string = "text"
+	FORMAT_XML  string = "xml"
+	FORMAT_JSON string = "json"
+)
+
+var FORMATS = []string{FORMAT_TEXT, FORMAT_XML, FORMAT_JSON}
+
+// ListFormat picks the output format of a list command from -x, --json,
+// --format and --template, which must not contradict each other.
+func ListFormat(xFlag bool, jsonFlag bool, format string, tmpl *template.Template) (res string, err error) {
+	res = format
+	for _, flag := range []struct {
+		set    bool
+		format string
+	}{{xFlag, FORMAT_XML}, {jsonFlag, FORMAT_JSON}, {tmpl != nil, FORMAT_TEMPLATE}} {
+		if !flag.set {
+			continue
+		}
+		if res != "" && res != flag.format {
+			return "", ctlcompat.CtlErrorf(ctlcompat.ErrUsage, "conflicting output formats %s and %s", res, flag.format)
+		}
+		res = flag.format
+	}
+	if res == "" {
+		res = FORMAT_TEXT
+	}
+	return
+}
+
+type JsonLunList struct {
+	Luns []ctlcompat.Lun `json:"luns"`
+}
+
+type JsonPortList struct {
+	Ports []ctlcompat.Port `json:"ports"`
+}
+
+type JsonIsList struct {
+	Sessions []ctlcompat.Session `json:"sessions"`
+}
+
+func PrintJson(command string, v interface{}) (err error) {
+	if outJson, err := json.MarshalIndent(v, "", "  "); err != nil {
+		return fmt.Errorf("%s: error marshalling to JSON: %w", command, err)
+	} else {
+		log.Trace("JSON Output:")
+		log.Trace(string(outJson))
+		fmt.Println(string(outJson))
+	}
+	return
+}
@@ -1,200 +1,576 @@
 package main
 
 import (
-	"encoding/xml"
+	"errors"
 	"fmt"
 	"os"
-	"path/filepath"
+	"strconv"
 	"strings"
+	"text/template"
+	"time"
 
+	ctlcompat "github.com/Tualua/pk_ctladm/pk_ctlcompat"
 	scst "github.com/Tualua/pk_ctladm/pk_scst"
+	zfs "github.com/Tualua/pk_ctladm/pk_zfs"
 	"github.com/akamensky/argparse"
 	"github.com/sirupsen/logrus"
 )
 
 var log = logrus.New()
 
-func GetDevList(xFlag bool) {
-	DevList := [][]string{}
-	if LunIds, err := GetLunIds(); err != nil {
-		err = fmt.Errorf("cannot get LUNs IDs: %w", err)
-		log.Errorf("GetDevList: %w", err)
-		fmt.Println(err)
-	} else {
-		if Devices, err := scst.ScstGetDevices(); err != nil {
-			err = fmt.Errorf("cannot get devices: %w", err)
-			log.Errorf("GetDevList: %w", err)
-			fmt.Println(err)
+func LunRow(lun ctlcompat.Lun) []string {
+	target, lunNum := lun.Export()
+	return []string{
+		strconv.Itoa(lun.Id),
+		lun.BackendType,
+		strconv.FormatUint(lun.Size, 10),
+		strconv.Itoa(lun.Blocksize),
+		lun.SerialNumber,
+		lun.DeviceId,
+		lun.File,
+		target,
+		strconv.Itoa(lun.NumThreads),
+		lunNum,
+	}
+}
+
+func GetDevList(format string, tmpl *template.Template, vFlag bool) (err error) {
+	var (
+		luns []ctlcompat.Lun
+	)
+	if luns, err = ctlcompat.GetLuns(); err != nil {
+		return fmt.Errorf("cctl_devlist: error issuing CTL_LUN_LIST ioctl: %w", err)
+	}
+	if !vFlag && tmpl == nil {
+		for i := range luns {
+			if format == FORMAT_XML {
+				luns[i].Options = luns[i].InquiryOptions()
+			} else {
+				luns[i].Options = nil
+			}
+		}
+	}
+	switch format {
+	case FORMAT_JSON:
+		return PrintJson("cctl_devlist", JsonLunList{Luns: append([]ctlcompat.Lun{}, luns...)})
+	case FORMAT_TEMPLATE:
+		for _, lun := range luns {
+			if err = PrintTemplate("cctl_devlist", tmpl, lun); err != nil {
+				return
+			}
+		}
+	case FORMAT_XML:
+		if outXml, err := ctlcompat.MarshalLunsXml(luns); err != nil {
+			return fmt.Errorf("cctl_devlist: error marshalling to XML: %w", err)
 		} else {
-			DevicesFiltered := []string{}
-			for _, dev := range Devices {
-				if !strings.Contains(dev, ":") {
-					DevicesFiltered = append(DevicesFiltered, dev)
+			log.Trace("XML Output:")
+			log.Trace(string(outXml))
+			fmt.Println(string(outXml))
+		}
+	default:
+		for _, lun := range luns {
+			fmt.Println(strings.Join(LunRow(lun), "\t"))
+			if vFlag {
+				for _, name := range ctlcompat.OptionNames(lun.Options) {
+					fmt.Printf("      %s=%s\n", name, lun.Options[name])
 				}
 			}
-			for _, dev := range DevicesFiltered {
-				if params, err := scst.ScstGetDeviceParams(dev); err != nil {
-					err = fmt.Errorf("cannot get device %s parameters: %w", dev, err)
-					log.Errorf("GetDevList: %w", err)
-					fmt.Println(err)
-				} else {
-					if relId, ok := LunIds[params["filename"]]; ok {
-						device := []string{
-							relId,
-							"block",
-							params["size"],
-							params["blocksize"],
-							params["usn"],
-							filepath.Base(params["filename"]),
-							params["filename"],
-							FindDeviceWwn(dev),
-							params["threads_num"],
-						}
-						DevList = append(DevList, device)
-						log.Trace(device)
-					}
-				}
+		}
+	}
+	return
+}
+
+func GetPortList(format string, tmpl *template.Template, lFlag bool, vFlag bool, iFlag bool, frontend string, portId string) (err error) {
+	var (
+		ports    []ctlcompat.Port
+		selected = []ctlcompat.Port{}
+	)
+	if ports, err = ctlcompat.GetPorts(); err != nil {
+		return fmt.Errorf("cctl_portlist: error issuing CTL_PORT_LIST ioctl: %w", err)
+	}
+	for _, port := range ports {
+		if frontend != "" && port.FrontendType != frontend {
+			continue
+		}
+		if portId != "" && strconv.Itoa(port.Id) != portId {
+			continue
+		}
+		if !vFlag && tmpl == nil {
+			port.Options = nil
+		}
+		selected = append(selected, port)
+	}
+	switch format {
+	case FORMAT_JSON:
+		return PrintJson("cctl_portlist", JsonPortList{Ports: selected})
+	case FORMAT_TEMPLATE:
+		for _, port := range selected {
+			if err = PrintTemplate("cctl_portlist", tmpl, port); err != nil {
+				return
 			}
-			if xFlag {
-				XmlDevList := new(CtldLunList)
-				for _, device := range DevList {
-					XmlDevList.Luns = append(XmlDevList.Luns, LunFromSlice(device))
+		}
+	case FORMAT_XML:
+		if outXml, err := ctlcompat.MarshalPortsXml(selected); err != nil {
+			return fmt.Errorf("cctl_portlist: error marshalling to XML: %w", err)
+		} else {
+			log.Trace("XML Output:")
+			log.Trace(string(outXml))
+			fmt.Println(string(outXml))
+		}
+	default:
+		for _, port := range selected {
+			online := "NO"
+			if port.Online {
+				online = "YES"
+			}
+			fmt.Println(strings.Join([]string{
+				strconv.Itoa(port.Id),
+				online,
+				port.FrontendType,
+				port.FrontendType,
+				port.PortName,
+				port.Target,
+			}, "\t"))
+			if vFlag {
+				for _, name := range ctlcompat.OptionNames(port.Options) {
+					fmt.Printf("      %s=%s\n", name, port.Options[name])
 				}
-				if outXml, err := xml.MarshalIndent(XmlDevList, "", "        "); err != nil {
-					err = fmt.Errorf("error marshalling to XML. %s", err)
-					log.Errorf("GetDevList: %w", err)
-					fmt.Println(err)
-				} else {
-					log.Trace("XML Output:")
-					log.Trace(string(outXml))
-					fmt.Println(string(outXml))
+			}
+			if iFlag {
+				for _, initiator := range port.Initiators {
+					fmt.Printf("      Initiator %d: %s\n", initiator.Id, initiator.Name)
 				}
-			} else {
-				for _, device := range DevList {
-					fmt.Println(strings.Join(device, "\t"))
+			}
+			if lFlag {
+				for _, lun := range port.Luns {
+					fmt.Printf("      LUN %d: %d\n", lun.Lun, lun.Id)
 				}
 			}
 		}
 	}
+	return
 }
 
-func GetPortList(xFlag bool) {
-	PortList := [][]string{}
-	if LunIds, err := GetLunIds(); err != nil {
-		err = fmt.Errorf("error getting LUN IDs: %w", err)
-		log.Errorf("GetPortList: %w", err)
-		fmt.Println(err)
-	} else {
-		if Devices, err := scst.ScstGetDevices(); err != nil {
-			err = fmt.Errorf("error getting devices %w", err)
-			log.Errorf("GetPortList: %w", err)
-			fmt.Println(err)
+func RemoveLun(backend string, lun string, purge bool, deleteTarget bool, zfsMode string) (err error) {
+	if backend != "" {
+		if _, err = ctlcompat.BackendHandler(backend, 0); err != nil {
+			return ctlcompat.CtlErrorf(ctlcompat.ErrUsage, "LUN removal error: %w", err)
+		}
+	}
+	if lun == "" {
+		return ctlcompat.CtlErrorf(ctlcompat.ErrUsage, "cctl_rm_lun: LUN ID must be specified")
+	}
+	if !purge {
+		if device, err := ctlcompat.DeactivateLun(backend, lun); err != nil {
+			return fmt.Errorf("LUN removal error: %w", err)
 		} else {
-			DevicesFiltered := []string{}
-			for _, dev := range Devices {
-				if !strings.Contains(dev, ":") {
-					DevicesFiltered = append(DevicesFiltered, dev)
-				}
+			fmt.Printf("LUN %s (%s) deactivated\n", lun, device)
+		}
+		return
+	}
+	if err = ctlcompat.PurgeLun(backend, lun, deleteTarget, zfsMode, func(msgInfo string) {
+		fmt.Println(msgInfo)
+	}); err != nil {
+		return fmt.Errorf("LUN removal error: %w", err)
+	}
+	fmt.Printf("LUN %s removed successfully\n", lun)
+	return
+}
+
+func CreateLun(backend string, lunType int, size string, options []string, dev string, lun string) (err error) {
+	var (
+		lunOptions map[string]string
+		created    ctlcompat.Lun
+	)
+	if lunOptions, err = ctlcompat.ParseCtlOptions(options); err != nil {
+		return ctlcompat.CtlErrorf(ctlcompat.ErrUsage, "LUN creation error: %w", err)
+	}
+	if size != "" {
+		lunOptions["size"] = size
+	}
+	if created, err = ctlcompat.CreateLun(backend, lunType, lunOptions, dev, lun); err != nil {
+		return fmt.Errorf("LUN creation error: %w", err)
+	}
+	fmt.Println("LUN created successfully")
+	fmt.Printf("backend:       %s\n", created.BackendType)
+	fmt.Printf("device type:   %d\n", created.LunType)
+	fmt.Printf("LUN size:      %d bytes\n", created.Size*uint64(created.Blocksize))
+	fmt.Printf("blocksize      %d bytes\n", created.Blocksize)
+	fmt.Printf("LUN ID:        %d\n", created.Id)
+	fmt.Printf("Serial Number: %s\n", created.SerialNumber)
+	fmt.Printf("Device ID:     %s\n", created.DeviceId)
+	return
+}
+
+func ModifyLun(backend string, options []string, lun string) (err error) {
+	var (
+		lunOptions map[string]string
+		before     ctlcompat.Lun
+		after      ctlcompat.Lun
+	)
+	if backend != "" {
+		if _, err = ctlcompat.BackendHandler(backend, 0); err != nil {
+			return ctlcompat.CtlErrorf(ctlcompat.ErrUsage, "LUN modification error: %w", err)
+		}
+	}
+	if lun == "" {
+		return ctlcompat.CtlErrorf(ctlcompat.ErrUsage, "cctl_modify_lun: lun ID must be specified")
+	}
+	if lunOptions, err = ctlcompat.ParseCtlOptions(options); err != nil {
+		return ctlcompat.CtlErrorf(ctlcompat.ErrUsage, "LUN modification error: %w", err)
+	}
+	if before, after, err = ctlcompat.ModifyLun(backend, lun, lunOptions); err != nil {
+		return fmt.Errorf("LUN modification error: %w", err)
+	}
+	fmt.Println("LUN modified successfully")
+	fmt.Println("before\t" + strings.Join(LunRow(before), "\t"))
+	fmt.Println("after\t" + strings.Join(LunRow(after), "\t"))
+	return
+}
+
+func IsList(format string, tmpl *template.Template, vFlag bool, lun string) (err error) {
+	var (
+		sessions []ctlcompat.Session
+	)
+	if sessions, err = ctlcompat.GetSessions(lun); err != nil {
+		return fmt.Errorf("cctl_islist: error issuing CTL_ISCSI ioctl: %w", err)
+	}
+	switch format {
+	case FORMAT_JSON:
+		return PrintJson("cctl_islist", JsonIsList{Sessions: append([]ctlcompat.Session{}, sessions...)})
+	case FORMAT_TEMPLATE:
+		for _, session := range sessions {
+			if err = PrintTemplate("cctl_islist", tmpl, session); err != nil {
+				return
 			}
-			for _, dev := range DevicesFiltered {
-				if params, err := scst.ScstGetDeviceParams(dev); err != nil {
-					err = fmt.Errorf("error getting device %s parameters %s", dev, err)
-					log.Errorf("GetPortList: %w", err)
-					log.Println(err)
-				} else {
-					if relId, ok := LunIds[params["filename"]]; ok {
-						portActive := "NO"
-						if params["active"] == "1" {
-							portActive = "YES"
-						}
-						wwn := FindDeviceWwn(dev)
-						port := []string{
-							relId,
-							portActive,
-							"iscsi",
-							"iscsi",
-							fmt.Sprintf("%s,t,0x0101", wwn),
-							wwn,
-						}
-						log.Trace(port)
-						PortList = append(PortList, port)
-					}
+		}
+	case FORMAT_XML:
+		if outXml, err := ctlcompat.MarshalSessionsXml(sessions); err != nil {
+			return fmt.Errorf("cctl_islist: error marshalling to XML: %w", err)
+		} else {
+			log.Trace("XML Output:")
+			log.Trace(string(outXml))
+			fmt.Println(string(outXml))
+		}
+	default:
+		if vFlag {
+			for _, session := range sessions {
+				immediateData := "No"
+				if session.ImmediateData {
+					immediateData = "Yes"
 				}
+				fmt.Printf("Session ID:       %s\n", session.Id)
+				fmt.Printf("Initiator:        %s\n", session.Initiator)
+				fmt.Printf("Initiator portal: %s\n", session.InitiatorAddr)
+				fmt.Printf("Initiator alias:  %s\n", session.InitiatorAlias)
+				fmt.Printf("Connections:      %d\n", session.Connections)
+				fmt.Printf("Target:           %s\n", session.Target)
+				fmt.Printf("Target alias:     %s\n", session.TargetAlias)
+				fmt.Printf("Target portal group tag: %d\n", session.TargetPortalGroupTag)
+				fmt.Printf("Header digest:    %s\n", session.HeaderDigest)
+				fmt.Printf("Data digest:      %s\n", session.DataDigest)
+				fmt.Printf("DataSegmentLen:   %d/%d\n", session.MaxRecvDataSegmentLength, session.MaxSendDataSegmentLength)
+				fmt.Printf("MaxBurstLen:      %d\n", session.MaxBurstLength)
+				fmt.Printf("FirstBurstLen:    %d\n", session.FirstBurstLength)
+				fmt.Printf("ImmediateData:    %s\n", immediateData)
+				fmt.Printf("iSER (RDMA):      %s\n", "No")
+				fmt.Printf("Offload driver:   %s\n", session.Offload)
+				fmt.Println()
 			}
-			if xFlag {
-				XmlPortList := new(CtldPortList)
-				for _, device := range PortList {
-					XmlPortList.Ports = append(XmlPortList.Ports, PortFromSlice(device))
-				}
-				if outXml, err := xml.MarshalIndent(XmlPortList, "", "        "); err != nil {
-					err = fmt.Errorf("error marshalling to XML. %s", err)
-					log.Errorf("GetPortList: %w", err)
-					log.Println(err)
-				} else {
-					log.Trace("XML Output:")
-					log.Trace(string(outXml))
-					fmt.Println(string(outXml))
-				}
-			} else {
-				for _, device := range PortList {
-					fmt.Println(strings.Join(device, "\t"))
-				}
+		} else {
+			fmt.Printf("%-18s %-18s %-6s %-36s %-36s\n", "ID", "Portal", "Conns", "Initiator name", "Target name")
+			for _, session := range sessions {
+				fmt.Printf("%-18s %-18s %-6d %-36s %-36s\n", session.Id, session.InitiatorAddr, session.Connections, session.Initiator, session.Target)
 			}
 		}
 	}
+	return
 }
 
-func RemoveLun(lun string) {
-	if device, err := FindLunDevice(lun); err != nil {
-		err = fmt.Errorf("cannot find corresponding device for LUN %s: %w", lun, err)
-		log.Errorf("RemoveLun: %w", err)
-		fmt.Println(err)
-	} else {
-		if err := scst.ScstDeactivateDevice(device); err != nil {
-			err = fmt.Errorf("failed to deactivate device %s", lun)
-			log.Errorf("RemoveLun: %w", err)
-			fmt.Println(err)
+func IsLogout(all bool, lun string, target string, initiator string, portal string, timeout int) (err error) {
+	var (
+		selected []scst.ScstIscsiSession
+		failed   error
+	)
+	if !all && lun == "" && target == "" && initiator == "" && portal == "" {
+		return ctlcompat.CtlErrorf(ctlcompat.ErrUsage, "cctl_islogout: either -a, -l, -t, -i or -p must be specified")
+	}
+	if selected, err = ctlcompat.SelectSessions(ctlcompat.SessionFilter{
+		Lun:       lun,
+		Target:    target,
+		Initiator: initiator,
+		Portal:    portal,
+	}); err != nil {
+		return fmt.Errorf("cctl_islogout: error issuing CTL_ISCSI ioctl: %w", err)
+	}
+	if len(selected) == 0 {
+		return ctlcompat.CtlErrorf(ctlcompat.ErrNotFound, "cctl_islogout: error returned from CTL iSCSI logout request: No matching connections found")
+	}
+	for _, session := range selected {
+		if err := ctlcompat.LogoutSession(session, time.Duration(timeout)*time.Second); err != nil {
+			failed = fmt.Errorf("cctl_islogout: error returned from CTL iSCSI logout request: %w", err)
 		} else {
-			msgInfo := fmt.Sprintf("LUN %s (%s) deactivated", lun, device)
-			log.Info(msgInfo)
-			fmt.Println(msgInfo)
+			fmt.Printf("Session %s (%s) on %s closed\n", session.Sid, session.InitiatorName, session.Target)
 		}
+	}
+	if failed != nil {
+		return failed
+	}
+	fmt.Println("iSCSI logout requests completed")
+	return
+}
 
+// portErrorf reports a port that does not exist as such and anything else
+// as a failed CTL ioctl.
+func portErrorf(command string, ioctl string, err error) error {
+	if errors.Is(err, ctlcompat.ErrNotFound) {
+		return ctlcompat.CtlErrorf(ctlcompat.ErrNotFound, "%s: %w", command, err)
 	}
+	return fmt.Errorf("%s: error issuing %s ioctl: %w", command, ioctl, err)
 }
 
-func CreateLun(dev string) {
-	if err := scst.ScstActivateDevice(dev); err != nil {
-		err = fmt.Errorf("failed to activate device %s: %w", dev, err)
-		log.Errorf("CreateLun: %w", err)
+func SetPortState(mode string, port string, driver bool) (err error) {
+	var (
+		enabled bool
+	)
+	switch mode {
+	case "on":
+		enabled = true
+	case "off":
+		enabled = false
+	default:
+		return ctlcompat.CtlErrorf(ctlcompat.ErrUsage, "cctl_port: invalid port mode %s, expected on or off", mode)
+	}
+	if port == "" && !driver {
+		return ctlcompat.CtlErrorf(ctlcompat.ErrUsage, "cctl_port: either -p or -g must be specified")
+	}
+	if port != "" {
+		if _, err = ctlcompat.SetPortEnabled(port, enabled); err != nil {
+			return portErrorf("cctl_port", "CTL_PORT_REQ", err)
+		}
+	}
+	if driver {
+		if err = ctlcompat.SetDriverEnabled(enabled); err != nil {
+			return portErrorf("cctl_port", "CTL_PORT_REQ", err)
+		}
+	}
+	if enabled {
+		fmt.Println("Front End Ports enabled")
 	} else {
-		msgInfo := fmt.Sprintf("Device %s activated", dev)
-		log.Info(msgInfo)
-		fmt.Println(msgInfo)
+		fmt.Println("Front End Ports disabled")
 	}
+	return
+}
+
+func MapLun(port string, portLun int, lun string, group string) (err error) {
+	var (
+		device string
+	)
+	if portLun < 0 {
+		return ctlcompat.CtlErrorf(ctlcompat.ErrUsage, "cctl_lunmap: LUN number (-l) must be specified")
+	}
+	if lun == "" {
+		if err = ctlcompat.UnmapLun(port, portLun, group); err != nil {
+			return portErrorf("cctl_lunmap", "CTL_LUN_MAP", err)
+		}
+		fmt.Printf("LUN %d of port %s unmapped\n", portLun, port)
+		return
+	}
+	if device, err = ctlcompat.MapLun(port, portLun, lun, group); err != nil {
+		return portErrorf("cctl_lunmap", "CTL_LUN_MAP", err)
+	}
+	fmt.Printf("LUN %d of port %s mapped to LUN %s (%s)\n", portLun, port, lun, device)
+	return
+}
+
+func ImportXml(devlistPath string, portlistPath string, dryRun bool, partial bool) (err error) {
+	var (
+		data  []byte
+		luns  []ctlcompat.Lun
+		ports []ctlcompat.Port
+		plan  ctlcompat.Plan
+	)
+	if devlistPath == "" {
+		return ctlcompat.CtlErrorf(ctlcompat.ErrUsage, "import: --from-xml must be specified")
+	}
+	if data, err = os.ReadFile(devlistPath); err != nil {
+		return ctlcompat.CtlErrorf(ctlcompat.ErrNotFound, "import: %w", err)
+	}
+	if luns, err = ctlcompat.UnmarshalLunsXml(data); err != nil {
+		return ctlcompat.CtlErrorf(ctlcompat.ErrUsage, "import: %s: cannot parse LUN list: %w", devlistPath, err)
+	}
+	if portlistPath != "" {
+		if data, err = os.ReadFile(portlistPath); err != nil {
+			return ctlcompat.CtlErrorf(ctlcompat.ErrNotFound, "import: %w", err)
+		}
+		if ports, err = ctlcompat.UnmarshalPortsXml(data); err != nil {
+			return ctlcompat.CtlErrorf(ctlcompat.ErrUsage, "import: %s: cannot parse port list: %w", portlistPath, err)
+		}
+		if ports == nil {
+			ports = []ctlcompat.Port{}
+		}
+	}
+	if plan, err = ctlcompat.PlanImport(luns, ports); err != nil {
+		return fmt.Errorf("import: %w", err)
+	}
+	if PrintPlan(plan, "import", dryRun); dryRun {
+		return
+	}
+	if len(plan.Problems) > 0 && !partial {
+		return fmt.Errorf("import: %d items cannot be imported, nothing changed; use --partial to import the rest", len(plan.Problems))
+	}
+	if err = plan.Apply(func(desc string) {
+		fmt.Println(desc)
+	}); err != nil {
+		return fmt.Errorf("import: %w", err)
+	}
+	fmt.Printf("Import completed, %d actions\n", len(plan.Actions))
+	return
+}
+
+// PrintPlan lists the problems and notes of a plan, and with dryRun the
+// actions it would take.
+func PrintPlan(plan ctlcompat.Plan, verb string, dryRun bool) {
+	for _, problem := range plan.Problems {
+		fmt.Printf("cannot %s: %s\n", verb, problem)
+	}
+	for _, note := range plan.Notes {
+		fmt.Printf("note: %s\n", note)
+	}
+	if dryRun {
+		for _, action := range plan.Actions {
+			fmt.Printf("would %s\n", action.Desc)
+		}
+	}
+}
+
+func ApplyCtlConf(confPath string, dryRun bool, prune bool) (err error) {
+	var (
+		data []byte
+		conf *ctlcompat.CtlConf
+		plan ctlcompat.Plan
+	)
+	if data, err = os.ReadFile(confPath); err != nil {
+		return ctlcompat.CtlErrorf(ctlcompat.ErrNotFound, "apply-ctlconf: %w", err)
+	}
+	if conf, err = ctlcompat.ParseCtlConf(data); err != nil {
+		return ctlcompat.CtlErrorf(ctlcompat.ErrUsage, "apply-ctlconf: %s: %w", confPath, err)
+	}
+	if plan, err = ctlcompat.PlanCtlConf(conf, prune); err != nil {
+		return fmt.Errorf("apply-ctlconf: %w", err)
+	}
+	if PrintPlan(plan, "apply", dryRun); dryRun {
+		return
+	}
+	if len(plan.Problems) > 0 {
+		return fmt.Errorf("apply-ctlconf: %d items cannot be applied, nothing changed", len(plan.Problems))
+	}
+	if err = plan.Apply(func(desc string) {
+		fmt.Println(desc)
+	}); err != nil {
+		return fmt.Errorf("apply-ctlconf: %w", err)
+	}
+	fmt.Printf("Configuration applied, %d actions\n", len(plan.Actions))
+	return
+}
+
+func ScstApply(confPath string, dryRun bool) (err error) {
+	var (
+		data   []byte
+		conf   *scst.ScstConfig
+		writes []scst.ScstConfWrite
+	)
+	if data, err = os.ReadFile(confPath); err != nil {
+		return ctlcompat.CtlErrorf(ctlcompat.ErrNotFound, "scst-apply: %w", err)
+	}
+	if conf, err = scst.ParseScstConfig(data); err != nil {
+		return ctlcompat.CtlErrorf(ctlcompat.ErrUsage, "scst-apply: %s: %w", confPath, err)
+	}
+	if writes, err = scst.ScstPlanConfig(conf); err != nil {
+		return fmt.Errorf("scst-apply: %w", err)
+	}
+	if dryRun {
+		for _, w := range writes {
+			fmt.Println(w)
+		}
+		return
+	}
+	if err = scst.ScstApplyConfig(writes, func(w scst.ScstConfWrite) {
+		fmt.Println(w)
+	}); err != nil {
+		return fmt.Errorf("scst-apply: %w", err)
+	}
+	fmt.Printf("Configuration applied, %d writes\n", len(writes))
+	return
+}
+
+func ExportConfig(format string, output string) (err error) {
+	var (
+		b strings.Builder
+	)
+	switch format {
+	case "ctl.conf":
+		var conf *ctlcompat.CtlConf
+		if conf, err = ctlcompat.CtlConfFromScst(); err == nil {
+			for _, note := range conf.Notes {
+				fmt.Fprintf(os.Stderr, "note: %s\n", note)
+			}
+			err = conf.Write(&b)
+		}
+	case "scst.conf":
+		var conf *scst.ScstConfig
+		if conf, err = scst.ScstReadConfig(); err == nil {
+			err = conf.Write(&b)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+	if output == "" || output == "-" {
+		fmt.Print(b.String())
+	} else if err = os.WriteFile(output, []byte(b.String()), 0600); err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+	return
 }
 
 func init() {
 	var (
 		logFilePath string
+		configPath  string
 	)
 	log.SetFormatter(&logrus.TextFormatter{})
 	log.SetLevel(logrus.DebugLevel)
+	ctlcompat.SetLogger(log)
+	scst.SetLogger(log)
+	zfs.SetLogger(log)
 	if os.Getenv("CTLADM_DEBUG") == "true" {
 		logFilePath = "ctladm.log"
-		fmt.Println("WARNING! Running in development environment")
+		fmt.Fprintln(os.Stderr, "WARNING! Running in development environment")
 	} else {
 		logFilePath = "/var/log/ctladm.log"
 	}
 
 	if logFile, err := os.OpenFile(logFilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666); err != nil {
 		err = fmt.Errorf("failed to log to file, using stderr: %w", err)
-		log.Infof("init: %w", err)
-		fmt.Println(err)
+		log.Infof("init: %v", err)
+		fmt.Fprintln(os.Stderr, err)
 
 	} else {
 		log.SetOutput(logFile)
 	}
+
+	if configPath = os.Getenv("CTLADM_CONFIG"); configPath == "" {
+		configPath = CTLADM_CONFIG_PATH
+	}
+	if err := LoadConfig(configPath); err != nil {
+		err = fmt.Errorf("failed to load config, using defaults: %w", err)
+		log.Errorf("init: %v", err)
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if scstRoot := os.Getenv("CTLADM_SCST_ROOT"); scstRoot != "" {
+		config.ScstRoot = scstRoot
+	}
 }
 
 func main() {
@@ -202,51 +578,248 @@ func main() {
 		err error
 	)
 	parser := argparse.NewParser("ctladm", "Replacement for ctladm for Linux Playkey SDS")
+	argScstRoot := parser.String("", "scst-root", &argparse.Options{Help: "SCST sysfs root", Default: config.ScstRoot})
 
 	parserDevlist := parser.NewCommand("devlist", "List devices")
 	argDevListXml := parserDevlist.Flag("x", "xml", &argparse.Options{Help: "Enable XML Output"})
+	argDevListJson := parserDevlist.Flag("", "json", &argparse.Options{Help: "Enable JSON Output"})
+	argDevListFormat := parserDevlist.Selector("", "format", FORMATS, &argparse.Options{Help: "Output format"})
+	argDevListTemplate := parserDevlist.String("", "template", &argparse.Options{Help: "Go template executed for every item"})
+	argDevListTemplateFile := parserDevlist.String("", "template-file", &argparse.Options{Help: "File with a Go template executed for every item"})
+	argDevListVerbose := parserDevlist.Flag("v", "verbose", &argparse.Options{Help: "Show every device attribute"})
 
 	parserPortlist := parser.NewCommand("portlist", "List ports")
 	argPortListXml := parserPortlist.Flag("x", "xml", &argparse.Options{Help: "Enable XML Output"})
+	argPortListJson := parserPortlist.Flag("", "json", &argparse.Options{Help: "Enable JSON Output"})
+	argPortListFormat := parserPortlist.Selector("", "format", FORMATS, &argparse.Options{Help: "Output format"})
+	argPortListTemplate := parserPortlist.String("", "template", &argparse.Options{Help: "Go template executed for every item"})
+	argPortListTemplateFile := parserPortlist.String("", "template-file", &argparse.Options{Help: "File with a Go template executed for every item"})
+	argPortListLuns := parserPortlist.Flag("l", "luns", &argparse.Options{Help: "Show LUN mappings"})
+	argPortListVerbose := parserPortlist.Flag("v", "verbose", &argparse.Options{Help: "Show every target attribute"})
+	argPortListInitiators := parserPortlist.Flag("i", "initiators", &argparse.Options{Help: "Show connected initiators"})
+	argPortListFrontend := parserPortlist.String("f", "frontend", &argparse.Options{Help: "Show only ports of this frontend type"})
+	argPortListPort := parserPortlist.String("p", "port", &argparse.Options{Help: "Show only this port"})
 
-	parserRemove := parser.NewCommand("remove", "Remove port")
-	argRemoveB := parserRemove.String("b", "b", &argparse.Options{Help: "Accepts only \"block\""})
+	parserRemove := parser.NewCommand("remove", "Remove LUN")
+	argRemoveB := parserRemove.String("b", "b", &argparse.Options{Help: "Backend type: block, file or ramdisk, checked against the LUN"})
 	argRemoveLun := parserRemove.String("l", "lun", &argparse.Options{Help: "LUN ID"})
+	argRemovePurge := parserRemove.Flag("", "purge", &argparse.Options{Help: "Delete the device and its LUN mappings instead of deactivating it"})
+	argRemoveDeleteTarget := parserRemove.Flag("", "delete-target", &argparse.Options{Help: "With --purge, also delete targets left without LUNs"})
+	argRemoveZfs := parserRemove.Selector("", "zfs", []string{"none", "destroy", "snapshot"}, &argparse.Options{Help: "With --purge, destroy or snapshot the backing zvol", Default: config.RemoveZfs})
 
-	parserCreate := parser.NewCommand("create", "Create port")
-	argCreateB := parserCreate.String("b", "b", &argparse.Options{Help: "Accepts only \"block\""})
-	argCreateOptions := parserCreate.StringList("o", "options", &argparse.Options{Help: "Options"})
-	argCreateDevice := parserCreate.String("d", "device", &argparse.Options{Help: "Device ID"})
+	parserCreate := parser.NewCommand("create", "Create LUN")
+	argCreateB := parserCreate.String("b", "b", &argparse.Options{Help: "Backend type: block (vdisk_blockio), file (vdisk_fileio) or ramdisk (vdisk_nullio)", Default: "block"})
+	argCreateT := parserCreate.Int("t", "t", &argparse.Options{Help: "Device type, 0 for a disk or 5 for a CD-ROM (vcdrom)", Default: 0})
+	argCreateS := parserCreate.String("s", "s", &argparse.Options{Help: "Size of a ramdisk LUN, e.g. 100G"})
+	argCreateOptions := parserCreate.StringList("o", "options", &argparse.Options{Help: "Options in name=value format, file=<path> is required except for ramdisk"})
+	argCreateDevice := parserCreate.String("d", "device", &argparse.Options{Help: "Device ID, defaults to the file name"})
 	argCreateLun := parserCreate.String("l", "lun", &argparse.Options{Help: "LUN ID"})
 
+	parserModify := parser.NewCommand("modify", "Modify LUN")
+	argModifyB := parserModify.String("b", "b", &argparse.Options{Help: "Backend type: block, file or ramdisk, checked against the LUN"})
+	argModifyLun := parserModify.String("l", "lun", &argparse.Options{Help: "LUN ID"})
+	argModifyOptions := parserModify.StringList("o", "options", &argparse.Options{Help: "Options in name=value format, size=<size> grows the LUN"})
+
+	parserIslist := parser.NewCommand("islist", "List iSCSI sessions")
+	argIsListXml := parserIslist.Flag("x", "xml", &argparse.Options{Help: "Enable XML Output"})
+	argIsListJson := parserIslist.Flag("", "json", &argparse.Options{Help: "Enable JSON Output"})
+	argIsListFormat := parserIslist.Selector("", "format", FORMATS, &argparse.Options{Help: "Output format"})
+	argIsListTemplate := parserIslist.String("", "template", &argparse.Options{Help: "Go template executed for every item"})
+	argIsListTemplateFile := parserIslist.String("", "template-file", &argparse.Options{Help: "File with a Go template executed for every item"})
+	argIsListVerbose := parserIslist.Flag("v", "verbose", &argparse.Options{Help: "Show negotiated session parameters"})
+	argIsListLun := parserIslist.String("l", "lun", &argparse.Options{Help: "Show only sessions of this LUN ID"})
+
+	parserIslogout := parser.NewCommand("islogout", "Close iSCSI sessions")
+	argIsLogoutAll := parserIslogout.Flag("a", "all", &argparse.Options{Help: "Close all sessions"})
+	argIsLogoutLun := parserIslogout.String("l", "lun", &argparse.Options{Help: "Close sessions of this LUN ID"})
+	argIsLogoutTarget := parserIslogout.String("t", "target", &argparse.Options{Help: "Close sessions of this target IQN"})
+	argIsLogoutInitiator := parserIslogout.String("i", "initiator", &argparse.Options{Help: "Close sessions of this initiator name"})
+	argIsLogoutPortal := parserIslogout.String("p", "portal", &argparse.Options{Help: "Close sessions from this initiator address"})
+	argIsLogoutTimeout := parserIslogout.Int("w", "timeout", &argparse.Options{Help: "Seconds to wait for each session to go away", Default: 10})
+
+	parserPort := parser.NewCommand("port", "Enable or disable ports")
+	argPortMode := parserPort.Selector("o", "mode", []string{"on", "off"}, &argparse.Options{Help: "Port state, on or off", Required: true})
+	argPortPort := parserPort.String("p", "port", &argparse.Options{Help: "Port (LUN) ID"})
+	argPortDriver := parserPort.Flag("g", "driver", &argparse.Options{Help: "Also switch the iSCSI driver globally"})
+
+	parserLunmap := parser.NewCommand("lunmap", "Map or unmap LUNs of a port")
+	argLunmapPort := parserLunmap.String("p", "port", &argparse.Options{Help: "Port (LUN) ID", Required: true})
+	argLunmapLun := parserLunmap.Int("l", "lun", &argparse.Options{Help: "LUN number on the port", Default: -1})
+	argLunmapDevLun := parserLunmap.String("L", "device-lun", &argparse.Options{Help: "LUN ID to map, unmaps the LUN number if omitted"})
+	argLunmapGroup := parserLunmap.String("g", "group", &argparse.Options{Help: "Initiator group, empty for the target LUN table", Default: scst.SYSFS_SCST_INI_GROUP})
+
+	parserImport := parser.NewCommand("import", "Recreate LUNs and ports of FreeBSD ctladm XML dumps")
+	argImportFromXml := parserImport.String("", "from-xml", &argparse.Options{Help: "devlist -x output"})
+	argImportPorts := parserImport.String("", "ports", &argparse.Options{Help: "portlist -x output, targets follow the ctld_name of the LUNs without it"})
+	argImportDryRun := parserImport.Flag("n", "dry-run", &argparse.Options{Help: "Only report what would be done"})
+	argImportPartial := parserImport.Flag("", "partial", &argparse.Options{Help: "Import what can be imported even if some items cannot"})
+
+	parserApplyCtlConf := parser.NewCommand("apply-ctlconf", "Bring SCST to the configuration of a FreeBSD ctl.conf")
+	argApplyCtlConfFile := parserApplyCtlConf.StringPositional(&argparse.Options{Help: "ctl.conf file"})
+	argApplyCtlConfDryRun := parserApplyCtlConf.Flag("n", "dry-run", &argparse.Options{Help: "Only report what would be done"})
+	argApplyCtlConfPrune := parserApplyCtlConf.Flag("", "prune", &argparse.Options{Help: "Delete targets, devices and settings missing from the file"})
+
+	parserScstApply := parser.NewCommand("scst-apply", "Bring SCST to the configuration of an scst.conf")
+	argScstApplyFile := parserScstApply.StringPositional(&argparse.Options{Help: "scst.conf file"})
+	argScstApplyDryRun := parserScstApply.Flag("n", "dry-run", &argparse.Options{Help: "Only print the sysfs writes that would be done"})
+
+	parserExport := parser.NewCommand("export", "Write the SCST configuration as ctl.conf or scst.conf")
+	argExportFormat := parserExport.Selector("f", "format", []string{"ctl.conf", "scst.conf"}, &argparse.Options{Help: "Configuration format", Required: true})
+	argExportOutput := parserExport.String("o", "output", &argparse.Options{Help: "Output file, standard output by default"})
+
+	command := ""
+	format := ""
+	var tmpl *template.Template
 	if err = parser.Parse(os.Args); err != nil {
-		fmt.Println(parser.Usage(err))
+		fmt.Fprintln(os.Stderr, parser.Usage(err))
+		os.Exit(EXIT_USAGE)
 	} else {
+		log.Debug("SCST root: ", *argScstRoot)
+		if err := setScstRoot(*argScstRoot); err != nil {
+			fmt.Fprintf(os.Stderr, "ctladm: %v\n", err)
+			os.Exit(EXIT_FAILURE)
+		}
 		if parserDevlist.Happened() {
+			command = "devlist"
 			log.Debug("Command: devlist")
 			log.Debug("Arguments:")
 			log.Debug("-x:", *argDevListXml)
-			GetDevList(*argDevListXml)
+			log.Debug("--json:", *argDevListJson)
+			log.Debug("--format:", *argDevListFormat)
+			log.Debug("--template:", *argDevListTemplate)
+			log.Debug("--template-file:", *argDevListTemplateFile)
+			log.Debug("-v:", *argDevListVerbose)
+			if tmpl, err = ListTemplate(*argDevListTemplate, *argDevListTemplateFile); err == nil {
+				if format, err = ListFormat(*argDevListXml, *argDevListJson, *argDevListFormat, tmpl); err == nil {
+					err = GetDevList(format, tmpl, *argDevListVerbose)
+				}
+			}
 		} else if parserPortlist.Happened() {
+			command = "portlist"
 			log.Debug("Command: portlist")
 			log.Debug("Arguments:")
 			log.Debug("-x:", *argPortListXml)
-			GetPortList(*argPortListXml)
+			log.Debug("--json:", *argPortListJson)
+			log.Debug("--format:", *argPortListFormat)
+			log.Debug("--template:", *argPortListTemplate)
+			log.Debug("--template-file:", *argPortListTemplateFile)
+			log.Debug("-l:", *argPortListLuns)
+			log.Debug("-v:", *argPortListVerbose)
+			log.Debug("-i:", *argPortListInitiators)
+			log.Debug("-f:", *argPortListFrontend)
+			log.Debug("-p:", *argPortListPort)
+			if tmpl, err = ListTemplate(*argPortListTemplate, *argPortListTemplateFile); err == nil {
+				if format, err = ListFormat(*argPortListXml, *argPortListJson, *argPortListFormat, tmpl); err == nil {
+					err = GetPortList(format, tmpl, *argPortListLuns, *argPortListVerbose, *argPortListInitiators, *argPortListFrontend, *argPortListPort)
+				}
+			}
 		} else if parserRemove.Happened() {
+			command = "remove"
 			log.Debug("Command: remove")
 			log.Debug("Arguments:")
 			log.Debug("-b:", *argRemoveB)
 			log.Debug("-l:", *argRemoveLun)
-			RemoveLun(*argRemoveLun)
+			log.Debug("--purge:", *argRemovePurge)
+			log.Debug("--delete-target:", *argRemoveDeleteTarget)
+			log.Debug("--zfs:", *argRemoveZfs)
+			err = RemoveLun(*argRemoveB, *argRemoveLun, *argRemovePurge || config.RemovePurge, *argRemoveDeleteTarget || config.RemoveDeleteTarget, *argRemoveZfs)
 		} else if parserCreate.Happened() {
+			command = "create"
 			log.Debug("Command: create")
 			log.Debug("Arguments:")
 			log.Debug("-b:", *argCreateB)
+			log.Debug("-t:", *argCreateT)
+			log.Debug("-s:", *argCreateS)
 			log.Debug("-o:", *argCreateOptions)
 			log.Debug("-d:", *argCreateDevice)
 			log.Debug("-l:", *argCreateLun)
-			CreateLun(*argCreateDevice)
+			err = CreateLun(*argCreateB, *argCreateT, *argCreateS, *argCreateOptions, *argCreateDevice, *argCreateLun)
+		} else if parserModify.Happened() {
+			command = "modify"
+			log.Debug("Command: modify")
+			log.Debug("Arguments:")
+			log.Debug("-b:", *argModifyB)
+			log.Debug("-l:", *argModifyLun)
+			log.Debug("-o:", *argModifyOptions)
+			err = ModifyLun(*argModifyB, *argModifyOptions, *argModifyLun)
+		} else if parserIslist.Happened() {
+			command = "islist"
+			log.Debug("Command: islist")
+			log.Debug("Arguments:")
+			log.Debug("-x:", *argIsListXml)
+			log.Debug("--json:", *argIsListJson)
+			log.Debug("--format:", *argIsListFormat)
+			log.Debug("--template:", *argIsListTemplate)
+			log.Debug("--template-file:", *argIsListTemplateFile)
+			log.Debug("-v:", *argIsListVerbose)
+			log.Debug("-l:", *argIsListLun)
+			if tmpl, err = ListTemplate(*argIsListTemplate, *argIsListTemplateFile); err == nil {
+				if format, err = ListFormat(*argIsListXml, *argIsListJson, *argIsListFormat, tmpl); err == nil {
+					err = IsList(format, tmpl, *argIsListVerbose, *argIsListLun)
+				}
+			}
+		} else if parserIslogout.Happened() {
+			command = "islogout"
+			log.Debug("Command: islogout")
+			log.Debug("Arguments:")
+			log.Debug("-a:", *argIsLogoutAll)
+			log.Debug("-l:", *argIsLogoutLun)
+			log.Debug("-t:", *argIsLogoutTarget)
+			log.Debug("-i:", *argIsLogoutInitiator)
+			log.Debug("-p:", *argIsLogoutPortal)
+			log.Debug("-w:", *argIsLogoutTimeout)
+			err = IsLogout(*argIsLogoutAll, *argIsLogoutLun, *argIsLogoutTarget, *argIsLogoutInitiator, *argIsLogoutPortal, *argIsLogoutTimeout)
+		} else if parserPort.Happened() {
+			command = "port"
+			log.Debug("Command: port")
+			log.Debug("Arguments:")
+			log.Debug("-o:", *argPortMode)
+			log.Debug("-p:", *argPortPort)
+			log.Debug("-g:", *argPortDriver)
+			err = SetPortState(*argPortMode, *argPortPort, *argPortDriver)
+		} else if parserLunmap.Happened() {
+			command = "lunmap"
+			log.Debug("Command: lunmap")
+			log.Debug("Arguments:")
+			log.Debug("-p:", *argLunmapPort)
+			log.Debug("-l:", *argLunmapLun)
+			log.Debug("-L:", *argLunmapDevLun)
+			log.Debug("-g:", *argLunmapGroup)
+			err = MapLun(*argLunmapPort, *argLunmapLun, *argLunmapDevLun, *argLunmapGroup)
+		} else if parserImport.Happened() {
+			command = "import"
+			log.Debug("Command: import")
+			log.Debug("Arguments:")
+			log.Debug("--from-xml:", *argImportFromXml)
+			log.Debug("--ports:", *argImportPorts)
+			log.Debug("--dry-run:", *argImportDryRun)
+			log.Debug("--partial:", *argImportPartial)
+			err = ImportXml(*argImportFromXml, *argImportPorts, *argImportDryRun, *argImportPartial)
+		} else if parserApplyCtlConf.Happened() {
+			command = "apply-ctlconf"
+			log.Debug("Command: apply-ctlconf")
+			log.Debug("Arguments:")
+			log.Debug("file:", *argApplyCtlConfFile)
+			log.Debug("--dry-run:", *argApplyCtlConfDryRun)
+			log.Debug("--prune:", *argApplyCtlConfPrune)
+			err = ApplyCtlConf(*argApplyCtlConfFile, *argApplyCtlConfDryRun, *argApplyCtlConfPrune)
+		} else if parserScstApply.Happened() {
+			command = "scst-apply"
+			log.Debug("Command: scst-apply")
+			log.Debug("Arguments:")
+			log.Debug("file:", *argScstApplyFile)
+			log.Debug("--dry-run:", *argScstApplyDryRun)
+			err = ScstApply(*argScstApplyFile, *argScstApplyDryRun)
+		} else if parserExport.Happened() {
+			command = "export"
+			log.Debug("Command: export")
+			log.Debug("Arguments:")
+			log.Debug("--format:", *argExportFormat)
+			log.Debug("--output:", *argExportOutput)
+			err = ExportConfig(*argExportFormat, *argExportOutput)
 		}
 	}
-
+	if err != nil {
+		os.Exit(ReportError(command, err))
+	}
 }
@@ -0,0 +1,121 @@
+package pk_ctlcompat
+
+import (
+	scst "github.com/Tualua/pk_ctladm/pk_scst"
+)
+
+const CTL_LUN_TYPE_DISK int = 0
+const CTL_LUN_TYPE_CDROM int = 5
+
+// ScstHandlerBackends maps the SCST handlers ctladm manages to CTL backends.
+// file is ctladm's own name for vdisk_fileio, CTL serves files with block.
+var ScstHandlerBackends = map[string]string{
+	scst.SCST_HANDLER_BLOCKIO: "block",
+	scst.SCST_HANDLER_FILEIO:  "file",
+	scst.SCST_HANDLER_NULLIO:  "ramdisk",
+	scst.SCST_HANDLER_CDROM:   "block",
+}
+
+// BackendHandler picks the SCST handler for a CTL backend and device type.
+// CD-ROMs of the block and file backends are served by vcdrom.
+func BackendHandler(backend string, lunType int) (handler string, err error) {
+	switch backend {
+	case "block":
+		handler = scst.SCST_HANDLER_BLOCKIO
+	case "file":
+		handler = scst.SCST_HANDLER_FILEIO
+	case "ramdisk":
+		handler = scst.SCST_HANDLER_NULLIO
+	default:
+		return "", CtlErrorf(ErrInvalid, "backend \"%s\" not found", backend)
+	}
+	switch {
+	case lunType == CTL_LUN_TYPE_DISK:
+	case lunType == CTL_LUN_TYPE_CDROM && handler != scst.SCST_HANDLER_NULLIO:
+		handler = scst.SCST_HANDLER_CDROM
+	default:
+		return "", CtlErrorf(ErrInvalid, "device type %d is not supported by backend %s", lunType, backend)
+	}
+	return
+}
+
+// HandlerNeedsFile tells whether devices of handler are created from a
+// file option.
+func HandlerNeedsFile(handler string) bool {
+	return handler != scst.SCST_HANDLER_NULLIO
+}
+
+// ScstDeviceAttrs are the vdisk attributes outside the CtlOptions table that
+// can be set once a device exists.
+var ScstDeviceAttrs = []string{
+	"cluster_mode",
+	"dummy",
+	"eui64_id",
+	"expl_alua",
+	"inq_vend_specific",
+	"naa_id",
+	"read_zero",
+	"scsi_device_name",
+	"vend_specific_id",
+}
+
+func containsString(list []string, val string) bool {
+	for _, item := range list {
+		if item == val {
+			return true
+		}
+	}
+	return false
+}
+
+// HandlerOptionsToScst is CtlOptionsToScst for a handler. Defaults that are
+// not add_device parameters of the handler are dropped, options that are
+// not become attributes set once the device exists. Options the handler
+// takes neither way are refused before anything is created.
+func HandlerOptionsToScst(handler string, options map[string]string) (params map[string]string, attrs map[string]string, err error) {
+	var (
+		accepted []string
+	)
+	if accepted, err = scst.ScstGetHandlerParams(handler); err != nil {
+		return
+	}
+	explicit := map[string]bool{}
+	for _, name := range sortedKeys(options) {
+		scstName, postCreate := name, false
+		if option, ok := FindCtlOption(name); ok {
+			scstName, postCreate = option.Scst, !option.Create
+		}
+		switch {
+		case containsString(accepted, scstName), postCreate, containsString(ScstDeviceAttrs, scstName):
+		case scstName == "filename" && handler == scst.SCST_HANDLER_CDROM:
+			// The medium of a CD-ROM is loaded after add_device.
+		default:
+			return nil, nil, CtlErrorf(ErrInvalid, "option %s is not supported by %s", name, handler)
+		}
+		explicit[scstName] = true
+	}
+	if params, attrs, err = CtlOptionsToScst(options); err != nil {
+		return nil, nil, &CtlError{Kind: ErrInvalid, Err: err}
+	}
+	for name, val := range params {
+		if containsString(accepted, name) {
+			continue
+		}
+		delete(params, name)
+		if explicit[name] {
+			attrs[name] = val
+		}
+	}
+	return
+}
+
+// DeviceBackend names the CTL backend of an SCST device, devices of other
+// handlers report the handler.
+func DeviceBackend(device string) (backend string) {
+	if handler, err := scst.ScstGetDeviceHandler(device); err != nil {
+		log.Errorf("DeviceBackend: %v", err)
+	} else if backend = ScstHandlerBackends[handler]; backend == "" {
+		backend = handler
+	}
+	return
+}
@@ -0,0 +1,301 @@
+package pk_ctlcompat
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	scst "github.com/Tualua/pk_ctladm/pk_scst"
+)
+
+// convergenceState is what devlist and portlist -l show: the device of
+// every LUN ID and the LUN IDs every target exports by LUN number.
+type convergenceState struct {
+	Ids  map[string]string
+	Luns map[string]string
+}
+
+func readConvergenceState(t *testing.T) (res convergenceState) {
+	t.Helper()
+	luns, err := GetLuns()
+	if err != nil {
+		t.Fatalf("GetLuns: %v", err)
+	}
+	res.Ids = map[string]string{}
+	for _, lun := range luns {
+		res.Ids[strconv.Itoa(lun.Id)] = lun.Device
+	}
+	ports, err := GetPorts()
+	if err != nil {
+		t.Fatalf("GetPorts: %v", err)
+	}
+	res.Luns = map[string]string{}
+	for _, port := range ports {
+		var (
+			mapped []string
+		)
+		for _, lun := range port.Luns {
+			mapped = append(mapped, fmt.Sprintf("%d:%d", lun.Lun, lun.Id))
+		}
+		sort.Strings(mapped)
+		res.Luns[port.Target] = strings.Join(mapped, " ")
+	}
+	return
+}
+
+func exportScstConf(t *testing.T) string {
+	t.Helper()
+	var b strings.Builder
+	conf, err := scst.ScstReadConfig()
+	if err == nil {
+		err = conf.Write(&b)
+	}
+	if err != nil {
+		t.Fatalf("export scst.conf: %v", err)
+	}
+	return b.String()
+}
+
+func exportCtlConf(t *testing.T) string {
+	t.Helper()
+	var b strings.Builder
+	conf, err := CtlConfFromScst()
+	if err == nil {
+		err = conf.Write(&b)
+	}
+	if err != nil {
+		t.Fatalf("export ctl.conf: %v", err)
+	}
+	return b.String()
+}
+
+// scstApply applies the scst.conf text and returns the number of writes it
+// took.
+func scstApply(t *testing.T, text string) int {
+	t.Helper()
+	conf, err := scst.ParseScstConfig([]byte(text))
+	if err != nil {
+		t.Fatalf("ParseScstConfig: %v", err)
+	}
+	writes, err := scst.ScstPlanConfig(conf)
+	if err != nil {
+		t.Fatalf("ScstPlanConfig: %v", err)
+	}
+	if err = scst.ScstApplyConfig(writes, func(scst.ScstConfWrite) {}); err != nil {
+		t.Fatalf("ScstApplyConfig: %v", err)
+	}
+	return len(writes)
+}
+
+// checkConvergence checks that the exported scst.conf and ctl.conf describe
+// the running SCST. scst-apply of the scst.conf changes nothing, applying
+// the ctl.conf keeps the LUN IDs and port LUNs and is done after one run.
+// Applied to an empty SCST both give the same LUN IDs, port LUNs and
+// exports, the scst.conf the same scst.conf.
+func checkConvergence(t *testing.T, want convergenceState) {
+	t.Helper()
+	scstConf, ctlConf := exportScstConf(t), exportCtlConf(t)
+	if n := scstApply(t, scstConf); n != 0 {
+		t.Errorf("scst-apply of the exported scst.conf took %d writes", n)
+	}
+	applyCtlConf(t, ctlConf, false)
+	if got := readConvergenceState(t); !reflect.DeepEqual(got, want) {
+		t.Errorf("apply-ctlconf of the exported ctl.conf: got %+v, want %+v", got, want)
+	}
+	if n := applyCtlConf(t, ctlConf, false); n != 0 {
+		t.Errorf("apply-ctlconf of the exported ctl.conf took %d actions the second time", n)
+	}
+
+	for _, c := range []struct {
+		name     string
+		apply    func()
+		scstConf string
+	}{
+		{"scst-apply", func() { scstApply(t, scstConf) }, scstConf},
+		{"apply-ctlconf", func() { applyCtlConf(t, ctlConf, false) }, ""},
+	} {
+		setupScst(t)
+		c.apply()
+		if got := readConvergenceState(t); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s to an empty SCST: got %+v, want %+v", c.name, got, want)
+		}
+		if got := exportScstConf(t); c.scstConf != "" && got != c.scstConf {
+			t.Errorf("%s to an empty SCST exports scst.conf\n%s\nwant\n%s", c.name, got, c.scstConf)
+		}
+		if got := exportCtlConf(t); got != ctlConf {
+			t.Errorf("%s to an empty SCST exports ctl.conf\n%s\nwant\n%s", c.name, got, ctlConf)
+		}
+	}
+}
+
+func TestConvergence(t *testing.T) {
+	create := func(t *testing.T, file string, ctldName string, lun string) {
+		t.Helper()
+		options := map[string]string{"file": file}
+		if ctldName != "" {
+			options["ctld_name"] = ctldName
+		}
+		if _, err := CreateLun("block", CTL_LUN_TYPE_DISK, options, "", lun); err != nil {
+			t.Fatalf("CreateLun %s: %v", file, err)
+		}
+	}
+	iqn := func(name string) string {
+		return CTLD_IQN_PREFIX + ":" + name
+	}
+	for _, c := range []struct {
+		name string
+		do   func(t *testing.T, dir string)
+		want convergenceState
+	}{
+		{
+			name: "create",
+			do: func(t *testing.T, dir string) {
+				create(t, path.Join(dir, "vol1"), "", "")
+				create(t, path.Join(dir, "vol2"), "", "5")
+			},
+			want: convergenceState{
+				Ids:  map[string]string{"1": "vol1", "5": "vol2"},
+				Luns: map[string]string{iqn("vol1"): "0:1", iqn("vol2"): "0:5"},
+			},
+		},
+		{
+			name: "create at LUN 1 of a target",
+			do: func(t *testing.T, dir string) {
+				create(t, path.Join(dir, "vol1"), "", "")
+				create(t, path.Join(dir, "vol2"), iqn("vol1")+",lun,1", "")
+				create(t, path.Join(dir, "vol3"), iqn("new")+",lun,1", "6")
+				create(t, path.Join(dir, "vol4"), "", "9")
+			},
+			want: convergenceState{
+				Ids:  map[string]string{"1": "vol1", "2": "vol2", "6": "vol3", "9": "vol4"},
+				Luns: map[string]string{iqn("vol1"): "0:1 1:2", iqn("new"): "1:6", iqn("vol4"): "0:9"},
+			},
+		},
+		{
+			name: "modify",
+			do: func(t *testing.T, dir string) {
+				create(t, path.Join(dir, "vol1"), "", "")
+				create(t, path.Join(dir, "vol2"), iqn("vol1")+",lun,1", "")
+				if _, _, err := ModifyLun("block", "2", map[string]string{"num_threads": "4", "serial_number": "SN2"}); err != nil {
+					t.Fatalf("ModifyLun: %v", err)
+				}
+				if threads := scst.ScstGetDeviceParam("vol2", "threads_num"); threads != "4" {
+					t.Errorf("threads_num of vol2 is %s, want 4", threads)
+				}
+			},
+			want: convergenceState{
+				Ids:  map[string]string{"1": "vol1", "2": "vol2"},
+				Luns: map[string]string{iqn("vol1"): "0:1 1:2"},
+			},
+		},
+		{
+			name: "lunmap",
+			do: func(t *testing.T, dir string) {
+				create(t, path.Join(dir, "vol1"), "", "")
+				create(t, path.Join(dir, "vol2"), "", "")
+				if _, err := MapLun("1", 1, "2", scst.SYSFS_SCST_INI_GROUP); err != nil {
+					t.Fatalf("MapLun: %v", err)
+				}
+				if _, err := MapLun("2", 1, "1", scst.SYSFS_SCST_INI_GROUP); err != nil {
+					t.Fatalf("MapLun: %v", err)
+				}
+			},
+			want: convergenceState{
+				Ids:  map[string]string{"1": "vol1", "2": "vol2"},
+				Luns: map[string]string{iqn("vol1"): "0:1 1:2", iqn("vol2"): "0:2 1:1"},
+			},
+		},
+		{
+			name: "lunmap into the default LUN table",
+			do: func(t *testing.T, dir string) {
+				create(t, path.Join(dir, "vol1"), "", "")
+				create(t, path.Join(dir, "vol2"), "", "")
+				if _, err := MapLun("1", 3, "2", ""); err != nil {
+					t.Fatalf("MapLun: %v", err)
+				}
+			},
+			want: convergenceState{
+				Ids:  map[string]string{"1": "vol1", "2": "vol2"},
+				Luns: map[string]string{iqn("vol1"): "0:1 3:2", iqn("vol2"): "0:2"},
+			},
+		},
+		{
+			name: "remove --purge",
+			do: func(t *testing.T, dir string) {
+				create(t, path.Join(dir, "vol1"), "", "")
+				create(t, path.Join(dir, "vol2"), iqn("vol1")+",lun,1", "")
+				create(t, path.Join(dir, "vol3"), "", "")
+				if err := PurgeLun("block", "1", true, "none", nil); err != nil {
+					t.Fatalf("PurgeLun: %v", err)
+				}
+			},
+			want: convergenceState{
+				Ids:  map[string]string{"2": "vol2", "3": "vol3"},
+				Luns: map[string]string{iqn("vol1"): "1:2", iqn("vol3"): "0:3"},
+			},
+		},
+		{
+			name: "import",
+			do: func(t *testing.T, dir string) {
+				luns := []Lun{
+					{Id: 3, BackendType: "block", File: path.Join(dir, "vol1"), CtldName: iqn("vol1") + ",lun,0", Options: map[string]string{"vendor": "FREEBSD"}},
+					{Id: 7, BackendType: "block", File: path.Join(dir, "vol2"), CtldName: iqn("vol1") + ",lun,1"},
+				}
+				plan, err := PlanImport(luns, nil)
+				if err != nil || len(plan.Problems) > 0 {
+					t.Fatalf("PlanImport: %v %v", err, plan.Problems)
+				}
+				if err = plan.Apply(nil); err != nil {
+					t.Fatalf("Apply: %v", err)
+				}
+			},
+			want: convergenceState{
+				Ids:  map[string]string{"3": "vol1", "7": "vol2"},
+				Luns: map[string]string{iqn("vol1"): "0:3 1:7"},
+			},
+		},
+		{
+			name: "apply-ctlconf",
+			do: func(t *testing.T, dir string) {
+				applyCtlConf(t, fmt.Sprintf(`auth-group ag0 {
+	chap user1 secret123456
+	initiator-name iqn.1994-05.com.example:host1
+}
+lun shared {
+	path %s/vol2
+}
+target %s {
+	auth-group ag0
+	lun 0 {
+		path %s/vol1
+	}
+	lun 1 shared
+}
+target %s {
+	auth-group no-authentication
+	lun 0 shared
+}
+`, dir, iqn("conf1"), dir, iqn("conf2")), false)
+			},
+			want: convergenceState{
+				Ids:  map[string]string{"1": "vol1", "2": "vol2"},
+				Luns: map[string]string{iqn("conf1"): "0:1 1:2", iqn("conf2"): "0:2"},
+			},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			setupScst(t)
+			dir := lunFiles(t, "vol1", "vol2", "vol3", "vol4")
+			c.do(t, dir)
+			got := readConvergenceState(t)
+			if !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("got %+v, want %+v", got, c.want)
+			}
+			checkConvergence(t, got)
+		})
+	}
+}
@@ -0,0 +1,677 @@
+package pk_ctlcompat
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const CTLCONF_DEFAULT_GROUP string = "default"
+
+// CtlConf is a parsed FreeBSD ctl.conf. Targets without an auth-group or
+// portal-group use the "default" ones, like ctld does.
+type CtlConf struct {
+	AuthGroups   map[string]*CtlConfAuthGroup
+	PortalGroups map[string]*CtlConfPortalGroup
+	Luns         map[string]*CtlConfLun
+	Targets      []*CtlConfTarget
+	// Ignored lists statements that have no SCST equivalent.
+	Ignored []string
+	// Notes lists SCST settings CtlConfFromScst could only express
+	// indirectly.
+	Notes []string
+}
+
+type CtlConfChap struct {
+	User         string
+	Secret       string
+	MutualUser   string
+	MutualSecret string
+}
+
+type CtlConfAuthGroup struct {
+	Name             string
+	AuthType         string
+	Chap             []CtlConfChap
+	InitiatorNames   []string
+	InitiatorPortals []string
+}
+
+// Type returns the auth-type of the group, worked out from its chap entries
+// when it is not set.
+func (ag *CtlConfAuthGroup) Type() string {
+	if ag.AuthType != "" {
+		return ag.AuthType
+	}
+	for _, chap := range ag.Chap {
+		if chap.MutualUser != "" {
+			return "chap-mutual"
+		}
+	}
+	if len(ag.Chap) > 0 {
+		return "chap"
+	}
+	return "none"
+}
+
+type CtlConfPortalGroup struct {
+	Name               string
+	Tag                int
+	Listen             []string
+	DiscoveryAuthGroup string
+}
+
+type CtlConfLun struct {
+	Name       string
+	Backend    string
+	Path       string
+	Size       string
+	Blocksize  int
+	Serial     string
+	DeviceId   string
+	DeviceType string
+	Options    map[string]string
+	// CtlLun is the CTL LUN ID of the ctl-lun statement, 0 without one.
+	CtlLun int
+}
+
+type CtlConfTarget struct {
+	Name  string
+	Alias string
+	// AuthGroup names the auth-group of the target, it is empty when the
+	// target has its own auth settings.
+	AuthGroup    string
+	Auth         *CtlConfAuthGroup
+	PortalGroups []string
+	Luns         map[int]*CtlConfLun
+	// Comment is written above the target, it is not parsed.
+	Comment string
+	// lunRefs keeps the names of LUNs defined outside of the target until
+	// the whole file is parsed.
+	lunRefs map[int]string
+}
+
+// LunNumbers returns the LUN numbers of the target in ascending order.
+func (t *CtlConfTarget) LunNumbers() (res []int) {
+	for num := range t.Luns {
+		res = append(res, num)
+	}
+	sort.Ints(res)
+	return
+}
+
+type ctlConfToken struct {
+	text string
+	line int
+	// kind is '{', '}', ';' or '\n' for punctuation and 0 for words.
+	kind byte
+}
+
+type ctlConfStatement struct {
+	line  int
+	words []string
+	block []*ctlConfStatement
+}
+
+func tokenizeCtlConf(data string) (res []ctlConfToken, err error) {
+	line := 1
+	for i := 0; i < len(data); {
+		c := data[i]
+		switch {
+		case c == '\n':
+			res = append(res, ctlConfToken{line: line, kind: c})
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#':
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+		case c == '{' || c == '}' || c == ';':
+			res = append(res, ctlConfToken{line: line, kind: c})
+			i++
+		case c == '"':
+			end := strings.IndexByte(data[i+1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated string", line)
+			}
+			text := data[i+1 : i+1+end]
+			res = append(res, ctlConfToken{text: text, line: line})
+			line += strings.Count(text, "\n")
+			i += end + 2
+		default:
+			start := i
+			for i < len(data) && !strings.ContainsRune(" \t\r\n{};#\"", rune(data[i])) {
+				i++
+			}
+			res = append(res, ctlConfToken{text: data[start:i], line: line})
+		}
+	}
+	return
+}
+
+// parseCtlConfBlock groups tokens into statements. A statement ends at a
+// newline, a semicolon or a block in braces.
+func parseCtlConfBlock(tokens []ctlConfToken, pos *int, nested bool) (res []*ctlConfStatement, err error) {
+	var (
+		cur *ctlConfStatement
+	)
+	for *pos < len(tokens) {
+		token := tokens[*pos]
+		*pos++
+		switch token.kind {
+		case '\n', ';':
+			cur = nil
+		case '{':
+			if cur == nil && len(res) > 0 && res[len(res)-1].block == nil {
+				cur = res[len(res)-1]
+			}
+			if cur == nil {
+				return nil, fmt.Errorf("line %d: unexpected {", token.line)
+			}
+			if cur.block, err = parseCtlConfBlock(tokens, pos, true); err != nil {
+				return
+			}
+			if cur.block == nil {
+				cur.block = []*ctlConfStatement{}
+			}
+			cur = nil
+		case '}':
+			if !nested {
+				return nil, fmt.Errorf("line %d: unexpected }", token.line)
+			}
+			return
+		default:
+			if cur == nil {
+				cur = &ctlConfStatement{line: token.line}
+				res = append(res, cur)
+			}
+			cur.words = append(cur.words, token.text)
+		}
+	}
+	if nested {
+		return nil, fmt.Errorf("unexpected end of file, missing }")
+	}
+	return
+}
+
+func (st *ctlConfStatement) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %s", st.line, fmt.Sprintf(format, args...))
+}
+
+// args checks that the statement has n arguments and no block, or a block
+// when n is negative.
+func (st *ctlConfStatement) args(n int) error {
+	if n < 0 {
+		if st.block == nil || len(st.words) != -n+1 {
+			return st.errorf("%s expects a name and a block", st.words[0])
+		}
+	} else if st.block != nil || len(st.words) != n+1 {
+		return st.errorf("%s expects %d arguments", st.words[0], n)
+	}
+	return nil
+}
+
+func (conf *CtlConf) ignore(st *ctlConfStatement) {
+	conf.Ignored = append(conf.Ignored, fmt.Sprintf("line %d: %s", st.line, strings.Join(st.words, " ")))
+}
+
+// ParseCtlConf parses a FreeBSD ctl.conf.
+func ParseCtlConf(data []byte) (conf *CtlConf, err error) {
+	var (
+		tokens     []ctlConfToken
+		statements []*ctlConfStatement
+	)
+	if tokens, err = tokenizeCtlConf(string(data)); err != nil {
+		return
+	}
+	pos := 0
+	if statements, err = parseCtlConfBlock(tokens, &pos, false); err != nil {
+		return
+	}
+	conf = &CtlConf{
+		AuthGroups: map[string]*CtlConfAuthGroup{
+			CTLCONF_DEFAULT_GROUP: {Name: CTLCONF_DEFAULT_GROUP, AuthType: "deny"},
+			"no-authentication":   {Name: "no-authentication", AuthType: "none"},
+			"no-access":           {Name: "no-access", AuthType: "deny"},
+		},
+		PortalGroups: map[string]*CtlConfPortalGroup{
+			CTLCONF_DEFAULT_GROUP: {Name: CTLCONF_DEFAULT_GROUP, Listen: []string{"0.0.0.0", "[::]"}},
+		},
+		Luns: map[string]*CtlConfLun{},
+	}
+	defined := map[string]bool{}
+	targets := map[string]bool{}
+	for _, st := range statements {
+		switch st.words[0] {
+		case "auth-group":
+			if err = st.args(-1); err != nil {
+				return nil, err
+			}
+			name := st.words[1]
+			if defined["auth-group "+name] || (name != CTLCONF_DEFAULT_GROUP && conf.AuthGroups[name] != nil) {
+				return nil, st.errorf("duplicated auth-group %s", name)
+			}
+			defined["auth-group "+name] = true
+			ag := &CtlConfAuthGroup{Name: name}
+			for _, sub := range st.block {
+				if err = parseCtlConfAuth(ag, sub); err != nil {
+					return nil, err
+				}
+			}
+			conf.AuthGroups[name] = ag
+		case "portal-group":
+			if err = st.args(-1); err != nil {
+				return nil, err
+			}
+			name := st.words[1]
+			if defined["portal-group "+name] || (name != CTLCONF_DEFAULT_GROUP && conf.PortalGroups[name] != nil) {
+				return nil, st.errorf("duplicated portal-group %s", name)
+			}
+			defined["portal-group "+name] = true
+			pg := &CtlConfPortalGroup{Name: name}
+			for _, sub := range st.block {
+				if err = conf.parsePortalGroup(pg, sub); err != nil {
+					return nil, err
+				}
+			}
+			conf.PortalGroups[name] = pg
+		case "lun":
+			if err = st.args(-1); err != nil {
+				return nil, err
+			}
+			if conf.Luns[st.words[1]] != nil {
+				return nil, st.errorf("duplicated lun %s", st.words[1])
+			}
+			lun := &CtlConfLun{Name: st.words[1], Options: map[string]string{}}
+			for _, sub := range st.block {
+				if err = conf.parseLun(lun, sub); err != nil {
+					return nil, err
+				}
+			}
+			conf.Luns[lun.Name] = lun
+		case "target":
+			if err = st.args(-1); err != nil {
+				return nil, err
+			}
+			if targets[st.words[1]] {
+				return nil, st.errorf("duplicated target %s", st.words[1])
+			}
+			targets[st.words[1]] = true
+			if target, err := conf.parseTarget(st); err != nil {
+				return nil, err
+			} else {
+				conf.Targets = append(conf.Targets, target)
+			}
+		case "debug", "timeout", "maxproc", "pidfile", "isns-server", "isns-period", "isns-timeout", "transport-group":
+			conf.ignore(st)
+		default:
+			return nil, st.errorf("unknown statement %s", st.words[0])
+		}
+	}
+	// Resolve references now that every group and LUN is known.
+	for _, target := range conf.Targets {
+		if target.AuthGroup != "" {
+			if target.Auth = conf.AuthGroups[target.AuthGroup]; target.Auth == nil {
+				return nil, fmt.Errorf("target %s: unknown auth-group %s", target.Name, target.AuthGroup)
+			}
+		}
+		for _, name := range target.PortalGroups {
+			if conf.PortalGroups[name] == nil {
+				return nil, fmt.Errorf("target %s: unknown portal-group %s", target.Name, name)
+			}
+		}
+		for num, name := range target.lunRefs {
+			if target.Luns[num] = conf.Luns[name]; target.Luns[num] == nil {
+				return nil, fmt.Errorf("target %s: unknown lun %s", target.Name, name)
+			}
+		}
+	}
+	for _, pg := range conf.PortalGroups {
+		if pg.DiscoveryAuthGroup != "" && conf.AuthGroups[pg.DiscoveryAuthGroup] == nil {
+			return nil, fmt.Errorf("portal-group %s: unknown auth-group %s", pg.Name, pg.DiscoveryAuthGroup)
+		}
+	}
+	return
+}
+
+func parseCtlConfAuth(ag *CtlConfAuthGroup, st *ctlConfStatement) (err error) {
+	switch st.words[0] {
+	case "auth-type":
+		if err = st.args(1); err == nil {
+			switch st.words[1] {
+			case "none", "deny", "chap", "chap-mutual":
+				if ag.AuthType != "" && ag.AuthType != st.words[1] {
+					err = st.errorf("auth-type already set to %s", ag.AuthType)
+				}
+				ag.AuthType = st.words[1]
+			default:
+				err = st.errorf("invalid auth-type %s", st.words[1])
+			}
+		}
+	case "chap":
+		if err = st.args(2); err == nil {
+			ag.Chap = append(ag.Chap, CtlConfChap{User: st.words[1], Secret: st.words[2]})
+		}
+	case "chap-mutual":
+		if err = st.args(4); err == nil {
+			ag.Chap = append(ag.Chap, CtlConfChap{User: st.words[1], Secret: st.words[2], MutualUser: st.words[3], MutualSecret: st.words[4]})
+		}
+	case "initiator-name":
+		if err = st.args(1); err == nil {
+			ag.InitiatorNames = append(ag.InitiatorNames, st.words[1])
+		}
+	case "initiator-portal":
+		if err = st.args(1); err == nil {
+			ag.InitiatorPortals = append(ag.InitiatorPortals, st.words[1])
+		}
+	default:
+		err = st.errorf("unknown auth-group statement %s", st.words[0])
+	}
+	return
+}
+
+func (conf *CtlConf) parsePortalGroup(pg *CtlConfPortalGroup, st *ctlConfStatement) (err error) {
+	switch st.words[0] {
+	case "listen":
+		if err = st.args(1); err == nil {
+			pg.Listen = append(pg.Listen, st.words[1])
+		}
+	case "discovery-auth-group":
+		if err = st.args(1); err == nil {
+			pg.DiscoveryAuthGroup = st.words[1]
+		}
+	case "tag":
+		if err = st.args(1); err == nil {
+			if pg.Tag, err = strconv.Atoi(st.words[1]); err != nil {
+				err = st.errorf("invalid tag %s", st.words[1])
+			}
+		}
+	case "discovery-filter", "foreign", "listen-iser", "offload", "option", "redirect", "dscp", "pcp":
+		conf.ignore(st)
+	default:
+		err = st.errorf("unknown portal-group statement %s", st.words[0])
+	}
+	return
+}
+
+func (conf *CtlConf) parseLun(lun *CtlConfLun, st *ctlConfStatement) (err error) {
+	switch st.words[0] {
+	case "backend":
+		if err = st.args(1); err == nil {
+			lun.Backend = st.words[1]
+		}
+	case "path":
+		if err = st.args(1); err == nil {
+			lun.Path = st.words[1]
+		}
+	case "size":
+		if err = st.args(1); err == nil {
+			lun.Size = st.words[1]
+		}
+	case "blocksize":
+		if err = st.args(1); err == nil {
+			if lun.Blocksize, err = strconv.Atoi(st.words[1]); err != nil {
+				err = st.errorf("invalid blocksize %s", st.words[1])
+			}
+		}
+	case "serial":
+		if err = st.args(1); err == nil {
+			lun.Serial = st.words[1]
+		}
+	case "device-id":
+		if err = st.args(1); err == nil {
+			lun.DeviceId = st.words[1]
+		}
+	case "device-type":
+		if err = st.args(1); err == nil {
+			lun.DeviceType = st.words[1]
+		}
+	case "option":
+		if err = st.args(2); err == nil {
+			lun.Options[st.words[1]] = st.words[2]
+		}
+	case "ctl-lun":
+		if err = st.args(1); err == nil {
+			if lun.CtlLun, err = strconv.Atoi(st.words[1]); err != nil || lun.CtlLun < 0 {
+				err = st.errorf("invalid ctl-lun %s", st.words[1])
+			} else if lun.CtlLun == 0 {
+				// LUN IDs start at 1, the ID of the first target.
+				conf.ignore(st)
+			}
+		}
+	default:
+		err = st.errorf("unknown lun statement %s", st.words[0])
+	}
+	return
+}
+
+func (conf *CtlConf) parseTarget(st *ctlConfStatement) (target *CtlConfTarget, err error) {
+	var (
+		inline   *CtlConfAuthGroup
+		authName string
+	)
+	target = &CtlConfTarget{Name: st.words[1], Luns: map[int]*CtlConfLun{}, lunRefs: map[int]string{}}
+	for _, sub := range st.block {
+		switch sub.words[0] {
+		case "alias":
+			if err = sub.args(1); err != nil {
+				return
+			}
+			target.Alias = sub.words[1]
+		case "auth-group":
+			if err = sub.args(1); err != nil {
+				return
+			}
+			authName = sub.words[1]
+		case "auth-type", "chap", "chap-mutual", "initiator-name", "initiator-portal":
+			if inline == nil {
+				inline = &CtlConfAuthGroup{Name: "target " + target.Name}
+			}
+			if err = parseCtlConfAuth(inline, sub); err != nil {
+				return
+			}
+		case "portal-group":
+			// The per portal group auth-group is a discovery setting.
+			if len(sub.words) == 3 {
+				conf.ignore(sub)
+			} else if err = sub.args(1); err != nil {
+				return
+			}
+			target.PortalGroups = append(target.PortalGroups, sub.words[1])
+		case "lun":
+			num := 0
+			if len(sub.words) < 2 {
+				return nil, sub.errorf("lun expects a number")
+			}
+			if num, err = strconv.Atoi(sub.words[1]); err != nil || num < 0 {
+				return nil, sub.errorf("invalid LUN number %s", sub.words[1])
+			}
+			if _, ok := target.Luns[num]; ok {
+				return nil, sub.errorf("duplicated LUN %d", num)
+			}
+			if sub.block != nil {
+				if err = sub.args(-1); err != nil {
+					return
+				}
+				lun := &CtlConfLun{Name: target.Name + ",lun," + sub.words[1], Options: map[string]string{}}
+				for _, lunSt := range sub.block {
+					if err = conf.parseLun(lun, lunSt); err != nil {
+						return
+					}
+				}
+				target.Luns[num] = lun
+			} else {
+				if err = sub.args(2); err != nil {
+					return
+				}
+				// Named LUNs may be defined after the target.
+				target.Luns[num] = nil
+				target.lunRefs[num] = sub.words[2]
+			}
+		case "port", "redirect":
+			conf.ignore(sub)
+		default:
+			return nil, sub.errorf("unknown target statement %s", sub.words[0])
+		}
+	}
+	if authName != "" && inline != nil {
+		return nil, st.errorf("target %s has both an auth-group and its own auth settings", target.Name)
+	}
+	if inline != nil {
+		target.Auth = inline
+	} else if target.AuthGroup = authName; authName == "" {
+		target.AuthGroup = CTLCONF_DEFAULT_GROUP
+	}
+	if len(target.PortalGroups) == 0 {
+		target.PortalGroups = []string{CTLCONF_DEFAULT_GROUP}
+	}
+	return
+}
+
+// ctlConfValue quotes values ctld would otherwise split.
+func ctlConfValue(val string) string {
+	if val == "" || strings.ContainsAny(val, " \t#{};\"") {
+		return `"` + val + `"`
+	}
+	return val
+}
+
+func writeCtlConfAuth(b *strings.Builder, indent string, ag *CtlConfAuthGroup) {
+	if ag.AuthType != "" {
+		fmt.Fprintf(b, "%sauth-type %s\n", indent, ag.AuthType)
+	}
+	for _, chap := range ag.Chap {
+		if chap.MutualUser != "" {
+			fmt.Fprintf(b, "%schap-mutual %s %s %s %s\n", indent, ctlConfValue(chap.User), ctlConfValue(chap.Secret), ctlConfValue(chap.MutualUser), ctlConfValue(chap.MutualSecret))
+		} else {
+			fmt.Fprintf(b, "%schap %s %s\n", indent, ctlConfValue(chap.User), ctlConfValue(chap.Secret))
+		}
+	}
+	for _, name := range ag.InitiatorNames {
+		fmt.Fprintf(b, "%sinitiator-name %s\n", indent, ctlConfValue(name))
+	}
+	for _, portal := range ag.InitiatorPortals {
+		fmt.Fprintf(b, "%sinitiator-portal %s\n", indent, ctlConfValue(portal))
+	}
+}
+
+func writeCtlConfLun(b *strings.Builder, indent string, lun *CtlConfLun) {
+	if lun.Backend != "" {
+		fmt.Fprintf(b, "%sbackend %s\n", indent, lun.Backend)
+	}
+	if lun.DeviceType != "" {
+		fmt.Fprintf(b, "%sdevice-type %s\n", indent, lun.DeviceType)
+	}
+	if lun.Path != "" {
+		fmt.Fprintf(b, "%spath %s\n", indent, ctlConfValue(lun.Path))
+	}
+	if lun.Size != "" {
+		fmt.Fprintf(b, "%ssize %s\n", indent, lun.Size)
+	}
+	if lun.Blocksize > 0 {
+		fmt.Fprintf(b, "%sblocksize %d\n", indent, lun.Blocksize)
+	}
+	if lun.Serial != "" {
+		fmt.Fprintf(b, "%sserial %s\n", indent, ctlConfValue(lun.Serial))
+	}
+	if lun.DeviceId != "" {
+		fmt.Fprintf(b, "%sdevice-id %s\n", indent, ctlConfValue(lun.DeviceId))
+	}
+	if lun.CtlLun > 0 {
+		fmt.Fprintf(b, "%sctl-lun %d\n", indent, lun.CtlLun)
+	}
+	for _, name := range OptionNames(lun.Options) {
+		fmt.Fprintf(b, "%soption %s %s\n", indent, name, ctlConfValue(lun.Options[name]))
+	}
+}
+
+// Write writes the configuration in the ctl.conf format. The predefined
+// groups are left out unless they were redefined.
+func (conf *CtlConf) Write(w io.Writer) (err error) {
+	var (
+		b     strings.Builder
+		names []string
+	)
+	b.WriteString("# Automatically generated by ctladm.\n")
+	for name := range conf.AuthGroups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ag := conf.AuthGroups[name]
+		builtin := name == "no-authentication" || name == "no-access"
+		if builtin || (name == CTLCONF_DEFAULT_GROUP && ag.AuthType == "deny" && len(ag.Chap) == 0 && len(ag.InitiatorNames) == 0 && len(ag.InitiatorPortals) == 0) {
+			continue
+		}
+		fmt.Fprintf(&b, "\nauth-group %s {\n", name)
+		writeCtlConfAuth(&b, "\t", ag)
+		b.WriteString("}\n")
+	}
+	names = nil
+	for name := range conf.PortalGroups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		pg := conf.PortalGroups[name]
+		if name == CTLCONF_DEFAULT_GROUP && pg.DiscoveryAuthGroup == "" && pg.Tag == 0 && strings.Join(pg.Listen, " ") == "0.0.0.0 [::]" {
+			continue
+		}
+		fmt.Fprintf(&b, "\nportal-group %s {\n", name)
+		if pg.DiscoveryAuthGroup != "" {
+			fmt.Fprintf(&b, "\tdiscovery-auth-group %s\n", pg.DiscoveryAuthGroup)
+		}
+		if pg.Tag != 0 {
+			fmt.Fprintf(&b, "\ttag %d\n", pg.Tag)
+		}
+		for _, listen := range pg.Listen {
+			fmt.Fprintf(&b, "\tlisten %s\n", listen)
+		}
+		b.WriteString("}\n")
+	}
+	names = nil
+	for name := range conf.Luns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&b, "\nlun %s {\n", ctlConfValue(name))
+		writeCtlConfLun(&b, "\t", conf.Luns[name])
+		b.WriteString("}\n")
+	}
+	for _, target := range conf.Targets {
+		b.WriteString("\n")
+		if target.Comment != "" {
+			fmt.Fprintf(&b, "# %s\n", target.Comment)
+		}
+		fmt.Fprintf(&b, "target %s {\n", target.Name)
+		if target.Alias != "" {
+			fmt.Fprintf(&b, "\talias %s\n", ctlConfValue(target.Alias))
+		}
+		if target.AuthGroup != "" {
+			fmt.Fprintf(&b, "\tauth-group %s\n", target.AuthGroup)
+		} else if target.Auth != nil {
+			writeCtlConfAuth(&b, "\t", target.Auth)
+		}
+		for _, name := range target.PortalGroups {
+			fmt.Fprintf(&b, "\tportal-group %s\n", name)
+		}
+		for _, num := range target.LunNumbers() {
+			lun := target.Luns[num]
+			if conf.Luns[lun.Name] == lun {
+				fmt.Fprintf(&b, "\tlun %d %s\n", num, ctlConfValue(lun.Name))
+			} else {
+				fmt.Fprintf(&b, "\tlun %d {\n", num)
+				writeCtlConfLun(&b, "\t\t", lun)
+				b.WriteString("\t}\n")
+			}
+		}
+		b.WriteString("}\n")
+	}
+	_, err = io.WriteString(w, b.String())
+	return
+}
@@ -0,0 +1,595 @@
+package pk_ctlcompat
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	scst "github.com/Tualua/pk_ctladm/pk_scst"
+)
+
+const CTLCONF_ISCSI_PORT string = "3260"
+
+// ctlConfLunOptions turns a ctl.conf LUN into CTL options that
+// CtlOptionsToScst can map, options SCST has no equivalent for are returned
+// in dropped.
+func ctlConfLunOptions(lun *CtlConfLun) (options map[string]string, dropped []string) {
+	options = map[string]string{}
+	if lun.Path != "" {
+		options["file"] = lun.Path
+	}
+	if lun.Blocksize > 0 {
+		options["blocksize"] = strconv.Itoa(lun.Blocksize)
+	}
+	if lun.Serial != "" {
+		options["serial_number"] = lun.Serial
+	}
+	if lun.DeviceId != "" {
+		options["device_id"] = lun.DeviceId
+	}
+	for _, name := range OptionNames(lun.Options) {
+		if option, ok := FindCtlOption(name); ok && option.Ctl != "" && option.Scst != "filename" {
+			options[name] = lun.Options[name]
+		} else {
+			dropped = append(dropped, name)
+		}
+	}
+	return
+}
+
+// listenAddress splits a listen address of a portal group into the host and
+// the port.
+func listenAddress(listen string) (host string, port string) {
+	if host, port, err := net.SplitHostPort(listen); err == nil {
+		return host, port
+	}
+	return strings.Trim(listen, "[]"), CTLCONF_ISCSI_PORT
+}
+
+// convergeValues plans the changes that turn the values of a target
+// attribute from have into want. Values are matched by their first field,
+// so a CHAP user with a new secret is replaced, values missing from want are
+// only removed with prune.
+func (p *Plan) convergeValues(wwn string, what string, have []string, want []string, prune bool, add func(val string) error, del func(key string) error) {
+	key := func(val string) (k string) {
+		if fields := strings.Fields(val); len(fields) > 0 {
+			k = fields[0]
+		}
+		return
+	}
+	haveByKey := map[string]string{}
+	for _, val := range have {
+		haveByKey[key(val)] = val
+	}
+	wanted := map[string]bool{}
+	for _, val := range want {
+		k := key(val)
+		wanted[k] = true
+		if cur, ok := haveByKey[k]; ok {
+			if cur == val {
+				continue
+			}
+			p.action(func() error {
+				return del(k)
+			}, "remove %s %s from target %s", what, k, wwn)
+		}
+		val := val
+		p.action(func() error {
+			return add(val)
+		}, "add %s %s to target %s", what, k, wwn)
+	}
+	for _, val := range have {
+		k := key(val)
+		if wanted[k] {
+			continue
+		}
+		if prune {
+			p.action(func() error {
+				return del(k)
+			}, "remove %s %s from target %s", what, k, wwn)
+		} else {
+			p.notef("target %s: %s %s is not in the configuration, kept", wwn, what, k)
+		}
+	}
+}
+
+// PlanCtlConf works out how to bring SCST to the configuration of a
+// ctl.conf: devices for its LUNs, targets with their CHAP users, allowed
+// portals, initiators and LUN mappings. Targets, devices and target
+// settings missing from the configuration are removed only with prune.
+func PlanCtlConf(conf *CtlConf, prune bool) (plan Plan, err error) {
+	var (
+		existingDevices []string
+		existingTargets []string
+		lunIds          map[string]string
+	)
+	if existingDevices, err = scst.ScstGetDevices(); err != nil {
+		return
+	}
+	if lunIds, err = GetLunIds(); err != nil {
+		return
+	}
+	if existingTargets, err = scst.ScstGetIscsiTargets(); err != nil {
+		return
+	}
+	haveDevices := map[string]bool{}
+	for _, dev := range existingDevices {
+		if !strings.Contains(dev, ":") {
+			haveDevices[dev] = true
+		}
+	}
+	haveTargets := map[string]bool{}
+	for _, wwn := range existingTargets {
+		haveTargets[wwn] = true
+	}
+	for _, ignored := range conf.Ignored {
+		plan.notef("%s is not supported, ignored", ignored)
+	}
+
+	// Devices, named after the file like ctladm create does.
+	devices := map[*CtlConfLun]string{}
+	deviceLuns := map[string]*CtlConfLun{}
+	checked := map[*CtlConfLun]bool{}
+	for _, target := range conf.Targets {
+		for _, num := range target.LunNumbers() {
+			lun := target.Luns[num]
+			if checked[lun] {
+				continue
+			}
+			checked[lun] = true
+			if dev, ok := plan.planCtlConfDevice(lun, deviceLuns, haveDevices); ok {
+				devices[lun] = dev
+			}
+		}
+	}
+
+	relIds := plan.planCtlConfLunIds(conf, devices, deviceLuns, lunIds, haveTargets)
+
+	// Portal groups become the allowed_portal list of their targets, a
+	// wildcard address allows every portal.
+	portals := map[string][]string{}
+	anyPortal := map[string]bool{}
+	usedGroups := map[string]bool{}
+	for _, target := range conf.Targets {
+		for _, name := range target.PortalGroups {
+			usedGroups[name] = true
+		}
+	}
+	for _, name := range sortedGroupNames(usedGroups) {
+		pg := conf.PortalGroups[name]
+		for _, listen := range pg.Listen {
+			host, port := listenAddress(listen)
+			if port != CTLCONF_ISCSI_PORT {
+				plan.problemf("portal-group %s: listen %s uses port %s, SCST listens on port %s only", name, listen, port, CTLCONF_ISCSI_PORT)
+			}
+			if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+				anyPortal[name] = true
+			} else {
+				portals[name] = append(portals[name], host)
+			}
+		}
+		discovery := pg.DiscoveryAuthGroup
+		if discovery == "" {
+			discovery = CTLCONF_DEFAULT_GROUP
+		}
+		if conf.AuthGroups[discovery].Type() != "none" {
+			plan.notef("portal-group %s: discovery-auth-group %s is not enforced, SCST answers discovery from any initiator", name, discovery)
+		}
+	}
+
+	// New targets with a rel_tgt_id come first, SCST gives the others the
+	// lowest free one.
+	for _, withRelId := range []bool{true, false} {
+		for _, target := range conf.Targets {
+			if relId := relIds[target.Name]; (relId != "") == withRelId {
+				plan.planCtlConfTarget(target, devices, portals, anyPortal, haveTargets[target.Name], relId, prune)
+			}
+		}
+	}
+
+	// Removals come last so that nothing still in use is deleted.
+	wanted := map[string]bool{}
+	for _, target := range conf.Targets {
+		wanted[target.Name] = true
+	}
+	for _, wwn := range existingTargets {
+		wwn := wwn
+		if wanted[wwn] {
+			continue
+		}
+		if !prune {
+			plan.notef("target %s is not in the configuration, kept", wwn)
+			continue
+		}
+		plan.action(func() (err error) {
+			if err = scst.ScstDisableIscsiTarget(wwn); err == nil {
+				err = scst.ScstDeleteIscsiTarget(wwn)
+			}
+			return
+		}, "delete target %s", wwn)
+	}
+	for _, dev := range existingDevices {
+		dev := dev
+		if !haveDevices[dev] || deviceLuns[dev] != nil {
+			continue
+		}
+		if !prune {
+			plan.notef("device %s is not in the configuration, kept", dev)
+			continue
+		}
+		plan.action(func() error {
+			return scst.ScstDeleteDevice(dev)
+		}, "delete device %s", dev)
+	}
+	return
+}
+
+func sortedGroupNames(groups map[string]bool) (res []string) {
+	for name := range groups {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return
+}
+
+// planCtlConfDevice plans the device of a ctl.conf LUN. It returns false
+// when the LUN cannot be exported.
+func (p *Plan) planCtlConfDevice(lun *CtlConfLun, deviceLuns map[string]*CtlConfLun, haveDevices map[string]bool) (dev string, ok bool) {
+	var (
+		cur     map[string]string
+		lunType int
+	)
+	backend := lun.Backend
+	if backend == "" {
+		backend = "block"
+	}
+	switch lun.DeviceType {
+	case "", "0", "disk", "direct":
+		lunType = CTL_LUN_TYPE_DISK
+	case "5", "cd", "cdrom", "dvd":
+		lunType = CTL_LUN_TYPE_CDROM
+	default:
+		p.problemf("lun %s: device-type %s is not supported", lun.Name, lun.DeviceType)
+		return
+	}
+	handler, err := BackendHandler(backend, lunType)
+	if err != nil {
+		p.problemf("lun %s: %v", lun.Name, err)
+		return
+	}
+	if !HandlerNeedsFile(handler) {
+		// Named LUNs name their device, inline ones have no usable name.
+		if dev = lun.Name; strings.Contains(dev, ",") {
+			p.problemf("lun %s: backend %s needs a named lun to name its device", lun.Name, backend)
+			return
+		}
+	} else if lun.Path == "" {
+		p.problemf("lun %s: no path", lun.Name)
+		return
+	} else {
+		dev = filepath.Base(lun.Path)
+	}
+	if other := deviceLuns[dev]; other != nil {
+		p.problemf("lun %s: device %s is already used by lun %s", lun.Name, dev, other.Name)
+		return
+	}
+	deviceLuns[dev] = lun
+	if !HandlerNeedsFile(handler) {
+		if lun.Path != "" {
+			p.problemf("lun %s: backend %s takes no path", lun.Name, backend)
+			return
+		}
+	} else if _, err := os.Stat(lun.Path); err != nil {
+		p.problemf("lun %s: path %s not found", lun.Name, lun.Path)
+		return
+	}
+	options, dropped := ctlConfLunOptions(lun)
+	for _, name := range dropped {
+		p.problemf("lun %s: option %s has no SCST equivalent", lun.Name, name)
+	}
+	if lun.Size != "" {
+		if HandlerNeedsFile(handler) {
+			p.notef("lun %s: size is ignored, the device takes the size of %s", lun.Name, lun.Path)
+		} else if size, err := ParseSize(lun.Size); err != nil {
+			p.problemf("lun %s: %v", lun.Name, err)
+		} else {
+			options["size"] = strconv.FormatUint(size, 10)
+		}
+	}
+	params, attrs, err := HandlerOptionsToScst(handler, options)
+	if err != nil {
+		p.problemf("lun %s: %v", lun.Name, err)
+		return
+	}
+	if !haveDevices[dev] {
+		create := func() (err error) {
+			if err = scst.ScstAddDevice(handler, dev, params); err == nil {
+				for _, attr := range sortedKeys(attrs) {
+					if err = scst.ScstSetDeviceParam(dev, attr, attrs[attr]); err != nil {
+						break
+					}
+				}
+			}
+			return
+		}
+		if HandlerNeedsFile(handler) {
+			p.action(create, "create device %s backed by %s", dev, lun.Path)
+		} else {
+			p.action(create, "create %s device %s", handler, dev)
+		}
+		return dev, true
+	}
+
+	if cur, _ := scst.ScstGetDeviceHandler(dev); cur != handler {
+		p.problemf("lun %s: device %s exists with handler %s instead of %s", lun.Name, dev, cur, handler)
+		return
+	}
+	if cur, err = scst.ScstGetDeviceParams(dev); err != nil {
+		p.problemf("lun %s: %v", lun.Name, err)
+		return
+	}
+	if HandlerNeedsFile(handler) && strings.Split(cur["filename"], "\n")[0] != lun.Path {
+		p.problemf("lun %s: device %s exists and is backed by %s", lun.Name, dev, cur["filename"])
+		return
+	}
+	// add_device parameters cannot change, only complain about the ones
+	// the configuration asks for.
+	explicit := map[string]bool{}
+	for name := range options {
+		if option, ok := FindCtlOption(name); ok {
+			explicit[option.Scst] = true
+		}
+	}
+	for _, param := range sortedKeys(params) {
+		if val, ok := cur[param]; ok && explicit[param] && param != "filename" && strings.Split(val, "\n")[0] != params[param] {
+			p.problemf("lun %s: %s of device %s is %s and cannot be changed to %s", lun.Name, param, dev, strings.Split(val, "\n")[0], params[param])
+		}
+	}
+	for _, attr := range sortedKeys(attrs) {
+		attr, val := attr, attrs[attr]
+		if strings.Split(cur[attr], "\n")[0] != val {
+			p.action(func() error {
+				return scst.ScstSetDeviceParam(dev, attr, val)
+			}, "set %s of device %s to %s", attr, dev, val)
+		}
+	}
+	if cur["active"] == "0" {
+		p.action(func() error {
+			return scst.ScstActivateDevice(dev)
+		}, "activate device %s", dev)
+	}
+	return dev, true
+}
+
+// planCtlConfLunIds keeps the ctl-lun IDs of the configuration. A LUN 0
+// of a new target gets its ID as the rel_tgt_id of the target, like
+// ctladm create does, other devices store it unless they already have it.
+// It returns the rel_tgt_id of the new targets by name.
+func (p *Plan) planCtlConfLunIds(conf *CtlConf, devices map[*CtlConfLun]string, deviceLuns map[string]*CtlConfLun, lunIds map[string]string, haveTargets map[string]bool) (relIds map[string]string) {
+	var (
+		names []string
+	)
+	relIds = map[string]string{}
+	holders := map[int]string{}
+	for dev, id := range lunIds {
+		num, _ := strconv.Atoi(id)
+		holders[num] = dev
+	}
+	usedRelIds := map[string]bool{}
+	for wwn := range haveTargets {
+		if relId, err := scst.ScstGetIscsiTargetParam(wwn, "rel_tgt_id"); err == nil {
+			usedRelIds[relId] = true
+		}
+	}
+	for dev := range deviceLuns {
+		names = append(names, dev)
+	}
+	sort.Strings(names)
+	wanted := map[int]*CtlConfLun{}
+	for _, dev := range names {
+		dev, lun := dev, deviceLuns[dev]
+		if _, ok := devices[lun]; !ok || lun.CtlLun == 0 {
+			continue
+		}
+		id := lun.CtlLun
+		if other := wanted[id]; other != nil {
+			p.problemf("lun %s: ctl-lun %d is already used by lun %s", lun.Name, id, other.Name)
+			continue
+		}
+		wanted[id] = lun
+		if holder, ok := holders[id]; ok && holder == dev {
+			continue
+		} else if ok && (deviceLuns[holder] == nil || deviceLuns[holder].CtlLun == 0) {
+			p.problemf("lun %s: ctl-lun %d is the LUN ID of device %s", lun.Name, id, holder)
+			continue
+		}
+		relId := strconv.Itoa(id)
+		if wwn := newTargetOfLun0(conf, lun, haveTargets, relIds); wwn != "" && !usedRelIds[relId] {
+			relIds[wwn] = relId
+			usedRelIds[relId] = true
+			continue
+		}
+		label := CTL_LUN_ID_PREFIX + relId
+		p.action(func() error {
+			return scst.ScstSetDeviceParam(dev, CTL_LUN_ID_ATTR, label)
+		}, "keep LUN ID %d in device %s", id, dev)
+	}
+	return
+}
+
+// newTargetOfLun0 returns the first target of the configuration that does
+// not exist yet, has no rel_tgt_id planned and exports lun as LUN 0.
+func newTargetOfLun0(conf *CtlConf, lun *CtlConfLun, haveTargets map[string]bool, relIds map[string]string) string {
+	for _, target := range conf.Targets {
+		if target.Luns[0] == lun && !haveTargets[target.Name] && relIds[target.Name] == "" {
+			return target.Name
+		}
+	}
+	return ""
+}
+
+// iniGroupLabel names an initiator group of a target in plan messages.
+func iniGroupLabel(group string) string {
+	if group == "" {
+		return "the default LUN table"
+	}
+	return "group " + group
+}
+
+func (p *Plan) planCtlConfTarget(target *CtlConfTarget, devices map[*CtlConfLun]string, portals map[string][]string, anyPortal map[string]bool, exists bool, relId string, prune bool) {
+	var (
+		haveIn, haveOut, havePortals, haveInitiators []string
+		wantIn, wantOut, wantPortals                 []string
+		haveLuns, otherLuns                          []scst.ScstLun
+	)
+	wwn := target.Name
+	ag := target.Auth
+	// Without initiator-name any initiator may log in. Initiators outside
+	// the allowed_ini group only see the default LUN table of the target,
+	// so the LUNs of such a target go there.
+	group, otherGroup := scst.SYSFS_SCST_INI_GROUP, ""
+	if len(ag.InitiatorNames) == 0 && ag.Type() != "deny" {
+		group, otherGroup = "", scst.SYSFS_SCST_INI_GROUP
+	}
+	if !exists && relId != "" {
+		p.action(func() (err error) {
+			if err = scst.ScstAddIscsiTarget(wwn); err == nil {
+				err = scst.ScstSetIscsiTargetParam(wwn, "rel_tgt_id", relId)
+			}
+			return
+		}, "create target %s with rel_tgt_id %s", wwn, relId)
+	} else if !exists {
+		p.action(func() error {
+			return scst.ScstAddIscsiTarget(wwn)
+		}, "create target %s", wwn)
+	} else {
+		haveIn, _ = scst.ScstGetIscsiTargetAttrValues(wwn, "IncomingUser")
+		haveOut, _ = scst.ScstGetIscsiTargetAttrValues(wwn, "OutgoingUser")
+		havePortals, _ = scst.ScstGetIscsiTargetAttrValues(wwn, "allowed_portal")
+		haveInitiators, _ = scst.ScstGetIniGroupInitiators(wwn, scst.SYSFS_SCST_INI_GROUP)
+		haveLuns, _ = scst.ScstGetGroupLuns(wwn, group)
+		otherLuns, _ = scst.ScstGetGroupLuns(wwn, otherGroup)
+	}
+	if target.Alias != "" {
+		p.notef("target %s: alias is not supported by SCST, ignored", wwn)
+	}
+	for _, portal := range ag.InitiatorPortals {
+		p.problemf("target %s: initiator-portal %s cannot be enforced by SCST", wwn, portal)
+	}
+
+	switch ag.Type() {
+	case "chap", "chap-mutual":
+		if len(ag.Chap) == 0 {
+			p.problemf("target %s: auth-group %s has auth-type %s and no chap users", wwn, ag.Name, ag.Type())
+		}
+		for _, chap := range ag.Chap {
+			wantIn = append(wantIn, chap.User+" "+chap.Secret)
+			if chap.MutualUser != "" {
+				mutual := chap.MutualUser + " " + chap.MutualSecret
+				if len(wantOut) > 0 && wantOut[0] != mutual {
+					p.problemf("target %s: SCST supports one mutual CHAP user per target", wwn)
+					continue
+				}
+				wantOut = []string{mutual}
+			}
+		}
+	case "deny":
+		// The target is disabled, its CHAP users and initiators are kept for
+		// when it is enabled again.
+		p.notef("target %s: auth-group %s denies access, the target is disabled", wwn, ag.Name)
+		wantIn, wantOut = haveIn, haveOut
+	}
+	p.convergeValues(wwn, "IncomingUser", haveIn, wantIn, prune, func(val string) error {
+		return scst.ScstAddIscsiTargetAttr(wwn, "IncomingUser", val)
+	}, func(key string) error {
+		return scst.ScstDelIscsiTargetAttr(wwn, "IncomingUser", key)
+	})
+	p.convergeValues(wwn, "OutgoingUser", haveOut, wantOut, prune, func(val string) error {
+		return scst.ScstAddIscsiTargetAttr(wwn, "OutgoingUser", val)
+	}, func(key string) error {
+		return scst.ScstDelIscsiTargetAttr(wwn, "OutgoingUser", key)
+	})
+
+	seen := map[string]bool{}
+	for _, name := range target.PortalGroups {
+		if anyPortal[name] {
+			wantPortals = nil
+			break
+		}
+		for _, host := range portals[name] {
+			if !seen[host] {
+				seen[host] = true
+				wantPortals = append(wantPortals, host)
+			}
+		}
+	}
+	p.convergeValues(wwn, "allowed_portal", havePortals, wantPortals, prune, func(val string) error {
+		return scst.ScstAddIscsiTargetAttr(wwn, "allowed_portal", val)
+	}, func(key string) error {
+		return scst.ScstDelIscsiTargetAttr(wwn, "allowed_portal", key)
+	})
+	wantInitiators := ag.InitiatorNames
+	if ag.Type() == "deny" {
+		wantInitiators = haveInitiators
+	}
+	p.convergeValues(wwn, "initiator", haveInitiators, wantInitiators, prune, func(val string) error {
+		return scst.ScstAddIniGroupInitiator(wwn, scst.SYSFS_SCST_INI_GROUP, val)
+	}, func(key string) error {
+		return scst.ScstDelIniGroupInitiator(wwn, scst.SYSFS_SCST_INI_GROUP, key)
+	})
+
+	mapped := map[int]string{}
+	for _, lun := range haveLuns {
+		mapped[lun.Lun] = lun.Device.Name
+	}
+	for _, num := range target.LunNumbers() {
+		dev, ok := devices[target.Luns[num]]
+		if !ok || mapped[num] == dev {
+			continue
+		}
+		num := num
+		p.action(func() error {
+			return scst.ScstMapLun(wwn, group, dev, num)
+		}, "map device %s as LUN %d of %s", dev, num, wwn)
+	}
+	for _, lun := range haveLuns {
+		num := lun.Lun
+		if _, ok := target.Luns[num]; ok {
+			continue
+		}
+		if prune {
+			p.action(func() error {
+				return scst.ScstUnmapLun(wwn, group, num)
+			}, "unmap LUN %d of %s", num, wwn)
+		} else {
+			p.notef("target %s: LUN %d is not in the configuration, kept", wwn, num)
+		}
+	}
+	// LUNs of the configuration still in the other table are moved out of
+	// it whatever prune says, left in the default table a restricted target
+	// would show them to every initiator.
+	for _, lun := range otherLuns {
+		num := lun.Lun
+		if _, ok := target.Luns[num]; ok || prune {
+			p.action(func() error {
+				return scst.ScstUnmapLun(wwn, otherGroup, num)
+			}, "unmap LUN %d of %s from %s", num, wwn, iniGroupLabel(otherGroup))
+		} else {
+			p.notef("target %s: LUN %d of %s is not in the configuration, kept", wwn, num, iniGroupLabel(otherGroup))
+		}
+	}
+
+	enabled := exists && scst.ScstIscsiTargetEnabled(wwn)
+	if want := ag.Type() != "deny"; want && !enabled {
+		p.action(func() error {
+			return scst.ScstEnableIscsiTarget(wwn)
+		}, "enable target %s", wwn)
+	} else if !want && enabled {
+		p.action(func() error {
+			return scst.ScstDisableIscsiTarget(wwn)
+		}, "disable target %s", wwn)
+	}
+}
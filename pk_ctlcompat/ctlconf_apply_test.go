@@ -0,0 +1,133 @@
+package pk_ctlcompat
+
+import (
+	"fmt"
+	"testing"
+
+	scst "github.com/Tualua/pk_ctladm/pk_scst"
+)
+
+const testWwn = CTLD_IQN_PREFIX + ":conf1"
+
+// applyCtlConf applies the ctl.conf text and returns the number of actions
+// it took.
+func applyCtlConf(t *testing.T, text string, prune bool) int {
+	t.Helper()
+	conf, err := ParseCtlConf([]byte(text))
+	if err != nil {
+		t.Fatalf("ParseCtlConf: %v", err)
+	}
+	plan, err := PlanCtlConf(conf, prune)
+	if err != nil {
+		t.Fatalf("PlanCtlConf: %v", err)
+	}
+	if len(plan.Problems) > 0 {
+		t.Fatalf("PlanCtlConf problems: %v", plan.Problems)
+	}
+	if err = plan.Apply(nil); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	return len(plan.Actions)
+}
+
+// groupLuns returns the devices of the LUN table of group of target wwn by
+// LUN number.
+func groupLuns(t *testing.T, wwn string, group string) (res map[int]string) {
+	t.Helper()
+	luns, err := scst.ScstGetGroupLuns(wwn, group)
+	if err != nil {
+		t.Fatalf("ScstGetGroupLuns %s: %v", group, err)
+	}
+	res = map[int]string{}
+	for _, lun := range luns {
+		res[lun.Lun] = lun.Device.Name
+	}
+	return
+}
+
+func TestApplyCtlConfLunGroup(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		auth  string
+		group string
+	}{
+		{"no-authentication", "auth-group no-authentication", ""},
+		{"auth-type none", "auth-type none", ""},
+		{"chap without initiator-name", "chap user1 secret123456", ""},
+		{"initiator-name", "initiator-name iqn.1994-05.com.example:host1", scst.SYSFS_SCST_INI_GROUP},
+		{"chap and initiator-name", "chap user1 secret123456\n\tinitiator-name iqn.1994-05.com.example:host1", scst.SYSFS_SCST_INI_GROUP},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			setupScst(t)
+			dir := lunFiles(t, "vol1")
+			text := fmt.Sprintf("target %s {\n\t%s\n\tlun 0 {\n\t\tpath %s/vol1\n\t}\n}\n", testWwn, c.auth, dir)
+			applyCtlConf(t, text, false)
+
+			other := ""
+			if c.group == "" {
+				other = scst.SYSFS_SCST_INI_GROUP
+			}
+			if luns := groupLuns(t, testWwn, c.group); luns[0] != "vol1" {
+				t.Errorf("LUN 0 of %s is %q, want vol1", iniGroupLabel(c.group), luns[0])
+			}
+			if luns := groupLuns(t, testWwn, other); len(luns) > 0 {
+				t.Errorf("%s has LUNs %v", iniGroupLabel(other), luns)
+			}
+			if n := applyCtlConf(t, text, false); n != 0 {
+				t.Errorf("applying again took %d actions", n)
+			}
+		})
+	}
+}
+
+func TestApplyCtlConfMovesLuns(t *testing.T) {
+	setupScst(t)
+	dir := lunFiles(t, "vol1")
+	open := fmt.Sprintf("target %s {\n\tauth-group no-authentication\n\tlun 0 {\n\t\tpath %s/vol1\n\t}\n}\n", testWwn, dir)
+	restricted := fmt.Sprintf("target %s {\n\tinitiator-name iqn.1994-05.com.example:host1\n\tlun 0 {\n\t\tpath %s/vol1\n\t}\n}\n", testWwn, dir)
+	for _, step := range []struct {
+		text  string
+		group string
+	}{
+		{open, ""},
+		{restricted, scst.SYSFS_SCST_INI_GROUP},
+		{open, ""},
+	} {
+		applyCtlConf(t, step.text, false)
+		other := ""
+		if step.group == "" {
+			other = scst.SYSFS_SCST_INI_GROUP
+		}
+		if luns := groupLuns(t, testWwn, step.group); luns[0] != "vol1" {
+			t.Errorf("LUN 0 of %s is %q, want vol1", iniGroupLabel(step.group), luns[0])
+		}
+		if luns := groupLuns(t, testWwn, other); len(luns) > 0 {
+			t.Errorf("%s kept LUNs %v", iniGroupLabel(other), luns)
+		}
+	}
+}
+
+func TestApplyCtlConfCtlLun(t *testing.T) {
+	setupScst(t)
+	dir := lunFiles(t, "vol1", "vol2")
+	text := fmt.Sprintf("target %s {\n\tauth-group no-authentication\n\tlun 0 {\n\t\tpath %s/vol1\n\t\tctl-lun 7\n\t}\n\tlun 1 {\n\t\tpath %s/vol2\n\t\tctl-lun 3\n\t}\n}\n", testWwn, dir, dir)
+	applyCtlConf(t, text, false)
+	ids, err := GetLunIds()
+	if err != nil {
+		t.Fatalf("GetLunIds: %v", err)
+	}
+	if ids["vol1"] != "7" || ids["vol2"] != "3" {
+		t.Errorf("LUN IDs are %v, want vol1 7 and vol2 3", ids)
+	}
+	if n := applyCtlConf(t, text, false); n != 0 {
+		t.Errorf("applying again took %d actions", n)
+	}
+
+	conf, err := ParseCtlConf([]byte(fmt.Sprintf("lun other {\n\tpath %s/vol1\n\tctl-lun 3\n}\ntarget %s {\n\tlun 0 other\n}\n", dir, testWwn)))
+	if err != nil {
+		t.Fatalf("ParseCtlConf: %v", err)
+	}
+	if plan, err := PlanCtlConf(conf, false); err != nil || len(plan.Problems) != 1 {
+		t.Errorf("taking the LUN ID of vol2: got problems %v, error %v", plan.Problems, err)
+	}
+}
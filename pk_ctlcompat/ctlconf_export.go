@@ -0,0 +1,174 @@
+package pk_ctlcompat
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	scst "github.com/Tualua/pk_ctladm/pk_scst"
+)
+
+func scstConfAttrMap(attrs []scst.ScstConfAttr) (res map[string]string) {
+	res = map[string]string{}
+	for _, attr := range attrs {
+		res[attr.Name] = attr.Value
+	}
+	return
+}
+
+// ctlConfLunFromScst describes a device as a ctl.conf LUN named after it,
+// with the options SCST has set away from their defaults.
+func ctlConfLunFromScst(device *scst.ScstConfDevice, handler string) (lun *CtlConfLun) {
+	lun = &CtlConfLun{Name: device.Name, Options: map[string]string{}}
+	if backend := ScstHandlerBackends[handler]; backend != "block" {
+		lun.Backend = backend
+	}
+	attrs := scstConfAttrMap(device.Attrs)
+	switch handler {
+	case scst.SCST_HANDLER_CDROM:
+		lun.DeviceType = "cd"
+	case scst.SCST_HANDLER_NULLIO:
+		lun.Size = attrs["size"]
+	}
+	for _, option := range CtlOptionsFromScst(attrs) {
+		switch option[0] {
+		case "file":
+			lun.Path = option[1]
+		case "blocksize":
+			lun.Blocksize, _ = strconv.Atoi(option[1])
+		case "serial_number":
+			lun.Serial = option[1]
+		case "device_id":
+			lun.DeviceId = option[1]
+		default:
+			lun.Options[option[0]] = option[1]
+		}
+	}
+	return
+}
+
+// CtlConfFromScst describes the running SCST as a ctl.conf. Devices become
+// named LUNs with their LUN IDs as ctl-lun, the CHAP users and allowed_ini
+// initiators of a target its own auth settings and its allowed portals a
+// portal group. Disabled targets get the no-access auth-group, their auth
+// settings are kept in an auth-group named after the target.
+func CtlConfFromScst() (conf *CtlConf, err error) {
+	var (
+		scstConf *scst.ScstConfig
+		lunIds   map[string]string
+	)
+	if scstConf, err = scst.ScstReadConfig(); err != nil {
+		return
+	}
+	if lunIds, err = GetLunIds(); err != nil {
+		return
+	}
+	conf = &CtlConf{
+		AuthGroups:   map[string]*CtlConfAuthGroup{},
+		PortalGroups: map[string]*CtlConfPortalGroup{},
+		Luns:         map[string]*CtlConfLun{},
+	}
+	for _, handler := range scstConf.Handlers {
+		if _, ok := ScstHandlerBackends[handler.Name]; !ok {
+			continue
+		}
+		for _, device := range handler.Devices {
+			conf.Luns[device.Name] = ctlConfLunFromScst(device, handler.Name)
+			conf.Luns[device.Name].CtlLun, _ = strconv.Atoi(lunIds[device.Name])
+		}
+	}
+
+	// SCST answers discovery from anyone, say so instead of inheriting the
+	// default auth-group that denies it.
+	conf.PortalGroups[CTLCONF_DEFAULT_GROUP] = &CtlConfPortalGroup{
+		Name:               CTLCONF_DEFAULT_GROUP,
+		Listen:             []string{"0.0.0.0", "[::]"},
+		DiscoveryAuthGroup: "no-authentication",
+	}
+	portalGroups := map[string]string{}
+	for _, driver := range scstConf.Drivers {
+		if driver.Name != scst.SCST_ISCSI_DRIVER {
+			continue
+		}
+		for _, scstTarget := range driver.Targets {
+			var (
+				incoming, outgoing, portals []string
+			)
+			target := &CtlConfTarget{Name: scstTarget.Name, Luns: map[int]*CtlConfLun{}}
+			enabled := false
+			for _, attr := range scstTarget.Attrs {
+				switch attr.Name {
+				case "enabled":
+					enabled = attr.Value == "1"
+				case "IncomingUser":
+					incoming = append(incoming, attr.Value)
+				case "OutgoingUser":
+					outgoing = append(outgoing, attr.Value)
+				case "allowed_portal":
+					portals = append(portals, attr.Value)
+				}
+			}
+			for _, lun := range scstTarget.Luns {
+				if l, ok := conf.Luns[lun.Device]; ok {
+					target.Luns[lun.Lun] = l
+				}
+			}
+			auth := &CtlConfAuthGroup{Name: "target " + target.Name}
+			for _, group := range scstTarget.Groups {
+				if group.Name != scst.SYSFS_SCST_INI_GROUP {
+					continue
+				}
+				for _, lun := range group.Luns {
+					if l, ok := conf.Luns[lun.Device]; ok {
+						target.Luns[lun.Lun] = l
+					}
+				}
+				auth.InitiatorNames = group.Initiators
+			}
+			for _, user := range incoming {
+				fields := strings.Fields(user)
+				if len(fields) != 2 {
+					continue
+				}
+				chap := CtlConfChap{User: fields[0], Secret: fields[1]}
+				if len(outgoing) > 0 {
+					if mutual := strings.Fields(outgoing[0]); len(mutual) == 2 {
+						chap.MutualUser, chap.MutualSecret = mutual[0], mutual[1]
+					}
+				}
+				auth.Chap = append(auth.Chap, chap)
+			}
+			switch {
+			case !enabled:
+				target.AuthGroup = "no-access"
+				if len(auth.Chap) > 0 || len(auth.InitiatorNames) > 0 {
+					auth.Name = target.Name
+					conf.AuthGroups[auth.Name] = auth
+					target.Comment = fmt.Sprintf("disabled in SCST, auth-group %s has its auth settings", auth.Name)
+					conf.Notes = append(conf.Notes, fmt.Sprintf("target %s is disabled, exported with auth-group no-access and its auth settings in auth-group %s", target.Name, auth.Name))
+				} else {
+					target.Comment = "disabled in SCST"
+				}
+			case len(auth.Chap) == 0 && len(auth.InitiatorNames) == 0:
+				target.AuthGroup = "no-authentication"
+			default:
+				target.Auth = auth
+			}
+
+			if len(portals) == 0 {
+				target.PortalGroups = []string{CTLCONF_DEFAULT_GROUP}
+			} else {
+				key := strings.Join(portals, " ")
+				name, ok := portalGroups[key]
+				if !ok {
+					name = fmt.Sprintf("pg%d", len(portalGroups))
+					portalGroups[key] = name
+					conf.PortalGroups[name] = &CtlConfPortalGroup{Name: name, Listen: portals, DiscoveryAuthGroup: "no-authentication"}
+				}
+				target.PortalGroups = []string{name}
+			}
+			conf.Targets = append(conf.Targets, target)
+		}
+	}
+	return
+}
@@ -0,0 +1,61 @@
+package pk_ctlcompat
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"syscall"
+
+	zfs "github.com/Tualua/pk_ctladm/pk_zfs"
+)
+
+// ErrUsage is a bad command line, ErrInvalid an option or value that does
+// not validate. Anything else SCST refuses, EINVAL included, is a plain
+// failure.
+var (
+	ErrUsage    = errors.New("invalid usage")
+	ErrInvalid  = errors.New("invalid argument")
+	ErrNotFound = errors.New("not found")
+	ErrBusy     = errors.New("busy")
+)
+
+type CtlError struct {
+	Kind error
+	Err  error
+}
+
+func (e *CtlError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *CtlError) Unwrap() error {
+	return e.Err
+}
+
+func (e *CtlError) Is(target error) bool {
+	return e.Kind != nil && target == e.Kind
+}
+
+// CtlErrorf formats an error of kind, %w keeps the cause for ErrorKind when
+// kind is nil.
+func CtlErrorf(kind error, format string, args ...interface{}) error {
+	return &CtlError{Kind: kind, Err: fmt.Errorf(format, args...)}
+}
+
+// ErrorKind classifies err as ErrUsage, ErrInvalid, ErrNotFound or ErrBusy,
+// looking through the errors it wraps down to the ones of the SCST sysfs and
+// of pk_zfs. A dataset that already exists is busy like a LUN ID in use.
+func ErrorKind(err error) (kind error) {
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrUsage):
+		kind = ErrUsage
+	case errors.Is(err, ErrInvalid):
+		kind = ErrInvalid
+	case errors.Is(err, ErrNotFound), errors.Is(err, fs.ErrNotExist), errors.Is(err, zfs.ErrNotFound):
+		kind = ErrNotFound
+	case errors.Is(err, ErrBusy), errors.Is(err, syscall.EBUSY), errors.Is(err, zfs.ErrBusy), errors.Is(err, zfs.ErrExists):
+		kind = ErrBusy
+	}
+	return
+}
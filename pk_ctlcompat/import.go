@@ -0,0 +1,279 @@
+package pk_ctlcompat
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	scst "github.com/Tualua/pk_ctladm/pk_scst"
+)
+
+type importTarget struct {
+	wwn      string
+	relId    int
+	online   bool
+	mappings []PortLun
+}
+
+// importOptions turns the LUN into CTL options that CtlOptionsToScst can
+// map, options SCST has no equivalent for are returned in dropped.
+func importOptions(lun Lun, handler string) (options map[string]string, dropped []string) {
+	options = map[string]string{}
+	if HandlerNeedsFile(handler) {
+		options["file"] = lun.File
+	} else {
+		options["size"] = strconv.FormatUint(lun.Size*uint64(lun.Blocksize), 10)
+	}
+	if lun.Blocksize > 0 {
+		options["blocksize"] = strconv.Itoa(lun.Blocksize)
+	}
+	if lun.SerialNumber != "" {
+		options["serial_number"] = lun.SerialNumber
+	}
+	if lun.DeviceId != "" {
+		options["device_id"] = lun.DeviceId
+	}
+	if lun.NumThreads > 0 {
+		options["num_threads"] = strconv.Itoa(lun.NumThreads)
+	}
+	for _, name := range OptionNames(lun.Options) {
+		switch name {
+		case "file", "ctld_name", "num_threads":
+			continue
+		}
+		if option, ok := FindCtlOption(name); ok && option.Ctl != "" {
+			options[name] = lun.Options[name]
+		} else {
+			dropped = append(dropped, name)
+		}
+	}
+	return
+}
+
+// PlanImport works out how to recreate the LUNs of a devlist -x dump and
+// the iSCSI ports of a portlist -x dump in SCST. Without ports the targets
+// come from the ctld_name of every LUN, the way ctladm create does it.
+func PlanImport(luns []Lun, ports []Port) (plan Plan, err error) {
+	var (
+		existingDevices []string
+		existingTargets []string
+		targets         []*importTarget
+	)
+	if existingDevices, err = scst.ScstGetDevices(); err != nil {
+		return
+	}
+	if existingTargets, err = scst.ScstGetIscsiTargets(); err != nil {
+		return
+	}
+	usedDevices := map[string]bool{}
+	for _, dev := range existingDevices {
+		usedDevices[dev] = true
+	}
+	usedTargets := map[string]bool{}
+	usedRelIds := map[int]string{}
+	for _, wwn := range existingTargets {
+		usedTargets[wwn] = true
+		if relId, err := scst.ScstGetIscsiTargetParam(wwn, "rel_tgt_id"); err == nil {
+			if id, err := strconv.Atoi(relId); err == nil {
+				usedRelIds[id] = wwn
+			}
+		}
+	}
+
+	devices := map[int]string{}
+	deviceLuns := map[string]int{}
+	for _, lun := range luns {
+		var (
+			dev string
+		)
+		handler, err := BackendHandler(lun.BackendType, lun.LunType)
+		if err != nil {
+			plan.problemf("LUN %d: %v", lun.Id, err)
+			continue
+		}
+		if !HandlerNeedsFile(handler) {
+			if dev = lun.DeviceId; dev == "" {
+				plan.problemf("LUN %d: backend %s needs a device_id to name its device", lun.Id, lun.BackendType)
+				continue
+			}
+		} else if lun.File == "" {
+			plan.problemf("LUN %d: no file", lun.Id)
+			continue
+		} else if _, err := os.Stat(lun.File); err != nil {
+			plan.problemf("LUN %d: file %s not found", lun.Id, lun.File)
+			continue
+		} else {
+			dev = filepath.Base(lun.File)
+		}
+		if other, ok := deviceLuns[dev]; ok {
+			plan.problemf("LUN %d: device %s is already used by LUN %d", lun.Id, dev, other)
+			continue
+		} else if usedDevices[dev] {
+			plan.problemf("LUN %d: device %s already exists", lun.Id, dev)
+			continue
+		}
+		options, dropped := importOptions(lun, handler)
+		for _, name := range dropped {
+			plan.problemf("LUN %d: option %s has no SCST equivalent", lun.Id, name)
+		}
+		params, attrs, err := HandlerOptionsToScst(handler, options)
+		if err != nil {
+			plan.problemf("LUN %d: %v", lun.Id, err)
+			continue
+		}
+		usedDevices[dev] = true
+		deviceLuns[dev] = lun.Id
+		devices[lun.Id] = dev
+		create := func() (err error) {
+			if err = scst.ScstAddDevice(handler, dev, params); err == nil {
+				for _, attr := range sortedKeys(attrs) {
+					if err = scst.ScstSetDeviceParam(dev, attr, attrs[attr]); err != nil {
+						break
+					}
+				}
+			}
+			return
+		}
+		if HandlerNeedsFile(handler) {
+			plan.action(create, "create device %s for LUN %d backed by %s", dev, lun.Id, lun.File)
+		} else {
+			plan.action(create, "create %s device %s for LUN %d", handler, dev, lun.Id)
+		}
+	}
+
+	if ports == nil {
+		byWwn := map[string]*importTarget{}
+		for _, lun := range luns {
+			if _, ok := devices[lun.Id]; !ok {
+				continue
+			}
+			wwn, lunNum := lun.Export()
+			num, err := strconv.Atoi(lunNum)
+			if wwn == "" || err != nil {
+				plan.problemf("LUN %d: ctld_name %s does not name a target and LUN", lun.Id, lun.CtldName)
+				continue
+			}
+			target, ok := byWwn[wwn]
+			if !ok {
+				target = &importTarget{wwn: wwn, online: true}
+				byWwn[wwn] = target
+				targets = append(targets, target)
+			}
+			if num == 0 && target.relId == 0 {
+				target.relId = lun.Id
+			}
+			target.mappings = append(target.mappings, PortLun{Lun: num, Id: lun.Id})
+		}
+	} else {
+		byWwn := map[string]*importTarget{}
+		for _, port := range ports {
+			if port.FrontendType != "iscsi" {
+				plan.notef("port %d: %s ports have no SCST equivalent, skipped", port.Id, port.FrontendType)
+				continue
+			}
+			wwn := port.Target
+			if port.CfiscsiTarget != "" {
+				wwn = port.CfiscsiTarget
+			}
+			if first, ok := byWwn[wwn]; ok {
+				plan.notef("port %d: target %s is already imported as port %d, SCST targets listen on every portal", port.Id, wwn, first.relId)
+				continue
+			}
+			if !port.LunMap {
+				plan.problemf("port %d: ports without a LUN map are not supported", port.Id)
+				continue
+			}
+			target := &importTarget{wwn: wwn, relId: port.Id, online: port.Online}
+			for _, lun := range port.Luns {
+				if _, ok := devices[lun.Id]; ok {
+					target.mappings = append(target.mappings, lun)
+				} else {
+					plan.problemf("port %d: LUN %d maps LUN %d, which is not imported", port.Id, lun.Lun, lun.Id)
+				}
+			}
+			byWwn[wwn] = target
+			targets = append(targets, target)
+		}
+	}
+
+	// SCST numbers targets created without a rel_tgt_id itself, create them
+	// last so they cannot take one of the imported IDs.
+	sort.SliceStable(targets, func(i, j int) bool {
+		return targets[i].relId > 0 && targets[j].relId == 0
+	})
+	for _, target := range targets {
+		target := target
+		if usedTargets[target.wwn] {
+			plan.problemf("target %s already exists", target.wwn)
+			continue
+		}
+		relId := ""
+		if target.relId > 0 {
+			if owner, ok := usedRelIds[target.relId]; ok {
+				plan.problemf("target %s: rel_tgt_id %d is used by %s", target.wwn, target.relId, owner)
+				continue
+			}
+			usedRelIds[target.relId] = target.wwn
+			relId = strconv.Itoa(target.relId)
+		}
+		desc := "create target " + target.wwn
+		if relId != "" {
+			desc += " with rel_tgt_id " + relId
+		}
+		plan.action(func() (err error) {
+			if err = scst.ScstAddIscsiTarget(target.wwn); err == nil && relId != "" {
+				err = scst.ScstSetIscsiTargetParam(target.wwn, "rel_tgt_id", relId)
+			}
+			return
+		}, "%s", desc)
+		for _, m := range target.mappings {
+			dev, lunNum := devices[m.Id], m.Lun
+			plan.action(func() error {
+				return scst.ScstMapLun(target.wwn, scst.SYSFS_SCST_INI_GROUP, dev, lunNum)
+			}, "map device %s as LUN %d of %s", dev, lunNum, target.wwn)
+		}
+		if target.online {
+			plan.action(func() error {
+				return scst.ScstEnableIscsiTarget(target.wwn)
+			}, "enable target %s", target.wwn)
+		}
+	}
+
+	// LUN IDs follow the rel_tgt_id of the target exporting the device as
+	// LUN 0, say where that differs from the CTL LUN ID. Devices without a
+	// LUN 0 export keep their ID in the device when no target or LUN has it.
+	usedIds := map[int]bool{}
+	if existingIds, err := GetLunIds(); err == nil {
+		for _, id := range existingIds {
+			num, _ := strconv.Atoi(id)
+			usedIds[num] = true
+		}
+	}
+	newIds := map[int]int{}
+	for _, target := range targets {
+		for _, m := range target.mappings {
+			if m.Lun == 0 && target.relId > 0 && (newIds[m.Id] == 0 || target.relId < newIds[m.Id]) {
+				newIds[m.Id] = target.relId
+			}
+		}
+	}
+	for _, lun := range luns {
+		if _, ok := devices[lun.Id]; !ok {
+			continue
+		}
+		if id, ok := newIds[lun.Id]; !ok {
+			if _, taken := usedRelIds[lun.Id]; taken || usedIds[lun.Id] {
+				plan.notef("LUN %d: not exported as LUN 0 of any port and its ID is taken, it gets an ID above the highest port", lun.Id)
+				continue
+			}
+			dev, label := devices[lun.Id], CTL_LUN_ID_PREFIX+strconv.Itoa(lun.Id)
+			plan.action(func() error {
+				return scst.ScstSetDeviceParam(dev, CTL_LUN_ID_ATTR, label)
+			}, "keep LUN ID %d in device %s", lun.Id, dev)
+		} else if id != lun.Id {
+			plan.notef("LUN %d: listed as LUN %d after the import", lun.Id, id)
+		}
+	}
+	return
+}
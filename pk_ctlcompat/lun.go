@@ -0,0 +1,380 @@
+package pk_ctlcompat
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	scst "github.com/Tualua/pk_ctladm/pk_scst"
+)
+
+// findManagedDevice returns the device of LUN lun. Like the -b of ctladm
+// remove and modify, a non-empty backend has to be the one serving the LUN.
+func findManagedDevice(lun string, backend string) (device string, err error) {
+	if device, err = FindLunDevice(lun); err != nil || device == "" {
+		if backend == "" {
+			err = CtlErrorf(ErrNotFound, "LUN %s not found", lun)
+		} else {
+			err = CtlErrorf(ErrNotFound, "LUN %s is not managed by the %s backend", lun, backend)
+		}
+	} else if have := DeviceBackend(device); backend != "" && have != backend {
+		err = CtlErrorf(ErrInvalid, "LUN %s is not managed by the %s backend, it is a %s LUN", lun, backend, have)
+	}
+	return
+}
+
+// CreateLun creates a LUN like ctladm create: the device dev of the handler
+// serving backend and lunType, exported as LUN 0 of a target with
+// rel_tgt_id lun, or at the target and LUN number given by the ctld_name
+// option. Devices are backed by the file option, ramdisk ones have the size
+// option instead. Empty dev and lun pick the file name and the first free
+// LUN ID.
+func CreateLun(backend string, lunType int, options map[string]string, dev string, lun string) (res Lun, err error) {
+	var (
+		lunOptions = map[string]string{}
+		handler    string
+		lunIds     map[string]string
+		params     map[string]string
+		scstParams map[string]string
+		scstAttrs  map[string]string
+	)
+	if handler, err = BackendHandler(backend, lunType); err != nil {
+		return
+	}
+	for name, val := range options {
+		lunOptions[name] = val
+	}
+	wwn := ""
+	lunNum := 0
+	if ctldName, ok := lunOptions["ctld_name"]; ok {
+		ctldParts := strings.Split(ctldName, ",")
+		wwn = ctldParts[0]
+		if len(ctldParts) == 3 && ctldParts[1] == "lun" {
+			if lunNum, err = strconv.Atoi(ctldParts[2]); err != nil {
+				return res, CtlErrorf(ErrInvalid, "invalid ctld_name %s", ctldName)
+			}
+		}
+		delete(lunOptions, "ctld_name")
+	}
+	if size, ok := lunOptions["size"]; !ok && handler == scst.SCST_HANDLER_NULLIO {
+		return res, CtlErrorf(ErrInvalid, "size of the %s LUN not specified", backend)
+	} else if ok {
+		if handler != scst.SCST_HANDLER_NULLIO {
+			return res, CtlErrorf(ErrInvalid, "size is only taken by the ramdisk backend, backend %s uses the size of the file", backend)
+		}
+		bytes, err := ParseSize(size)
+		if err != nil {
+			return res, &CtlError{Kind: ErrInvalid, Err: err}
+		}
+		lunOptions["size"] = strconv.FormatUint(bytes, 10)
+	}
+	fileName, ok := lunOptions["file"]
+	switch {
+	case !HandlerNeedsFile(handler) && ok:
+		return res, CtlErrorf(ErrInvalid, "backend %s takes no file", backend)
+	case !HandlerNeedsFile(handler) && dev == "":
+		return res, CtlErrorf(ErrInvalid, "backend %s needs a device ID", backend)
+	case HandlerNeedsFile(handler) && !ok:
+		return res, CtlErrorf(ErrInvalid, "no file argument specified")
+	case dev == "":
+		dev = filepath.Base(fileName)
+	}
+	if lunIds, err = GetLunIds(); err != nil {
+		return res, fmt.Errorf("cannot get LUNs IDs: %w", err)
+	}
+	if lun == "" {
+		lun = FindFreeLunId(lunIds)
+	} else {
+		for _, relId := range lunIds {
+			if relId == lun {
+				return res, CtlErrorf(ErrBusy, "requested LUN ID %s is already in use", lun)
+			}
+		}
+	}
+	if scstParams, scstAttrs, err = HandlerOptionsToScst(handler, lunOptions); err != nil {
+		return
+	}
+	if wwn == "" {
+		wwn = NewTargetWwn(dev)
+	}
+	relTgtId := lun
+	if lunNum != 0 {
+		// The device is not LUN 0 of its target, so the target cannot give
+		// it its ID, store the ID in the device instead.
+		scstAttrs[CTL_LUN_ID_ATTR] = CTL_LUN_ID_PREFIX + lun
+		if relId, _ := scst.ScstGetIscsiTargetParam(wwn, "rel_tgt_id"); relId != "" {
+			relTgtId = ""
+		}
+	}
+	if err = scst.ScstCreateLun(handler, dev, wwn, relTgtId, lunNum, scstParams, scstAttrs); err != nil {
+		return
+	}
+	if params, err = scst.ScstGetDeviceParams(dev); err != nil {
+		return res, fmt.Errorf("cannot get device %s parameters: %w", dev, err)
+	}
+	if lunNum != 0 {
+		if err = PinLunIds(); err != nil {
+			return
+		}
+	}
+	log.Infof("LUN %s (%s) created via target %s", lun, dev, wwn)
+	res = LunFromParams(dev, lun, params)
+	return
+}
+
+// growFile grows the zvol or regular file backing a LUN to size bytes.
+func growFile(fileName string, size uint64) (err error) {
+	var (
+		info os.FileInfo
+	)
+	if dataset, ok := ZvolDataset(fileName); ok {
+		return ZvolSetSize(dataset, size)
+	}
+	if info, err = os.Stat(fileName); err != nil {
+		return fmt.Errorf("cannot resize %s: %w", fileName, err)
+	} else if !info.Mode().IsRegular() {
+		return CtlErrorf(ErrInvalid, "cannot resize %s, it is neither a zvol nor a regular file", fileName)
+	}
+	if err = os.Truncate(fileName, int64(size)); err != nil {
+		err = fmt.Errorf("cannot resize %s: %w", fileName, err)
+	} else {
+		log.Infof("File %s resized to %d bytes", fileName, size)
+	}
+	return
+}
+
+// ModifyLun changes the options of a LUN like ctladm modify. A size option
+// grows the backing zvol or file and the device. A file option loads a new
+// medium into a CD-ROM. Every option is checked before anything changes.
+func ModifyLun(backend string, lun string, options map[string]string) (before Lun, after Lun, err error) {
+	var (
+		device       string
+		handler      string
+		beforeParams map[string]string
+		afterParams  map[string]string
+		size         uint64
+		resize       bool
+		attrs        = map[string]string{}
+	)
+	if device, err = findManagedDevice(lun, backend); err != nil {
+		return
+	}
+	if beforeParams, err = scst.ScstGetDeviceParams(device); err != nil {
+		err = fmt.Errorf("cannot get device %s parameters: %w", device, err)
+		return
+	}
+	if handler, err = scst.ScstGetDeviceHandler(device); err != nil {
+		return
+	}
+	before = LunFromParams(device, lun, beforeParams)
+	curSize, _ := strconv.ParseUint(beforeParams["size"], 10, 64)
+	for _, name := range sortedKeys(options) {
+		val := options[name]
+		if name == "size" {
+			if size, err = ParseSize(val); err != nil {
+				return before, after, &CtlError{Kind: ErrInvalid, Err: err}
+			}
+			if size < curSize {
+				return before, after, CtlErrorf(ErrInvalid, "cannot shrink LUN %s from %d to %d bytes", lun, curSize, size)
+			}
+			if beforeParams["filename"] == "" {
+				return before, after, CtlErrorf(ErrInvalid, "LUN %s has no backing file to resize", lun)
+			}
+			resize = true
+			continue
+		}
+		attr := name
+		if option, ok := FindCtlOption(name); ok {
+			attr = option.Scst
+			if option.ToScst != nil {
+				if val, err = option.ToScst(val); err != nil {
+					return before, after, CtlErrorf(ErrInvalid, "option %s: %v", name, err)
+				}
+			}
+			// Only a CD-ROM can get a new medium.
+			if option.Create && !(attr == "filename" && handler == scst.SCST_HANDLER_CDROM) {
+				return before, after, CtlErrorf(ErrInvalid, "option %s can only be set when the LUN is created", name)
+			}
+		} else if _, ok := beforeParams[attr]; !ok {
+			return before, after, CtlErrorf(ErrInvalid, "option %s is not supported by %s", name, handler)
+		}
+		attrs[attr] = val
+	}
+	if resize {
+		if size > curSize {
+			if err = growFile(beforeParams["filename"], size); err != nil {
+				return
+			}
+		}
+		if err = scst.ScstResyncDeviceSize(device); err != nil {
+			return
+		}
+	}
+	for _, attr := range sortedKeys(attrs) {
+		if err = scst.ScstSetDeviceParam(device, attr, attrs[attr]); err != nil {
+			return
+		}
+	}
+	if afterParams, err = scst.ScstGetDeviceParams(device); err != nil {
+		err = fmt.Errorf("cannot get device %s parameters: %w", device, err)
+		return
+	}
+	after = LunFromParams(device, lun, afterParams)
+	log.Infof("LUN %s (%s) modified, size %s -> %s", lun, device, beforeParams["size"], afterParams["size"])
+	return
+}
+
+// DeactivateLun takes a LUN offline and keeps its device and mappings.
+func DeactivateLun(backend string, lun string) (device string, err error) {
+	if device, err = findManagedDevice(lun, backend); err == nil {
+		if err = scst.ScstDeactivateDevice(device); err == nil {
+			log.Infof("LUN %s (%s) deactivated", lun, device)
+		}
+	}
+	return
+}
+
+// PurgeLun deletes a LUN with its device and mappings. Sessions of targets
+// left without LUNs are closed, deleteTarget also deletes those targets.
+// zfsMode none, destroy or snapshot says what happens to a backing zvol.
+// Every completed step is passed to report.
+func PurgeLun(backend string, lun string, deleteTarget bool, zfsMode string, report func(string)) (err error) {
+	var (
+		device string
+		params map[string]string
+	)
+	reportStep := func(msgInfo string) {
+		log.Info(msgInfo)
+		if report != nil {
+			report(msgInfo)
+		}
+	}
+	if device, err = findManagedDevice(lun, backend); err != nil {
+		return
+	}
+	if params, err = scst.ScstGetDeviceParams(device); err != nil {
+		return
+	}
+	// Refuse to destroy a zvol that is not a clone before anything is
+	// torn down.
+	dataset, isZvol := ZvolDataset(params["filename"])
+	if isZvol && zfsMode == "destroy" {
+		if origin, err := ZvolOrigin(dataset); err != nil {
+			return err
+		} else if origin == "" {
+			return fmt.Errorf("%s is not a clone, refusing to destroy it", dataset)
+		}
+	}
+	exports := FindDeviceExports(device)
+	targets := []string{}
+	for _, export := range exports {
+		found := false
+		for _, target := range targets {
+			found = found || target == export.Target
+		}
+		if !found {
+			targets = append(targets, export.Target)
+		}
+	}
+	emptyTargets := map[string]bool{}
+	for _, target := range targets {
+		emptyTargets[target] = true
+		if luns, err := scst.ScstGetLuns(target); err == nil {
+			for _, l := range luns {
+				if l.Device.Name != device {
+					emptyTargets[target] = false
+				}
+			}
+		}
+		if !emptyTargets[target] {
+			continue
+		}
+		sessions, _ := scst.ScstGetIscsiSessions(target)
+		for _, session := range sessions {
+			if err = scst.ScstCloseIscsiSession(target, session.Name, 10*time.Second); err != nil {
+				return
+			}
+			reportStep(fmt.Sprintf("Session %s (%s) on %s closed", session.Sid, session.InitiatorName, target))
+		}
+	}
+	if err = scst.ScstDeactivateDevice(device); err != nil {
+		return
+	}
+	reportStep(fmt.Sprintf("Device %s deactivated", device))
+	for _, export := range exports {
+		lunNum, _ := strconv.Atoi(export.Lun)
+		if err = scst.ScstUnmapLun(export.Target, export.Group, lunNum); err != nil {
+			return
+		}
+		reportStep(fmt.Sprintf("LUN %s of target %s unmapped", export.Lun, export.Target))
+	}
+	if err = scst.ScstDeleteDevice(device); err != nil {
+		return
+	}
+	reportStep(fmt.Sprintf("Device %s deleted", device))
+	if deleteTarget {
+		for _, target := range targets {
+			if !emptyTargets[target] {
+				continue
+			}
+			if err = scst.ScstDisableIscsiTarget(target); err != nil {
+				return
+			}
+			if err = scst.ScstDeleteIscsiTarget(target); err != nil {
+				return
+			}
+			reportStep(fmt.Sprintf("Target %s deleted", target))
+		}
+	}
+	if isZvol && zfsMode != "none" {
+		switch zfsMode {
+		case "destroy":
+			if err = ZvolDestroy(dataset); err != nil {
+				return
+			}
+			reportStep(fmt.Sprintf("Zvol %s destroyed", dataset))
+		case "snapshot":
+			if snapshot, err := ZvolSnapshot(dataset, "ctladm-remove-"+time.Now().Format("20060102150405")); err != nil {
+				return err
+			} else {
+				reportStep(fmt.Sprintf("Snapshot %s created", snapshot))
+			}
+		}
+	}
+	return
+}
+
+// MapLun maps LUN lun as LUN number portLun of port in the initiator group,
+// or of the target itself when group is empty.
+func MapLun(port string, portLun int, lun string, group string) (device string, err error) {
+	var (
+		target string
+	)
+	if target, err = FindLunTarget(port); err != nil {
+		return
+	}
+	if device, err = findManagedDevice(lun, ""); err != nil {
+		return
+	}
+	if err = scst.ScstMapLun(target, group, device, portLun); err == nil {
+		log.Infof("LUN %d of port %s mapped to LUN %s (%s)", portLun, port, lun, device)
+		err = PinLunIds()
+	}
+	return
+}
+
+func UnmapLun(port string, portLun int, group string) (err error) {
+	var (
+		target string
+	)
+	if target, err = FindLunTarget(port); err != nil {
+		return
+	}
+	if err = scst.ScstUnmapLun(target, group, portLun); err == nil {
+		log.Infof("LUN %d of port %s unmapped", portLun, port)
+	}
+	return
+}
@@ -0,0 +1,108 @@
+package pk_ctlcompat
+
+import (
+	"os"
+	"path"
+	"strconv"
+	"testing"
+
+	scst "github.com/Tualua/pk_ctladm/pk_scst"
+	scstsim "github.com/Tualua/pk_ctladm/pk_scstsim"
+)
+
+// setupScst points pk_scst at an empty simulated SCST until the test ends.
+func setupScst(t *testing.T) {
+	t.Helper()
+	sim, err := scstsim.NewTemp()
+	if err != nil {
+		t.Fatalf("cannot start SCST simulator: %v", err)
+	}
+	prevFS := scst.ScstGetFS()
+	scst.ScstSetFS(sim)
+	t.Cleanup(func() {
+		scst.ScstSetFS(prevFS)
+		sim.Close()
+	})
+}
+
+// lunFiles creates a 10M backing file for every name and returns their
+// directory.
+func lunFiles(t *testing.T, names ...string) (dir string) {
+	t.Helper()
+	dir = t.TempDir()
+	for _, name := range names {
+		if f, err := os.Create(path.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		} else if err = f.Truncate(10 << 20); err != nil {
+			t.Fatal(err)
+		} else {
+			f.Close()
+		}
+	}
+	return
+}
+
+// lunIdOf returns the ID devlist shows for device.
+func lunIdOf(t *testing.T, device string) string {
+	t.Helper()
+	luns, err := GetLuns()
+	if err != nil {
+		t.Fatalf("GetLuns: %v", err)
+	}
+	for _, lun := range luns {
+		if lun.Device == device {
+			return strconv.Itoa(lun.Id)
+		}
+	}
+	return ""
+}
+
+func TestCreateLunIdMatchesDevlist(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		ctldName string
+		lun      string
+		want     string
+	}{
+		{name: "LUN 0 of a new target", lun: "5", want: "5"},
+		{name: "LUN 1 of a new target", ctldName: CTLD_IQN_PREFIX + ":new,lun,1", lun: "5", want: "5"},
+		{name: "LUN 1 of a new target, free ID", ctldName: CTLD_IQN_PREFIX + ":new,lun,1", want: "2"},
+		{name: "LUN 1 of an existing target", ctldName: CTLD_IQN_PREFIX + ":base,lun,1", want: "2"},
+		{name: "LUN 1 of an existing target with an ID", ctldName: CTLD_IQN_PREFIX + ":base,lun,1", lun: "6", want: "6"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			setupScst(t)
+			dir := lunFiles(t, "base", "dev", "later")
+			if _, err := CreateLun("block", CTL_LUN_TYPE_DISK, map[string]string{"file": path.Join(dir, "base")}, "", ""); err != nil {
+				t.Fatalf("CreateLun base: %v", err)
+			}
+			options := map[string]string{"file": path.Join(dir, "dev")}
+			if c.ctldName != "" {
+				options["ctld_name"] = c.ctldName
+			}
+			lun, err := CreateLun("block", CTL_LUN_TYPE_DISK, options, "", c.lun)
+			if err != nil {
+				t.Fatalf("CreateLun: %v", err)
+			}
+			if id := strconv.Itoa(lun.Id); id != c.want {
+				t.Errorf("CreateLun reported ID %s, want %s", id, c.want)
+			}
+			if id := lunIdOf(t, "dev"); id != c.want {
+				t.Errorf("devlist shows ID %s, want %s", id, c.want)
+			}
+			if before, _, err := ModifyLun("block", c.want, map[string]string{"num_threads": "2"}); err != nil {
+				t.Errorf("ModifyLun %s: %v", c.want, err)
+			} else if before.Device != "dev" {
+				t.Errorf("ModifyLun %s changed device %s", c.want, before.Device)
+			}
+
+			// Another target must not move the ID.
+			if _, err = CreateLun("block", CTL_LUN_TYPE_DISK, map[string]string{"file": path.Join(dir, "later")}, "", "9"); err != nil {
+				t.Fatalf("CreateLun later: %v", err)
+			}
+			if id := lunIdOf(t, "dev"); id != c.want {
+				t.Errorf("devlist shows ID %s after adding a target, want %s", id, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,265 @@
+package pk_ctlcompat
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	scst "github.com/Tualua/pk_ctladm/pk_scst"
+)
+
+type Lun struct {
+	Id           int               `json:"id"`
+	BackendType  string            `json:"backend_type"`
+	LunType      int               `json:"lun_type"`
+	Size         uint64            `json:"size"`
+	Blocksize    int               `json:"blocksize"`
+	SerialNumber string            `json:"serial_number"`
+	DeviceId     string            `json:"device_id"`
+	NumThreads   int               `json:"num_threads"`
+	File         string            `json:"file"`
+	CtldName     string            `json:"ctld_name"`
+	Options      map[string]string `json:"options,omitempty"`
+	// Device is the SCST device behind the LUN, empty for LUNs read from
+	// FreeBSD output.
+	Device string `json:"-"`
+}
+
+// Export splits the ctld name into the target and the LUN number on it.
+func (lun Lun) Export() (target string, lunNum string) {
+	target, lunNum, _ = strings.Cut(lun.CtldName, ",lun,")
+	return
+}
+
+type PortLun struct {
+	Lun int `json:"lun"`
+	Id  int `json:"id"`
+}
+
+func (lun PortLun) String() string {
+	return fmt.Sprintf("%d:%d", lun.Lun, lun.Id)
+}
+
+type PortInitiator struct {
+	Id   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+func (initiator PortInitiator) String() string {
+	return initiator.Name
+}
+
+type Port struct {
+	Id                    int               `json:"id"`
+	FrontendType          string            `json:"frontend_type"`
+	PortType              int               `json:"port_type"`
+	Online                bool              `json:"online"`
+	PortName              string            `json:"port_name"`
+	PhysicalPort          int               `json:"physical_port"`
+	VirtualPort           int               `json:"virtual_port"`
+	Target                string            `json:"target"`
+	Port                  string            `json:"port"`
+	CfiscsiState          int               `json:"cfiscsi_state"`
+	CfiscsiTarget         string            `json:"cfiscsi_target"`
+	CtldPortalGroupName   string            `json:"ctld_portal_group_name"`
+	CfiscsiPortalGroupTag int               `json:"cfiscsi_portal_group_tag"`
+	LunMap                bool              `json:"lun_map"`
+	Luns                  []PortLun         `json:"luns"`
+	Initiators            []PortInitiator   `json:"initiators"`
+	Options               map[string]string `json:"options,omitempty"`
+}
+
+type Session struct {
+	Id                       string `json:"id"`
+	Initiator                string `json:"initiator"`
+	InitiatorAddr            string `json:"initiator_addr"`
+	InitiatorAlias           string `json:"initiator_alias"`
+	Target                   string `json:"target"`
+	TargetAlias              string `json:"target_alias"`
+	TargetPortalGroupTag     int    `json:"target_portal_group_tag"`
+	HeaderDigest             string `json:"header_digest"`
+	DataDigest               string `json:"data_digest"`
+	MaxRecvDataSegmentLength int    `json:"max_recv_data_segment_length"`
+	MaxSendDataSegmentLength int    `json:"max_send_data_segment_length"`
+	MaxBurstLength           int    `json:"max_burst_length"`
+	FirstBurstLength         int    `json:"first_burst_length"`
+	ImmediateData            bool   `json:"immediate_data"`
+	Iser                     bool   `json:"iser"`
+	Offload                  string `json:"offload"`
+	Connections              int    `json:"connections"`
+}
+
+func DeviceBlocks(params map[string]string) uint64 {
+	size, _ := strconv.ParseUint(params["size"], 10, 64)
+	blocksize, err := strconv.ParseUint(params["blocksize"], 10, 64)
+	if err != nil || blocksize == 0 {
+		blocksize = 512
+	}
+	return size / blocksize
+}
+
+func DeviceLunType(params map[string]string) (res int) {
+	res, _ = strconv.Atoi(strings.TrimSpace(strings.SplitN(params["type"], "-", 2)[0]))
+	return
+}
+
+// LunFromParams describes SCST device with LUN ID id from its attributes.
+func LunFromParams(device string, id string, params map[string]string) (lun Lun) {
+	wwn, lunNum := FindDeviceExport(device)
+	lun.Id, _ = strconv.Atoi(id)
+	lun.BackendType = DeviceBackend(device)
+	lun.LunType = DeviceLunType(params)
+	lun.Size = DeviceBlocks(params)
+	lun.Blocksize, _ = strconv.Atoi(params["blocksize"])
+	lun.SerialNumber = params["usn"]
+	if lun.DeviceId = params["t10_dev_id"]; lun.DeviceId == "" && params["filename"] != "" {
+		lun.DeviceId = filepath.Base(params["filename"])
+	} else if lun.DeviceId == "" {
+		lun.DeviceId = device
+	}
+	lun.NumThreads, _ = strconv.Atoi(params["threads_num"])
+	lun.File = params["filename"]
+	lun.CtldName = strings.Join([]string{wwn, "lun", lunNum}, ",")
+	lun.Options = map[string]string{}
+	for _, option := range DeviceOptions(params) {
+		lun.Options[option[0]] = option[1]
+	}
+	lun.Device = device
+	return
+}
+
+// GetLuns lists the SCST devices exported through iSCSI targets as CTL LUNs.
+func GetLuns() (res []Lun, err error) {
+	var (
+		lunIds  map[string]string
+		devices []string
+	)
+	if lunIds, err = GetLunIds(); err != nil {
+		return nil, fmt.Errorf("cannot get LUNs IDs: %w", err)
+	}
+	if devices, err = scst.ScstGetDevices(); err != nil {
+		return nil, fmt.Errorf("cannot get devices: %w", err)
+	}
+	for _, dev := range devices {
+		if strings.Contains(dev, ":") {
+			continue
+		}
+		if params, err := scst.ScstGetDeviceParams(dev); err != nil {
+			log.Errorf("GetLuns: cannot get device %s parameters: %v", dev, err)
+		} else if relId, ok := lunIds[dev]; ok {
+			res = append(res, LunFromParams(dev, relId, params))
+		}
+	}
+	return
+}
+
+// GetLun returns the LUN with ID id.
+func GetLun(id string) (lun Lun, err error) {
+	var (
+		device string
+		params map[string]string
+	)
+	if device, err = FindLunDevice(id); err == nil {
+		if params, err = scst.ScstGetDeviceParams(device); err == nil {
+			lun = LunFromParams(device, id, params)
+		}
+	}
+	return
+}
+
+// GetPorts lists the iSCSI targets with LUNs as CTL ports.
+func GetPorts() (res []Port, err error) {
+	var (
+		lunIds   map[string]string
+		mappings []LunMapping
+		targets  []string
+	)
+	if lunIds, err = GetLunIds(); err != nil {
+		return nil, fmt.Errorf("cannot get LUNs IDs: %w", err)
+	}
+	if mappings, err = GetLunMappings(); err != nil {
+		return nil, fmt.Errorf("cannot get LUN mappings: %w", err)
+	}
+	targetRelIds := map[string]string{}
+	targetLuns := map[string][]PortLun{}
+	for _, m := range mappings {
+		if _, ok := targetLuns[m.Target]; !ok {
+			targets = append(targets, m.Target)
+			targetRelIds[m.Target] = m.RelId
+		}
+		id, _ := strconv.Atoi(lunIds[m.Device.Name])
+		targetLuns[m.Target] = append(targetLuns[m.Target], PortLun{
+			Lun: m.Lun,
+			Id:  id,
+		})
+	}
+	for _, wwn := range targets {
+		tpgt, _ := strconv.Atoi(FindTargetTpgt(wwn))
+		port := Port{
+			FrontendType:          "iscsi",
+			PortType:              CTL_PORT_ISCSI,
+			Online:                scst.ScstIscsiTargetEnabled(wwn),
+			PortName:              TargetPortName(wwn),
+			PhysicalPort:          tpgt,
+			Target:                wwn,
+			Port:                  TargetPortName(wwn),
+			CfiscsiState:          1,
+			CfiscsiTarget:         wwn,
+			CtldPortalGroupName:   CTLD_DEFAULT_PORTAL_GROUP,
+			CfiscsiPortalGroupTag: tpgt,
+			LunMap:                true,
+			Luns:                  targetLuns[wwn],
+			Initiators:            []PortInitiator{},
+			Options:               map[string]string{},
+		}
+		port.Id, _ = strconv.Atoi(targetRelIds[wwn])
+		for i, initiator := range GetTargetInitiators(wwn) {
+			port.Initiators = append(port.Initiators, PortInitiator{Id: i, Name: initiator})
+		}
+		if params, err := scst.ScstGetIscsiTargetAttrs(wwn); err != nil {
+			log.Errorf("GetPorts: %v", err)
+		} else {
+			port.VirtualPort, _ = strconv.Atoi(params["tid"])
+			for name, val := range params {
+				port.Options[name] = strings.Split(val, "\n")[0]
+			}
+		}
+		res = append(res, port)
+	}
+	return
+}
+
+func SessionFromScst(session scst.ScstIscsiSession) (res Session) {
+	res.Id = session.Sid
+	res.Initiator = session.InitiatorName
+	if len(session.Connections) > 0 {
+		res.InitiatorAddr = session.Connections[0].Ip
+	}
+	res.Target = session.Target
+	res.TargetPortalGroupTag, _ = strconv.Atoi(FindTargetTpgt(session.Target))
+	res.HeaderDigest = session.Params["HeaderDigest"]
+	res.DataDigest = session.Params["DataDigest"]
+	res.MaxRecvDataSegmentLength, _ = strconv.Atoi(session.Params["MaxRecvDataSegmentLength"])
+	res.MaxSendDataSegmentLength, _ = strconv.Atoi(session.Params["MaxXmitDataSegmentLength"])
+	res.MaxBurstLength, _ = strconv.Atoi(session.Params["MaxBurstLength"])
+	res.FirstBurstLength, _ = strconv.Atoi(session.Params["FirstBurstLength"])
+	res.ImmediateData = session.Params["ImmediateData"] == "Yes"
+	res.Offload = "None"
+	res.Connections = len(session.Connections)
+	return
+}
+
+// GetSessions lists the iSCSI sessions of port lun, or of every port when
+// lun is empty.
+func GetSessions(lun string) (res []Session, err error) {
+	var (
+		sessions []scst.ScstIscsiSession
+	)
+	if sessions, err = GetIscsiSessions(lun); err == nil {
+		for _, session := range sessions {
+			res = append(res, SessionFromScst(session))
+		}
+	}
+	return
+}
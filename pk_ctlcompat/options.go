@@ -0,0 +1,231 @@
+package pk_ctlcompat
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type CtlOption struct {
+	Ctl      string
+	Scst     string
+	Create   bool
+	Default  string
+	ToScst   func(string) (string, error)
+	FromScst func(string) string
+}
+
+var CtlOptions = []CtlOption{
+	{Ctl: "file", Scst: "filename", Create: true},
+	{Ctl: "blocksize", Scst: "blocksize", Create: true},
+	{Ctl: "readonly", Scst: "read_only", Create: true, ToScst: ctlOnOffToScst, FromScst: scstToCtlOnOff},
+	{Ctl: "unmap", Scst: "thin_provisioned", Create: true, ToScst: ctlOnOffToScst, FromScst: scstToCtlOnOff},
+	{Ctl: "rpm", Scst: "rotational", Create: true, Default: "0", ToScst: ctlRpmToScst, FromScst: scstToCtlRpm},
+	{Scst: "nv_cache", Create: true, Default: "1"},
+	{Ctl: "serial_number", Scst: "usn"},
+	{Ctl: "device_id", Scst: "t10_dev_id"},
+	{Ctl: "vendor", Scst: "t10_vend_id", Default: "FREE_TT"},
+	{Ctl: "product", Scst: "prod_id"},
+	{Ctl: "revision", Scst: "prod_rev_lvl"},
+	{Ctl: "num_threads", Scst: "threads_num"},
+}
+
+func ctlOnOffToScst(val string) (res string, err error) {
+	switch strings.ToLower(val) {
+	case "on", "yes", "true", "1":
+		res = "1"
+	case "off", "no", "false", "0":
+		res = "0"
+	default:
+		err = fmt.Errorf("invalid value %s, expected on or off", val)
+	}
+	return
+}
+
+func scstToCtlOnOff(val string) (res string) {
+	res = "off"
+	if val == "1" {
+		res = "on"
+	}
+	return
+}
+
+func ctlRpmToScst(val string) (res string, err error) {
+	res = "1"
+	if val == "1" {
+		res = "0"
+	}
+	return
+}
+
+func scstToCtlRpm(val string) (res string) {
+	res = "1"
+	if val == "1" {
+		res = "7200"
+	}
+	return
+}
+
+func FindCtlOption(name string) (option CtlOption, ok bool) {
+	for _, option = range CtlOptions {
+		if option.Ctl == name || (option.Ctl == "" && option.Scst == name) {
+			ok = true
+			return
+		}
+	}
+	return
+}
+
+// CtlOptionsToScst splits CTL LUN options into add_device parameters and
+// device attributes. Options missing from the table are passed through to
+// add_device unchanged.
+func CtlOptionsToScst(options map[string]string) (params map[string]string, attrs map[string]string, err error) {
+	params = map[string]string{}
+	attrs = map[string]string{}
+	for _, option := range CtlOptions {
+		if option.Default == "" {
+			continue
+		}
+		if option.Create {
+			params[option.Scst] = option.Default
+		} else {
+			attrs[option.Scst] = option.Default
+		}
+	}
+	for name, val := range options {
+		if option, ok := FindCtlOption(name); !ok {
+			params[name] = val
+		} else {
+			if option.ToScst != nil {
+				if val, err = option.ToScst(val); err != nil {
+					err = fmt.Errorf("option %s: %w", name, err)
+					return
+				}
+			}
+			if option.Create {
+				params[option.Scst] = val
+			} else {
+				attrs[option.Scst] = val
+			}
+		}
+	}
+	return
+}
+
+func CtlOptionsFromScst(params map[string]string) (res [][]string) {
+	for _, option := range CtlOptions {
+		if option.Ctl == "" {
+			continue
+		}
+		if val, ok := params[option.Scst]; ok {
+			if option.FromScst != nil {
+				val = option.FromScst(val)
+			}
+			res = append(res, []string{option.Ctl, val})
+		}
+	}
+	return
+}
+
+// DeviceOptions lists the attributes of a device as CTL options. The size
+// attributes are left out, the LUN reports its size in blocks.
+func DeviceOptions(params map[string]string) (res [][]string) {
+	var (
+		names []string
+	)
+	mapped := map[string]bool{"size": true, "size_mb": true}
+	for _, option := range CtlOptionsFromScst(params) {
+		res = append(res, option)
+	}
+	for _, option := range CtlOptions {
+		if option.Ctl != "" {
+			mapped[option.Scst] = true
+		}
+	}
+	for name := range params {
+		if !mapped[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		res = append(res, []string{name, strings.Split(params[name], "\n")[0]})
+	}
+	return
+}
+
+func ParseSize(val string) (res uint64, err error) {
+	var (
+		shift uint
+	)
+	num := strings.TrimSpace(val)
+	if len(num) > 0 {
+		switch strings.ToUpper(num[len(num)-1:]) {
+		case "K":
+			shift = 10
+		case "M":
+			shift = 20
+		case "G":
+			shift = 30
+		case "T":
+			shift = 40
+		case "P":
+			shift = 50
+		case "E":
+			shift = 60
+		}
+		if shift > 0 {
+			num = num[:len(num)-1]
+		}
+	}
+	if res, err = strconv.ParseUint(num, 10, 64); err != nil {
+		err = fmt.Errorf("invalid size %s", val)
+	} else if shift > 0 {
+		if res > (^uint64(0))>>shift {
+			err = fmt.Errorf("size %s is too large", val)
+		} else {
+			res <<= shift
+		}
+	}
+	return
+}
+
+// OptionNames orders option names the way DeviceOptions does, options of the
+// CtlOptions table first and the rest by name.
+func OptionNames(options map[string]string) (res []string) {
+	var (
+		names []string
+	)
+	mapped := map[string]bool{}
+	for _, option := range CtlOptions {
+		if option.Ctl == "" {
+			continue
+		}
+		mapped[option.Ctl] = true
+		if _, ok := options[option.Ctl]; ok {
+			res = append(res, option.Ctl)
+		}
+	}
+	for name := range options {
+		if !mapped[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	res = append(res, names...)
+	return
+}
+
+func ParseCtlOptions(options []string) (res map[string]string, err error) {
+	res = map[string]string{}
+	for _, option := range options {
+		if name, value, found := strings.Cut(option, "="); !found || name == "" {
+			err = CtlErrorf(ErrInvalid, "option %s not in name=value format", option)
+			return
+		} else {
+			res[name] = value
+		}
+	}
+	return
+}
@@ -0,0 +1,342 @@
+// Package pk_ctlcompat presents SCST as FreeBSD CTL: LUN and port IDs,
+// ctld names, the CTL LUN options and the ctladm XML and JSON models.
+package pk_ctlcompat
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	scst "github.com/Tualua/pk_ctladm/pk_scst"
+	"github.com/sirupsen/logrus"
+)
+
+const CTLD_IQN_PREFIX string = "iqn.2022-10.net.playkey.sds"
+const CTLD_DEFAULT_TPGT string = "257"
+const CTLD_DEFAULT_PORTAL_GROUP string = "default"
+const CTL_PORT_ISCSI int = 0x10
+
+// The LUN ID of a device without a LUN 0 export is kept in the device,
+// SCST has no attribute of its own for it.
+const CTL_LUN_ID_ATTR string = "vend_specific_id"
+const CTL_LUN_ID_PREFIX string = "ctl-lun-"
+
+var log = logrus.StandardLogger()
+
+// SetLogger makes the package log through l instead of the standard logrus
+// logger.
+func SetLogger(l *logrus.Logger) {
+	log = l
+}
+
+type LunMapping struct {
+	Target string
+	RelId  string
+	Lun    int
+	Device scst.ScstBlockDevice
+}
+
+func GetLunMappings() (res []LunMapping, err error) {
+	var (
+		targets []string
+	)
+	if targets, err = scst.ScstGetIscsiTargets(); err != nil {
+		log.Errorf("GetLunMappings: cannot get iscsi targets: %v", err)
+	} else {
+		for _, target := range targets {
+			relId, _ := scst.ScstGetIscsiTargetParam(target, "rel_tgt_id")
+			if luns, err := scst.ScstGetLuns(target); err != nil {
+				log.Errorf("GetLunMappings: %v", err)
+			} else {
+				for _, lun := range luns {
+					res = append(res, LunMapping{
+						Target: target,
+						RelId:  relId,
+						Lun:    lun.Lun,
+						Device: lun.Device,
+					})
+				}
+			}
+		}
+	}
+	return
+}
+
+// lunIdLabel reads the LUN ID PinLunIds stored in a device.
+func lunIdLabel(device string) (id int, ok bool) {
+	val := scst.ScstGetDeviceParam(device, CTL_LUN_ID_ATTR)
+	if num, found := strings.CutPrefix(val, CTL_LUN_ID_PREFIX); found {
+		if id, err := strconv.Atoi(num); err == nil && id > 0 {
+			return id, true
+		}
+	}
+	return
+}
+
+// GetLunIds returns CTL LUN IDs keyed by SCST device name. A device keeps
+// the ID PinLunIds stored in it, otherwise a device exported as LUN 0 takes
+// the lowest rel_tgt_id of its targets. Devices exported only at higher LUN
+// numbers are numbered after the highest ID in use until they are pinned.
+func GetLunIds() (res map[string]string, err error) {
+	var (
+		mappings []LunMapping
+		maxId    int
+		others   []string
+	)
+	res = map[string]string{}
+	if mappings, err = GetLunMappings(); err != nil {
+		return
+	}
+	labelled := map[string]bool{}
+	usedIds := map[string]bool{}
+	for _, m := range mappings {
+		if _, ok := res[m.Device.Name]; ok || labelled[m.Device.Name] {
+			continue
+		}
+		if id, ok := lunIdLabel(m.Device.Name); ok {
+			res[m.Device.Name] = strconv.Itoa(id)
+			labelled[m.Device.Name] = true
+			usedIds[res[m.Device.Name]] = true
+			if id > maxId {
+				maxId = id
+			}
+		}
+	}
+	for _, m := range mappings {
+		relId, convErr := strconv.Atoi(m.RelId)
+		if convErr != nil {
+			continue
+		}
+		if relId > maxId {
+			maxId = relId
+		}
+		if m.Lun != 0 || labelled[m.Device.Name] || usedIds[m.RelId] {
+			continue
+		}
+		if cur, ok := res[m.Device.Name]; ok {
+			if curId, _ := strconv.Atoi(cur); curId <= relId {
+				continue
+			}
+		}
+		res[m.Device.Name] = m.RelId
+	}
+	for _, m := range mappings {
+		if _, ok := res[m.Device.Name]; !ok {
+			res[m.Device.Name] = ""
+			others = append(others, m.Device.Name)
+		}
+	}
+	sort.Strings(others)
+	for i, device := range others {
+		res[device] = strconv.Itoa(maxId + i + 1)
+	}
+	return
+}
+
+// PinLunIds stores the LUN ID of every device that is not exported as
+// LUN 0 in the device, so the ID does not move when targets come and go.
+func PinLunIds() (err error) {
+	var (
+		lunIds   map[string]string
+		mappings []LunMapping
+	)
+	if lunIds, err = GetLunIds(); err != nil {
+		return
+	}
+	if mappings, err = GetLunMappings(); err != nil {
+		return
+	}
+	lun0 := map[string]bool{}
+	for _, m := range mappings {
+		lun0[m.Device.Name] = lun0[m.Device.Name] || m.Lun == 0
+	}
+	for _, device := range sortedKeys(lunIds) {
+		if _, ok := lunIdLabel(device); ok || lun0[device] {
+			continue
+		}
+		if err = scst.ScstSetDeviceParam(device, CTL_LUN_ID_ATTR, CTL_LUN_ID_PREFIX+lunIds[device]); err != nil {
+			return
+		}
+		log.Infof("LUN ID %s pinned to device %s", lunIds[device], device)
+	}
+	return
+}
+
+func FindLunTarget(lun string) (target string, err error) {
+	wwns := make(map[string]string)
+	if targets, err := scst.ScstGetIscsiTargets(); err != nil {
+		log.Errorf("FindLunTarget: cannot get iscsi targets. %v", err)
+	} else {
+		for _, target := range targets {
+			if relId, err := scst.ScstGetIscsiTargetParam(target, "rel_tgt_id"); err != nil {
+				log.Errorf("FindLunTarget: cannot get relative id for target %s: %v", target, err)
+			} else {
+				wwns[relId] = target
+			}
+		}
+	}
+	if wwn, ok := wwns[lun]; ok {
+		target = wwn
+	} else {
+		err = CtlErrorf(ErrNotFound, "port %s not found", lun)
+	}
+	return
+}
+
+// findLun0Device finds the device exported as LUN 0 of the target with
+// rel_tgt_id lun, a device on several targets answers to all of them.
+func findLun0Device(lun string) (device string) {
+	if mappings, err := GetLunMappings(); err == nil {
+		for _, m := range mappings {
+			if m.RelId == lun && m.Lun == 0 {
+				device = m.Device.Name
+				break
+			}
+		}
+	}
+	return
+}
+
+func FindLunDevice(lun string) (device string, err error) {
+	var (
+		lunIds map[string]string
+	)
+	if lunIds, err = GetLunIds(); err != nil {
+		log.Errorf("FindLunDevice: cannot get LUNs IDs: %v", err)
+	} else {
+		for dev, id := range lunIds {
+			if id == lun {
+				device = dev
+				break
+			}
+		}
+		if device == "" {
+			device = findLun0Device(lun)
+		}
+		if device == "" {
+			err = CtlErrorf(ErrNotFound, "LUN %s not found", lun)
+			log.Errorf("FindLunDevice: %v", err)
+		}
+	}
+	return
+}
+
+type DeviceExport struct {
+	Target string
+	Group  string
+	Lun    string
+}
+
+func FindDeviceExports(device string) (res []DeviceExport) {
+	if exports, err := scst.ScstGetDeviceExports(device); err != nil {
+		log.Errorf("FindDeviceExports: error getting exports for device %s: %v", device, err)
+	} else {
+		for _, export := range exports {
+			res = append(res, DeviceExport{
+				Target: export.Target,
+				Group:  export.Group,
+				Lun:    strconv.Itoa(export.Lun),
+			})
+		}
+	}
+	return
+}
+
+func FindDeviceExport(device string) (wwn string, lun string) {
+	for _, export := range FindDeviceExports(device) {
+		if wwn == "" || (lun != "0" && export.Lun == "0") {
+			wwn = export.Target
+			lun = export.Lun
+		}
+	}
+	return
+}
+
+func FindDeviceWwn(device string) (wwn string) {
+	wwn, _ = FindDeviceExport(device)
+	return
+}
+
+func FindFreeLunId(lunIds map[string]string) (res string) {
+	used := map[string]bool{}
+	for _, relId := range lunIds {
+		used[relId] = true
+	}
+	for id := 1; ; id++ {
+		if !used[strconv.Itoa(id)] {
+			res = strconv.Itoa(id)
+			break
+		}
+	}
+	return
+}
+
+func NewTargetWwn(device string) (wwn string) {
+	var (
+		prefix string = CTLD_IQN_PREFIX
+	)
+	if wwn, err := scst.ScstFindWwn(device); err == nil {
+		return wwn
+	}
+	if targets, err := scst.ScstGetIscsiTargets(); err == nil && len(targets) > 0 {
+		if i := strings.LastIndex(targets[0], ":"); i > 0 {
+			prefix = targets[0][:i]
+		}
+	}
+	wwn = prefix + ":" + device
+	return
+}
+
+func FindTargetTpgt(wwn string) (tpgt string) {
+	if tpgt, _ = scst.ScstGetIscsiTargetParam(wwn, "tpgt"); tpgt == "" {
+		tpgt = CTLD_DEFAULT_TPGT
+	}
+	return
+}
+
+func TargetPortName(wwn string) string {
+	tpgt, err := strconv.Atoi(FindTargetTpgt(wwn))
+	if err != nil {
+		tpgt, _ = strconv.Atoi(CTLD_DEFAULT_TPGT)
+	}
+	return fmt.Sprintf("%s,t,0x%04x", wwn, tpgt)
+}
+
+// InitiatorPortName formats an initiator like CTL does, the name followed by
+// the ISID, which SCST keeps in the upper 48 bits of the session id.
+func InitiatorPortName(session scst.ScstIscsiSession) string {
+	sid, err := strconv.ParseUint(strings.TrimPrefix(session.Sid, "0x"), 16, 64)
+	if err != nil {
+		return session.InitiatorName
+	}
+	return fmt.Sprintf("%s,i,0x%012x", session.InitiatorName, sid>>16)
+}
+
+func GetTargetInitiators(wwn string) (res []string) {
+	sessions, _ := scst.ScstGetIscsiSessions(wwn)
+	for _, session := range sessions {
+		res = append(res, InitiatorPortName(session))
+	}
+	return
+}
+
+func GetIscsiSessions(lun string) (res []scst.ScstIscsiSession, err error) {
+	var (
+		targets []string
+	)
+	if targets, err = scst.ScstGetIscsiTargets(); err != nil {
+		log.Errorf("GetIscsiSessions: cannot get iscsi targets: %v", err)
+	} else {
+		for _, target := range targets {
+			if lun != "" {
+				if relId, _ := scst.ScstGetIscsiTargetParam(target, "rel_tgt_id"); relId != lun {
+					continue
+				}
+			}
+			sessions, _ := scst.ScstGetIscsiSessions(target)
+			res = append(res, sessions...)
+		}
+	}
+	return
+}
@@ -0,0 +1,59 @@
+package pk_ctlcompat
+
+import (
+	"fmt"
+	"sort"
+)
+
+type PlanAction struct {
+	Desc string
+	Do   func() error
+}
+
+// Plan is a list of SCST changes worked out before any of them is made.
+// Problems lists what cannot be done, Notes what is done differently from
+// the source configuration.
+type Plan struct {
+	Actions  []PlanAction
+	Problems []string
+	Notes    []string
+}
+
+func (p *Plan) problemf(format string, args ...interface{}) {
+	p.Problems = append(p.Problems, fmt.Sprintf(format, args...))
+}
+
+func (p *Plan) notef(format string, args ...interface{}) {
+	p.Notes = append(p.Notes, fmt.Sprintf(format, args...))
+}
+
+func (p *Plan) action(do func() error, format string, args ...interface{}) {
+	p.Actions = append(p.Actions, PlanAction{Desc: fmt.Sprintf(format, args...), Do: do})
+}
+
+// Apply runs the actions of the plan in order and stops at the first one
+// that fails. Every completed action is passed to report. The LUN IDs of
+// devices the plan left without a LUN 0 export are pinned at the end.
+func (p *Plan) Apply(report func(string)) (err error) {
+	for _, action := range p.Actions {
+		if err = action.Do(); err != nil {
+			return fmt.Errorf("%s: %w", action.Desc, err)
+		}
+		log.Infof("Plan: %s", action.Desc)
+		if report != nil {
+			report(action.Desc)
+		}
+	}
+	if len(p.Actions) > 0 {
+		err = PinLunIds()
+	}
+	return
+}
+
+func sortedKeys(m map[string]string) (res []string) {
+	for key := range m {
+		res = append(res, key)
+	}
+	sort.Strings(res)
+	return
+}
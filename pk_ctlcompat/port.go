@@ -0,0 +1,82 @@
+package pk_ctlcompat
+
+import (
+	"time"
+
+	scst "github.com/Tualua/pk_ctladm/pk_scst"
+)
+
+// SetPortEnabled switches the target of port on or off.
+func SetPortEnabled(port string, enabled bool) (target string, err error) {
+	if target, err = FindLunTarget(port); err != nil {
+		return
+	}
+	if enabled {
+		err = scst.ScstEnableIscsiTarget(target)
+	} else {
+		err = scst.ScstDisableIscsiTarget(target)
+	}
+	if err == nil {
+		log.Infof("Port %s (%s) enabled: %v", port, target, enabled)
+	}
+	return
+}
+
+// SetDriverEnabled switches the iSCSI driver, and with it every port, on or
+// off.
+func SetDriverEnabled(enabled bool) (err error) {
+	if err = scst.ScstSetIscsiDriverEnabled(enabled); err == nil {
+		log.Infof("iSCSI driver enabled: %v", enabled)
+	}
+	return
+}
+
+// SessionFilter selects iSCSI sessions, empty fields match every session.
+type SessionFilter struct {
+	Lun       string
+	Target    string
+	Initiator string
+	Portal    string
+}
+
+func (f SessionFilter) Match(session scst.ScstIscsiSession) bool {
+	if f.Target != "" && session.Target != f.Target {
+		return false
+	}
+	if f.Initiator != "" && session.InitiatorName != f.Initiator {
+		return false
+	}
+	if f.Portal != "" {
+		for _, conn := range session.Connections {
+			if conn.Ip == f.Portal {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func SelectSessions(filter SessionFilter) (res []scst.ScstIscsiSession, err error) {
+	var (
+		sessions []scst.ScstIscsiSession
+	)
+	if sessions, err = GetIscsiSessions(filter.Lun); err == nil {
+		for _, session := range sessions {
+			if filter.Match(session) {
+				res = append(res, session)
+			}
+		}
+	}
+	return
+}
+
+// LogoutSession closes session and waits up to timeout for it to go away.
+func LogoutSession(session scst.ScstIscsiSession, timeout time.Duration) (err error) {
+	if err = scst.ScstCloseIscsiSession(session.Target, session.Name, timeout); err != nil {
+		log.Errorf("LogoutSession: %v", err)
+	} else {
+		log.Infof("Session %s (%s) on %s closed", session.Sid, session.InitiatorName, session.Target)
+	}
+	return
+}
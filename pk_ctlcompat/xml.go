@@ -0,0 +1,349 @@
+package pk_ctlcompat
+
+import (
+	"encoding/xml"
+	"strconv"
+)
+
+type CtldLun struct {
+	XMLName      xml.Name        `xml:"lun"`
+	Id           string          `xml:"id,attr"`
+	BackendType  string          `xml:"backend_type"`
+	LunType      int             `xml:"lun_type"`
+	Size         string          `xml:"size"`
+	Blocksize    string          `xml:"blocksize"`
+	SerialNumber string          `xml:"serial_number"`
+	DeviceId     string          `xml:"device_id"`
+	NumThreads   string          `xml:"num_threads"`
+	File         string          `xml:"file"`
+	CtldName     string          `xml:"ctld_name"`
+	Options      []CtldLunOption `xml:",any"`
+}
+
+type CtldLunOption struct {
+	XMLName xml.Name
+	Value   string `xml:",chardata"`
+}
+
+type CtldLunList struct {
+	XMLName xml.Name  `xml:"ctllunlist"`
+	Luns    []CtldLun `xml:"lun"`
+}
+
+type CtldPort struct {
+	XMLName               xml.Name            `xml:"targ_port"`
+	Id                    string              `xml:"id,attr"`
+	FrontendType          string              `xml:"frontend_type"`
+	PortType              int                 `xml:"port_type"`
+	Online                string              `xml:"online"`
+	PortName              string              `xml:"port_name"`
+	PhysicalPort          int                 `xml:"physical_port"`
+	VirtualPort           int                 `xml:"virtual_port"`
+	Target                string              `xml:"target"`
+	Port                  string              `xml:"port"`
+	CfiscsiState          int                 `xml:"cfiscsi_state"`
+	CfiscsiTarget         string              `xml:"cfiscsi_target"`
+	CtldPortalGroupName   string              `xml:"ctld_portal_group_name"`
+	CfiscsiPortalGroupTag string              `xml:"cfiscsi_portal_group_tag"`
+	Options               []CtldLunOption     `xml:",any"`
+	LunMap                string              `xml:"lun_map"`
+	Luns                  []CtldPortLun       `xml:"lun"`
+	Initiators            []CtldPortInitiator `xml:"initiator"`
+}
+
+type CtldPortInitiator struct {
+	XMLName xml.Name `xml:"initiator"`
+	Id      int      `xml:"id,attr"`
+	Value   string   `xml:",chardata"`
+}
+
+type CtldPortLun struct {
+	XMLName xml.Name `xml:"lun"`
+	Id      int      `xml:"id,attr"`
+	Value   string   `xml:",chardata"`
+}
+
+type CtldPortList struct {
+	XMLName xml.Name   `xml:"ctlportlist"`
+	Ports   []CtldPort `xml:"targ_port"`
+}
+
+type CtlIsConnection struct {
+	XMLName                  xml.Name `xml:"connection"`
+	Id                       string   `xml:"id,attr"`
+	Initiator                string   `xml:"initiator"`
+	InitiatorAddr            string   `xml:"initiator_addr"`
+	InitiatorAlias           string   `xml:"initiator_alias"`
+	Target                   string   `xml:"target"`
+	TargetAlias              string   `xml:"target_alias"`
+	TargetPortalGroupTag     string   `xml:"target_portal_group_tag"`
+	HeaderDigest             string   `xml:"header_digest"`
+	DataDigest               string   `xml:"data_digest"`
+	MaxRecvDataSegmentLength string   `xml:"max_recv_data_segment_length"`
+	MaxSendDataSegmentLength string   `xml:"max_send_data_segment_length"`
+	MaxBurstLength           string   `xml:"max_burst_length"`
+	FirstBurstLength         string   `xml:"first_burst_length"`
+	ImmediateData            int      `xml:"immediate_data"`
+	Iser                     int      `xml:"iser"`
+	Offload                  string   `xml:"offload"`
+	Connections              int      `xml:"connections"`
+}
+
+type CtlIsList struct {
+	XMLName     xml.Name          `xml:"ctlislist"`
+	Connections []CtlIsConnection `xml:"connection"`
+}
+
+func xmlOptions(options map[string]string, skip ...string) (res []CtldLunOption) {
+	skipped := map[string]bool{}
+	for _, name := range skip {
+		skipped[name] = true
+	}
+	for _, name := range OptionNames(options) {
+		if !skipped[name] {
+			res = append(res, CtldLunOption{
+				XMLName: xml.Name{Local: name},
+				Value:   options[name],
+			})
+		}
+	}
+	return
+}
+
+func optionsFromXml(options []CtldLunOption) (res map[string]string) {
+	if len(options) > 0 {
+		res = map[string]string{}
+		for _, option := range options {
+			res[option.XMLName.Local] = option.Value
+		}
+	}
+	return
+}
+
+func boolToInt(val bool) (res int) {
+	if val {
+		res = 1
+	}
+	return
+}
+
+// lunXmlElements are the LUN fields devlist -x prints as elements of their
+// own, options by these names would repeat them.
+var lunXmlElements = []string{
+	"backend_type", "lun_type", "size", "blocksize", "serial_number",
+	"device_id", "num_threads", "file", "ctld_name",
+}
+
+// lunXmlInquiry are the options devlist -x prints for every LUN, with or
+// without -v, CTL always reports the INQUIRY identification of its LUNs.
+var lunXmlInquiry = []string{"vendor", "product", "revision"}
+
+// InquiryOptions returns the vendor, product and revision options of the LUN.
+func (lun Lun) InquiryOptions() (res map[string]string) {
+	res = map[string]string{}
+	for _, name := range lunXmlInquiry {
+		if val, ok := lun.Options[name]; ok {
+			res[name] = val
+		}
+	}
+	return
+}
+
+// Xml converts the LUN to the devlist -x element, options other than the
+// ones CTL reports as elements of their own are appended as is.
+func (lun Lun) Xml() (res CtldLun) {
+	res.Id = strconv.Itoa(lun.Id)
+	res.BackendType = lun.BackendType
+	res.LunType = lun.LunType
+	res.Size = strconv.FormatUint(lun.Size, 10)
+	res.Blocksize = strconv.Itoa(lun.Blocksize)
+	res.SerialNumber = lun.SerialNumber
+	res.DeviceId = lun.DeviceId
+	res.NumThreads = strconv.Itoa(lun.NumThreads)
+	res.File = lun.File
+	res.CtldName = lun.CtldName
+	res.Options = xmlOptions(lun.Options, lunXmlElements...)
+	return
+}
+
+func LunFromXml(lun CtldLun) (res Lun) {
+	res.Id, _ = strconv.Atoi(lun.Id)
+	res.BackendType = lun.BackendType
+	res.LunType = lun.LunType
+	res.Size, _ = strconv.ParseUint(lun.Size, 10, 64)
+	res.Blocksize, _ = strconv.Atoi(lun.Blocksize)
+	res.SerialNumber = lun.SerialNumber
+	res.DeviceId = lun.DeviceId
+	res.NumThreads, _ = strconv.Atoi(lun.NumThreads)
+	res.File = lun.File
+	res.CtldName = lun.CtldName
+	res.Options = optionsFromXml(lun.Options)
+	return
+}
+
+func (port Port) Xml() (res CtldPort) {
+	res.Id = strconv.Itoa(port.Id)
+	res.FrontendType = port.FrontendType
+	res.PortType = port.PortType
+	res.Online = "NO"
+	if port.Online {
+		res.Online = "YES"
+	}
+	res.PortName = port.PortName
+	res.PhysicalPort = port.PhysicalPort
+	res.VirtualPort = port.VirtualPort
+	res.Target = port.Target
+	res.Port = port.Port
+	res.CfiscsiState = port.CfiscsiState
+	res.CfiscsiTarget = port.CfiscsiTarget
+	res.CtldPortalGroupName = port.CtldPortalGroupName
+	res.CfiscsiPortalGroupTag = strconv.Itoa(port.CfiscsiPortalGroupTag)
+	res.Options = xmlOptions(port.Options)
+	res.LunMap = "off"
+	if port.LunMap {
+		res.LunMap = "on"
+	}
+	for _, lun := range port.Luns {
+		res.Luns = append(res.Luns, CtldPortLun{Id: lun.Lun, Value: strconv.Itoa(lun.Id)})
+	}
+	for _, initiator := range port.Initiators {
+		res.Initiators = append(res.Initiators, CtldPortInitiator{Id: initiator.Id, Value: initiator.Name})
+	}
+	return
+}
+
+func PortFromXml(port CtldPort) (res Port) {
+	res.Id, _ = strconv.Atoi(port.Id)
+	res.FrontendType = port.FrontendType
+	res.PortType = port.PortType
+	res.Online = port.Online == "YES"
+	res.PortName = port.PortName
+	res.PhysicalPort = port.PhysicalPort
+	res.VirtualPort = port.VirtualPort
+	res.Target = port.Target
+	res.Port = port.Port
+	res.CfiscsiState = port.CfiscsiState
+	res.CfiscsiTarget = port.CfiscsiTarget
+	res.CtldPortalGroupName = port.CtldPortalGroupName
+	res.CfiscsiPortalGroupTag, _ = strconv.Atoi(port.CfiscsiPortalGroupTag)
+	res.LunMap = port.LunMap == "on"
+	res.Luns = []PortLun{}
+	for _, lun := range port.Luns {
+		id, _ := strconv.Atoi(lun.Value)
+		res.Luns = append(res.Luns, PortLun{Lun: lun.Id, Id: id})
+	}
+	res.Initiators = []PortInitiator{}
+	for _, initiator := range port.Initiators {
+		res.Initiators = append(res.Initiators, PortInitiator{Id: initiator.Id, Name: initiator.Value})
+	}
+	res.Options = optionsFromXml(port.Options)
+	return
+}
+
+func (session Session) Xml() (res CtlIsConnection) {
+	res.Id = session.Id
+	res.Initiator = session.Initiator
+	res.InitiatorAddr = session.InitiatorAddr
+	res.InitiatorAlias = session.InitiatorAlias
+	res.Target = session.Target
+	res.TargetAlias = session.TargetAlias
+	res.TargetPortalGroupTag = strconv.Itoa(session.TargetPortalGroupTag)
+	res.HeaderDigest = session.HeaderDigest
+	res.DataDigest = session.DataDigest
+	res.MaxRecvDataSegmentLength = strconv.Itoa(session.MaxRecvDataSegmentLength)
+	res.MaxSendDataSegmentLength = strconv.Itoa(session.MaxSendDataSegmentLength)
+	res.MaxBurstLength = strconv.Itoa(session.MaxBurstLength)
+	res.FirstBurstLength = strconv.Itoa(session.FirstBurstLength)
+	res.ImmediateData = boolToInt(session.ImmediateData)
+	res.Iser = boolToInt(session.Iser)
+	res.Offload = session.Offload
+	res.Connections = session.Connections
+	return
+}
+
+func SessionFromXml(conn CtlIsConnection) (res Session) {
+	res.Id = conn.Id
+	res.Initiator = conn.Initiator
+	res.InitiatorAddr = conn.InitiatorAddr
+	res.InitiatorAlias = conn.InitiatorAlias
+	res.Target = conn.Target
+	res.TargetAlias = conn.TargetAlias
+	res.TargetPortalGroupTag, _ = strconv.Atoi(conn.TargetPortalGroupTag)
+	res.HeaderDigest = conn.HeaderDigest
+	res.DataDigest = conn.DataDigest
+	res.MaxRecvDataSegmentLength, _ = strconv.Atoi(conn.MaxRecvDataSegmentLength)
+	res.MaxSendDataSegmentLength, _ = strconv.Atoi(conn.MaxSendDataSegmentLength)
+	res.MaxBurstLength, _ = strconv.Atoi(conn.MaxBurstLength)
+	res.FirstBurstLength, _ = strconv.Atoi(conn.FirstBurstLength)
+	res.ImmediateData = conn.ImmediateData == 1
+	res.Iser = conn.Iser == 1
+	res.Offload = conn.Offload
+	res.Connections = conn.Connections
+	return
+}
+
+// MarshalLunsXml renders luns like FreeBSD ctladm devlist -x.
+func MarshalLunsXml(luns []Lun) ([]byte, error) {
+	list := CtldLunList{}
+	for _, lun := range luns {
+		list.Luns = append(list.Luns, lun.Xml())
+	}
+	return xml.MarshalIndent(list, "", "        ")
+}
+
+// UnmarshalLunsXml reads the output of devlist -x, from ctladm or FreeBSD.
+func UnmarshalLunsXml(data []byte) (res []Lun, err error) {
+	var (
+		list CtldLunList
+	)
+	if err = xml.Unmarshal(data, &list); err == nil {
+		for _, lun := range list.Luns {
+			res = append(res, LunFromXml(lun))
+		}
+	}
+	return
+}
+
+// MarshalPortsXml renders ports like FreeBSD ctladm portlist -x.
+func MarshalPortsXml(ports []Port) ([]byte, error) {
+	list := CtldPortList{}
+	for _, port := range ports {
+		list.Ports = append(list.Ports, port.Xml())
+	}
+	return xml.MarshalIndent(list, "", "        ")
+}
+
+// UnmarshalPortsXml reads the output of portlist -x, from ctladm or FreeBSD.
+func UnmarshalPortsXml(data []byte) (res []Port, err error) {
+	var (
+		list CtldPortList
+	)
+	if err = xml.Unmarshal(data, &list); err == nil {
+		for _, port := range list.Ports {
+			res = append(res, PortFromXml(port))
+		}
+	}
+	return
+}
+
+// MarshalSessionsXml renders sessions like FreeBSD ctladm islist -x.
+func MarshalSessionsXml(sessions []Session) ([]byte, error) {
+	list := CtlIsList{}
+	for _, session := range sessions {
+		list.Connections = append(list.Connections, session.Xml())
+	}
+	return xml.MarshalIndent(list, "", "        ")
+}
+
+// UnmarshalSessionsXml reads the output of islist -x, from ctladm or FreeBSD.
+func UnmarshalSessionsXml(data []byte) (res []Session, err error) {
+	var (
+		list CtlIsList
+	)
+	if err = xml.Unmarshal(data, &list); err == nil {
+		for _, conn := range list.Connections {
+			res = append(res, SessionFromXml(conn))
+		}
+	}
+	return
+}
@@ -0,0 +1,56 @@
+package pk_ctlcompat
+
+import (
+	"strconv"
+	"strings"
+
+	zfs "github.com/Tualua/pk_ctladm/pk_zfs"
+)
+
+func ZvolDataset(fileName string) (dataset string, ok bool) {
+	if zvolPath := zfs.ZfsGetZvolPath() + "/"; strings.HasPrefix(fileName, zvolPath) {
+		dataset = strings.TrimPrefix(fileName, zvolPath)
+		ok = dataset != ""
+	}
+	return
+}
+
+func ZvolSetSize(dataset string, size uint64) (err error) {
+	if err = zfs.ZfsSetProperty(dataset, "volsize", strconv.FormatUint(size, 10)); err != nil {
+		log.Errorf("ZvolSetSize: %v", err)
+	} else {
+		log.Infof("Zvol %s resized to %d bytes", dataset, size)
+	}
+	return
+}
+
+func ZvolOrigin(dataset string) (origin string, err error) {
+	var (
+		info map[string]string
+	)
+	if info, err = zfs.ZfsGetCloneInfo(dataset); err != nil {
+		log.Errorf("ZvolOrigin: %v", err)
+	} else if origin = info["origin"]; origin == "-" {
+		origin = ""
+	}
+	return
+}
+
+func ZvolDestroy(dataset string) (err error) {
+	if err = zfs.ZfsDestroyDataset(dataset); err != nil {
+		log.Errorf("ZvolDestroy: %v", err)
+	} else {
+		log.Infof("Zvol %s destroyed", dataset)
+	}
+	return
+}
+
+func ZvolSnapshot(dataset string, name string) (snapshot string, err error) {
+	snapshot = dataset + "@" + name
+	if err = zfs.ZfsCreateSnapshot(dataset, name); err != nil {
+		log.Errorf("ZvolSnapshot: %v", err)
+	} else {
+		log.Infof("Snapshot %s created", snapshot)
+	}
+	return
+}
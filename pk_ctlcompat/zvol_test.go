@@ -0,0 +1,146 @@
+package pk_ctlcompat
+
+import (
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	scst "github.com/Tualua/pk_ctladm/pk_scst"
+	zfs "github.com/Tualua/pk_ctladm/pk_zfs"
+)
+
+// setupZvols points pk_scst at a simulated SCST and pk_zfs at a fake pool
+// with the zvol tank/games/base, restoring both when the test ends.
+func setupZvols(t *testing.T) (fake *zfs.ZfsFake, devRoot string) {
+	var (
+		err error
+	)
+	t.Helper()
+	setupScst(t)
+	devRoot = t.TempDir()
+	fake = zfs.NewZfsFake(devRoot)
+	now := time.Unix(1665000000, 0)
+	fake.Now = func() time.Time {
+		now = now.Add(time.Minute)
+		return now
+	}
+	prevBackend, prevZvolPath := zfs.ZfsGetBackend(), zfs.ZfsGetZvolPath()
+	zfs.ZfsSetBackend(fake)
+	zfs.ZfsSetZvolPath(devRoot)
+	t.Cleanup(func() {
+		zfs.ZfsSetBackend(prevBackend)
+		zfs.ZfsSetZvolPath(prevZvolPath)
+	})
+
+	if err = fake.CreatePool("tank", 1<<40); err == nil {
+		if err = fake.CreateFilesystem("tank/games"); err == nil {
+			err = fake.CreateVolume("tank/games/base", 10<<20)
+		}
+	}
+	if err != nil {
+		t.Fatalf("cannot create the fake pool: %v", err)
+	}
+	return
+}
+
+func TestCreateLunOnCloneOfLastSnapshot(t *testing.T) {
+	fake, devRoot := setupZvols(t)
+	// v1 is taken last, so it is the latest snapshot even though it sorts
+	// first by name.
+	for _, step := range []func() error{
+		func() error { return fake.CreateSnapshot("tank/games/base", "v2") },
+		func() error { return fake.Write("tank/games/base", 1<<20) },
+		func() error { return fake.CreateSnapshot("tank/games/base", "v1") },
+		func() error { return zfs.ZfsCloneLast("tank/games/base", "tank/games/player1") },
+	} {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lun, err := CreateLun("block", CTL_LUN_TYPE_DISK, map[string]string{"file": path.Join(devRoot, "tank/games/player1")}, "", "")
+	if err != nil {
+		t.Fatalf("CreateLun: %v", err)
+	}
+	dataset, ok := ZvolDataset(lun.File)
+	if !ok || dataset != "tank/games/player1" {
+		t.Fatalf("LUN file %s is not the zvol of tank/games/player1", lun.File)
+	}
+	if origin, err := ZvolOrigin(dataset); err != nil || origin != "tank/games/base@v1" {
+		t.Errorf("origin of %s is %q (%v), want tank/games/base@v1", dataset, origin, err)
+	}
+
+	if err = PurgeLun("block", strconv.Itoa(lun.Id), true, "destroy", nil); err != nil {
+		t.Fatalf("PurgeLun: %v", err)
+	}
+	if exists, _ := fake.CheckDatasetExists(dataset); exists {
+		t.Errorf("clone %s left behind by --zfs destroy", dataset)
+	}
+}
+
+func TestPurgeLunRefusesToDestroyNonClone(t *testing.T) {
+	fake, devRoot := setupZvols(t)
+	lun, err := CreateLun("block", CTL_LUN_TYPE_DISK, map[string]string{"file": path.Join(devRoot, "tank/games/base")}, "", "")
+	if err != nil {
+		t.Fatalf("CreateLun: %v", err)
+	}
+
+	id := strconv.Itoa(lun.Id)
+	err = PurgeLun("block", id, true, "destroy", func(step string) {
+		t.Errorf("PurgeLun did %q before refusing", step)
+	})
+	if err == nil || !strings.Contains(err.Error(), "is not a clone") {
+		t.Fatalf("PurgeLun of a zvol that is not a clone returned %v", err)
+	}
+	if exists, _ := fake.CheckDatasetExists("tank/games/base"); !exists {
+		t.Errorf("tank/games/base destroyed")
+	}
+	if device, err := FindLunDevice(id); err != nil || device != "base" {
+		t.Errorf("LUN %s is %q (%v) after the refusal, want device base", id, device, err)
+	}
+	if wwn, _ := lun.Export(); !scst.ScstIscsiTargetEnabled(wwn) {
+		t.Errorf("target %s disabled by the refusal", wwn)
+	}
+}
+
+func TestZvolErrorKinds(t *testing.T) {
+	fake, devRoot := setupZvols(t)
+	if err := fake.CreateSnapshot("tank/games/base", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := zfs.ZfsCloneLast("tank/games/base", "tank/games/player1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name string
+		do   func() error
+		want error
+	}{
+		{"origin of a missing zvol", func() error {
+			_, err := ZvolOrigin("tank/games/missing")
+			return err
+		}, ErrNotFound},
+		{"destroy with dependent clones", func() error {
+			return ZvolDestroy("tank/games/base")
+		}, ErrBusy},
+		{"clone over an existing zvol", func() error {
+			return zfs.ZfsCloneLast("tank/games/base", "tank/games/player1")
+		}, ErrBusy},
+		{"purge of a LUN whose zvol is gone", func() error {
+			lun, err := CreateLun("block", CTL_LUN_TYPE_DISK, map[string]string{"file": path.Join(devRoot, "tank/games/player1")}, "", "")
+			if err != nil {
+				return err
+			}
+			if err = fake.DestroyDataset("tank/games/player1"); err != nil {
+				return err
+			}
+			return PurgeLun("block", strconv.Itoa(lun.Id), true, "destroy", nil)
+		}, ErrNotFound},
+	} {
+		if kind := ErrorKind(c.do()); kind != c.want {
+			t.Errorf("%s: error kind %v, want %v", c.name, kind, c.want)
+		}
+	}
+}
@@ -3,28 +3,47 @@ package pk_scst
 import (
 	"errors"
 	"fmt"
-	"io"
 	"io/fs"
-	"os"
 	"path"
-	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
-	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus"
 )
 
 const SCST_ROOT_PATH string = "/sys/kernel/scst_tgt"
-const SCST_DEVICES string = SCST_ROOT_PATH + "/devices"
-const SCST_ISCSI_TARGETS string = SCST_ROOT_PATH + "/targets/iscsi"
-const SYSFS_SCST_DEV_MGMT string = SCST_ROOT_PATH + "/handlers/vdisk_blockio/mgmt"
-const SYSFS_SCST_LUNS_MGMT string = "/ini_groups/allowed_ini/luns/mgmt"
-const SYSFS_SCST_LUN0_DEV string = "ini_groups/allowed_ini/luns/0/device"
+const SCST_DEVICES string = "devices"
+const SCST_ISCSI_TARGETS string = "targets/iscsi"
+const SCST_ISCSI_TARGETS_MGMT string = SCST_ISCSI_TARGETS + "/mgmt"
+const SCST_HANDLERS string = "handlers"
+const SCST_HANDLER_BLOCKIO string = "vdisk_blockio"
+const SCST_HANDLER_FILEIO string = "vdisk_fileio"
+const SCST_HANDLER_NULLIO string = "vdisk_nullio"
+const SCST_HANDLER_CDROM string = "vcdrom"
+const SYSFS_SCST_INI_GROUPS_MGMT string = "/ini_groups/mgmt"
+const SYSFS_SCST_INI_GROUP string = "allowed_ini"
+
+var log = logrus.StandardLogger()
+
+// SetLogger makes the package log through l instead of the standard logrus
+// logger.
+func SetLogger(l *logrus.Logger) {
+	log = l
+}
 
 type ScstBlockDevice struct {
 	Name     string
 	Filename string
 }
 
+type ScstLun struct {
+	Lun    int
+	Device ScstBlockDevice
+}
+
 func readParamsFromDir(dirpath string) (map[string]string, error) {
 	var (
 		res map[string]string
@@ -32,24 +51,20 @@ func readParamsFromDir(dirpath string) (map[string]string, error) {
 		val []byte
 	)
 	res = make(map[string]string)
-	if dataDir, err := os.Open(dirpath); err != nil {
+	if files, err := scstReadDir(dirpath); err != nil {
 		return res, err
 	} else {
-		if files, err := dataDir.ReadDir(0); err != nil {
-			return res, err
-		} else {
-			for _, v := range files {
-				if f, err := os.Open(path.Join(dirpath, v.Name())); err != nil {
-					res[v.Name()] = err.Error()
-				} else {
-					if val, err = io.ReadAll(f); err != nil {
-						res[v.Name()] = err.Error()
-					}
-					res[v.Name()] = strings.TrimSuffix(string(val), "\n")
-					res[v.Name()] = strings.TrimSuffix(res[v.Name()], "\n[key]")
-					res[v.Name()] = strings.TrimSuffix(res[v.Name()], "\n[key]\n")
-					res[v.Name()] = strings.TrimSuffix(res[v.Name()], "\n")
-				}
+		for _, v := range files {
+			if v.IsDir() || v.Type()&fs.ModeSymlink != 0 {
+				continue
+			}
+			if val, err = scstReadFile(path.Join(dirpath, v.Name())); err != nil {
+				continue
+			} else {
+				res[v.Name()] = strings.TrimSuffix(string(val), "\n")
+				res[v.Name()] = strings.TrimSuffix(res[v.Name()], "\n[key]")
+				res[v.Name()] = strings.TrimSuffix(res[v.Name()], "\n[key]\n")
+				res[v.Name()] = strings.TrimSuffix(res[v.Name()], "\n")
 			}
 		}
 	}
@@ -62,15 +77,11 @@ func ReadFromDir(dirpath string) ([]string, error) {
 		err error
 	)
 
-	if dataDir, err := os.Open(dirpath); err != nil {
+	if files, err := scstReadDir(dirpath); err != nil {
 		return res, err
 	} else {
-		if files, err := dataDir.ReadDir(0); err != nil {
-			return res, err
-		} else {
-			for _, v := range files {
-				res = append(res, v.Name())
-			}
+		for _, v := range files {
+			res = append(res, v.Name())
 		}
 	}
 	return res, err
@@ -78,40 +89,40 @@ func ReadFromDir(dirpath string) ([]string, error) {
 
 func listSubDirs(dirPath string) (res []string, err error) {
 	var (
-		dir        *os.File
 		dirContent []fs.DirEntry
 	)
-	if dir, err = os.Open(dirPath); err != nil {
-		log.Println(err.Error())
-	} else {
-		if dirContent, err = dir.ReadDir(0); err != nil {
-			log.Println(err.Error())
-		} else {
-			for _, v := range dirContent {
-				if v.IsDir() {
-					res = append(res, v.Name())
-				}
+	if dirContent, err = scstReadDir(dirPath); err == nil {
+		for _, v := range dirContent {
+			if v.IsDir() {
+				res = append(res, v.Name())
 			}
 		}
 	}
 	return
 }
 
+func scstWriteAttr(attrPath string, val string) (err error) {
+	return scstFs.WriteFile(attrPath, []byte(val))
+}
+
+func scstMgmtCmd(mgmtPath string, cmd string) (err error) {
+	if err = scstWriteAttr(mgmtPath, cmd); err != nil {
+		err = fmt.Errorf("command \"%s\" failed: %w", cmd, err)
+	} else {
+		log.Debugf("%s: %s", mgmtPath, cmd)
+	}
+	return
+}
+
 func ScstGetDevices() ([]string, error) {
 	var (
 		res         []string
 		scstDevices []fs.DirEntry
 		err         error
 	)
-	if scstDevicesDir, err := os.Open(SCST_DEVICES); err != nil {
-		log.Error(err.Error())
-	} else {
-		if scstDevices, err = scstDevicesDir.ReadDir(0); err != nil {
-			log.Error(err.Error())
-		} else {
-			for _, v := range scstDevices {
-				res = append(res, v.Name())
-			}
+	if scstDevices, err = scstReadDir(SCST_DEVICES); err == nil {
+		for _, v := range scstDevices {
+			res = append(res, v.Name())
 		}
 	}
 	return res, err
@@ -128,9 +139,7 @@ func ScstFindWwn(tgtId string) (res string, err error) {
 	var (
 		targets []string
 	)
-	if targets, err = ScstGetIscsiTargets(); err != nil {
-		log.Println(err.Error())
-	} else {
+	if targets, err = ScstGetIscsiTargets(); err == nil {
 		for _, v := range targets {
 			tgtId2 := strings.Split(v, ":")
 			if tgtId == tgtId2[len(tgtId2)-1] {
@@ -151,15 +160,10 @@ func ScstGetDeviceParam(device string, param string) string {
 		res       string
 	)
 
-	paramPath = SCST_DEVICES + "/" + device + "/" + param
-	deviceParam, err := os.Open(paramPath)
-	if err != nil {
+	paramPath = path.Join(SCST_DEVICES, device, param)
+	if deviceParamData, err := scstReadFile(paramPath); err != nil {
 		res = ""
 	} else {
-		deviceParamData, err := io.ReadAll(deviceParam)
-		if err != nil {
-			res = ""
-		}
 		res = strings.Split(string(deviceParamData), "\n")[0]
 	}
 	return res
@@ -168,35 +172,42 @@ func ScstGetDeviceParam(device string, param string) string {
 
 func ScstGetIscsiTargetParam(wwn string, param string) (res string, err error) {
 	var (
-		paramPath string = SCST_ISCSI_TARGETS + "/" + wwn + "/" + param
+		paramPath string = path.Join(SCST_ISCSI_TARGETS, wwn, param)
 	)
 
-	if deviceParam, err := os.Open(paramPath); err != nil {
+	if deviceParamData, err := scstReadFile(paramPath); err != nil {
 		res = ""
 	} else {
-		if deviceParamData, err := io.ReadAll(deviceParam); err != nil {
-			res = ""
-		} else {
-			res = strings.Split(string(deviceParamData), "\n")[0]
-		}
+		res = strings.Split(string(deviceParamData), "\n")[0]
 	}
 	return
 }
 
-func scstSetDeviceParam(device string, param string, val string) (err error) {
+func ScstSetDeviceParam(device string, param string, val string) (err error) {
 	var (
-		paramPath string = SCST_DEVICES + "/" + device + "/" + param
+		paramPath string = path.Join(SCST_DEVICES, device, param)
 	)
 
-	if deviceParam, err := os.OpenFile(paramPath, os.O_WRONLY, 0644); err != nil {
-		log.Println(err)
-	} else {
-		defer deviceParam.Close()
-		deviceParamW, err := deviceParam.Write([]byte(val))
-		if err != nil {
-			log.Println(err)
-		}
-		log.Printf("Wrote %d bytes.\n", deviceParamW)
+	if err = scstWriteAttr(paramPath, val); err != nil {
+		err = fmt.Errorf("ScstSetDeviceParam: cannot set %s of device %s: %w", param, device, err)
+	}
+	return
+}
+
+func ScstSetIscsiTargetParam(wwn string, param string, val string) (err error) {
+	var (
+		paramPath string = path.Join(SCST_ISCSI_TARGETS, wwn, param)
+	)
+
+	if err = scstWriteAttr(paramPath, val); err != nil {
+		err = fmt.Errorf("ScstSetIscsiTargetParam: cannot set %s of target %s: %w", param, wwn, err)
+	}
+	return
+}
+
+func ScstResyncDeviceSize(device string) (err error) {
+	if err = ScstSetDeviceParam(device, "resync_size", "1"); err != nil {
+		err = fmt.Errorf("ScstResyncDeviceSize: %w", err)
 	}
 	return
 }
@@ -204,7 +215,7 @@ func scstSetDeviceParam(device string, param string, val string) (err error) {
 func ScstGetDeviceParams(device string) (res map[string]string, err error) {
 
 	if res, err = readParamsFromDir(path.Join(SCST_DEVICES, device)); err != nil {
-		log.Error(err.Error())
+		err = fmt.Errorf("ScstGetDeviceParams: cannot read device %s: %w", device, err)
 	}
 	return
 }
@@ -214,120 +225,343 @@ func ScstGetIscsiTargetParams(target string) (res map[string]string, err error)
 		wwn string
 	)
 	res = make(map[string]string)
-	if wwn, err = ScstFindWwn(target); err != nil {
-		log.Println(err.Error())
-	} else {
+	if wwn, err = ScstFindWwn(target); err == nil {
 		if res, err = readParamsFromDir(path.Join(SCST_ISCSI_TARGETS, wwn)); err != nil {
-			log.Println(err.Error())
+			return
 		}
 		res["wwn"] = wwn
 	}
 	return
 }
 
+func ScstGetIscsiTargetAttrs(wwn string) (res map[string]string, err error) {
+	if res, err = readParamsFromDir(path.Join(SCST_ISCSI_TARGETS, wwn)); err != nil {
+		err = fmt.Errorf("ScstGetIscsiTargetAttrs: cannot read attributes of target %s: %w", wwn, err)
+	}
+	return
+}
+
+func ScstHandlerMgmt(handler string) string {
+	return path.Join(SCST_HANDLERS, handler, "mgmt")
+}
+
+// ScstGetDeviceHandler returns the name of the handler serving device.
+func ScstGetDeviceHandler(device string) (res string, err error) {
+	if res, err = scstFs.Readlink(path.Join(SCST_DEVICES, device, "handler")); err != nil {
+		err = fmt.Errorf("ScstGetDeviceHandler: cannot find handler of device %s: %w", device, err)
+	} else {
+		res = path.Base(res)
+	}
+	return
+}
+
 func ScstDeleteDevice(device string) (err error) {
+	var (
+		handler string
+	)
+	if handler, err = ScstGetDeviceHandler(device); err != nil {
+		return
+	}
+	if err = scstMgmtCmd(ScstHandlerMgmt(handler), "del_device "+device); err != nil {
+		err = fmt.Errorf("ScstDeleteDevice: cannot delete device %s: %w", device, err)
+	} else {
+		log.Printf("Device %s deleted \n", device)
+	}
+	return
+}
 
-	scstCmd := []byte("del_device " + device)
-	if mgmt, err := os.OpenFile(SYSFS_SCST_DEV_MGMT, os.O_WRONLY, 0644); err != nil {
-		log.Println(err.Error())
+func ScstDeleteIscsiTarget(wwn string) (err error) {
+	if err = scstMgmtCmd(SCST_ISCSI_TARGETS_MGMT, "del_target "+wwn); err != nil {
+		err = fmt.Errorf("ScstDeleteIscsiTarget: cannot delete target %s: %w", wwn, err)
 	} else {
-		defer mgmt.Close()
-		if _, err := mgmt.Write(scstCmd); err != nil {
-			log.Println(err.Error())
-		} else {
-			log.Printf("Device %s deleted \n", device)
-		}
+		log.Printf("Target %s deleted\n", wwn)
 	}
 	return
 }
 
 func ScstDeactivateDevice(device string) (err error) {
+	if err = scstWriteAttr(path.Join(SCST_DEVICES, device, "active"), "0"); err != nil {
+		err = fmt.Errorf("ScstDeactivateDevice: cannot deactivate device: %w", err)
+	}
+	return
+}
+
+func ScstActivateDevice(device string) (err error) {
+	if err = scstWriteAttr(path.Join(SCST_DEVICES, device, "active"), "1"); err != nil {
+		err = fmt.Errorf("ScstActivateDevice: cannot activate device: %w", err)
+	} else {
+		log.Printf("Device %s activated \n", device)
+	}
+	return
+}
+
+// ScstAddDevice creates device devId with handler, params are the
+// add_device parameters the handler takes.
+func ScstAddDevice(handler string, devId string, params map[string]string) (err error) {
 	var (
-		mgmt *os.File
+		names     []string
+		devParams []string
 	)
-	scstCmd := []byte("0")
-	scstCmdPath := path.Join(SCST_DEVICES, device, "active")
-	if mgmt, err = os.OpenFile(scstCmdPath, os.O_WRONLY, 0644); err != nil {
-		//log.Println(err.Error())
-		err = fmt.Errorf("ScstDeactivateDevice: cannot deactivate device: %w", err)
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		devParams = append(devParams, name+"="+params[name])
+	}
+	scstCmd := strings.TrimSpace("add_device " + devId + " " + strings.Join(devParams, "; "))
+	if err = scstMgmtCmd(ScstHandlerMgmt(handler), scstCmd); err != nil {
+		err = fmt.Errorf("ScstAddDevice: cannot add device %s: %w", devId, err)
+	} else if filename, ok := params["filename"]; ok {
+		log.Printf("Device %s backed by %s added to %s\n", devId, filename, handler)
 	} else {
-		defer mgmt.Close()
-		if _, err = mgmt.Write(scstCmd); err != nil {
-			//log.Println(err.Error())
-			err = fmt.Errorf("ScstDeactivateDevice: cannot deactivate device: %w", err)
+		log.Printf("Device %s added to %s\n", devId, handler)
+	}
+	return
+}
+
+func ScstAddIscsiTarget(wwn string) (err error) {
+	if err = scstMgmtCmd(SCST_ISCSI_TARGETS_MGMT, "add_target "+wwn); err != nil {
+		err = fmt.Errorf("ScstAddIscsiTarget: cannot add target %s: %w", wwn, err)
+	} else {
+		log.Printf("Target %s added\n", wwn)
+	}
+	return
+}
+
+// ScstGetIscsiTargetAttrValues returns the values of a target attribute
+// that can be set several times, like IncomingUser or allowed_portal. SCST
+// keeps them in attr, attr1, attr2 and so on.
+func ScstGetIscsiTargetAttrValues(wwn string, attr string) (res []string, err error) {
+	var (
+		params map[string]string
+	)
+	if params, err = readParamsFromDir(path.Join(SCST_ISCSI_TARGETS, wwn)); err != nil {
+		err = fmt.Errorf("ScstGetIscsiTargetAttrValues: cannot read attributes of target %s: %w", wwn, err)
+		return
+	}
+	for name, val := range params {
+		if n := strings.TrimPrefix(name, attr); n != name {
+			if _, err := strconv.Atoi(n); n != "" && err != nil {
+				continue
+			}
+			res = append(res, strings.Split(val, "\n")[0])
 		}
 	}
+	sort.Strings(res)
 	return
 }
 
-func ScstActivateDevice(device string) (err error) {
+// ScstAddIscsiTargetAttr adds a value to a target attribute like
+// IncomingUser ("user secret") or allowed_portal ("address").
+func ScstAddIscsiTargetAttr(wwn string, attr string, val string) (err error) {
+	if err = scstMgmtCmd(SCST_ISCSI_TARGETS_MGMT, fmt.Sprintf("add_target_attribute %s %s %s", wwn, attr, val)); err != nil {
+		err = fmt.Errorf("ScstAddIscsiTargetAttr: cannot add %s to target %s: %w", attr, wwn, err)
+	}
+	return
+}
+
+// ScstDelIscsiTargetAttr removes the value of a target attribute that
+// starts with key, the user name for IncomingUser and OutgoingUser.
+func ScstDelIscsiTargetAttr(wwn string, attr string, key string) (err error) {
+	if err = scstMgmtCmd(SCST_ISCSI_TARGETS_MGMT, fmt.Sprintf("del_target_attribute %s %s %s", wwn, attr, key)); err != nil {
+		err = fmt.Errorf("ScstDelIscsiTargetAttr: cannot remove %s %s from target %s: %w", attr, key, wwn, err)
+	}
+	return
+}
+
+func ScstEnableIscsiTarget(wwn string) (err error) {
+	return ScstSetIscsiTargetParam(wwn, "enabled", "1")
+}
+
+func ScstDisableIscsiTarget(wwn string) (err error) {
+	return ScstSetIscsiTargetParam(wwn, "enabled", "0")
+}
+
+func ScstIscsiTargetEnabled(wwn string) bool {
+	enabled, _ := ScstGetIscsiTargetParam(wwn, "enabled")
+	return enabled == "1"
+}
+
+func ScstSetIscsiDriverEnabled(enabled bool) (err error) {
+	val := "0"
+	if enabled {
+		val = "1"
+	}
+	if err = scstWriteAttr(path.Join(SCST_ISCSI_TARGETS, "enabled"), val); err != nil {
+		err = fmt.Errorf("ScstSetIscsiDriverEnabled: cannot set iSCSI driver state: %w", err)
+	}
+	return
+}
+
+func scstLunsPath(wwn string, group string) string {
+	if group == "" {
+		return path.Join(SCST_ISCSI_TARGETS, wwn, "luns")
+	}
+	return path.Join(SCST_ISCSI_TARGETS, wwn, "ini_groups", group, "luns")
+}
+
+func ScstCreateIniGroup(wwn string, group string) (err error) {
+	groupPath := path.Join(SCST_ISCSI_TARGETS, wwn, "ini_groups", group)
+	if !scstExists(groupPath) {
+		if err = scstMgmtCmd(path.Join(SCST_ISCSI_TARGETS, wwn, SYSFS_SCST_INI_GROUPS_MGMT), "create "+group); err != nil {
+			err = fmt.Errorf("ScstCreateIniGroup: cannot create group %s for target %s: %w", group, wwn, err)
+		}
+	}
+	return
+}
+
+func ScstGetIniGroupInitiators(wwn string, group string) (res []string, err error) {
 	var (
-		mgmt *os.File
+		entries []fs.DirEntry
 	)
-	scstCmd := []byte("1")
-	scstCmdPath := path.Join(SCST_DEVICES, device, "active")
-	if mgmt, err = os.OpenFile(scstCmdPath, os.O_WRONLY, 0644); err != nil {
-		log.Println(err.Error())
-	} else {
-		defer mgmt.Close()
-		if _, err = mgmt.Write(scstCmd); err != nil {
-			log.Println(err.Error())
+	if entries, err = scstReadDir(path.Join(SCST_ISCSI_TARGETS, wwn, "ini_groups", group, "initiators")); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			err = nil
 		} else {
-			log.Printf("Device %s activated \n", device)
+			err = fmt.Errorf("ScstGetIniGroupInitiators: cannot read initiators of group %s of target %s: %w", group, wwn, err)
+		}
+		return
+	}
+	for _, entry := range entries {
+		if entry.Name() != "mgmt" {
+			res = append(res, entry.Name())
 		}
 	}
 	return
 }
 
-func ScstCreateLun(devId string, fileName string) (err error) {
+func ScstAddIniGroupInitiator(wwn string, group string, initiator string) (err error) {
+	if err = ScstCreateIniGroup(wwn, group); err != nil {
+		return
+	}
+	if err = scstMgmtCmd(path.Join(SCST_ISCSI_TARGETS, wwn, "ini_groups", group, "initiators", "mgmt"), "add "+initiator); err != nil {
+		err = fmt.Errorf("ScstAddIniGroupInitiator: cannot add %s to group %s of target %s: %w", initiator, group, wwn, err)
+	}
+	return
+}
+
+func ScstDelIniGroupInitiator(wwn string, group string, initiator string) (err error) {
+	if err = scstMgmtCmd(path.Join(SCST_ISCSI_TARGETS, wwn, "ini_groups", group, "initiators", "mgmt"), "del "+initiator); err != nil {
+		err = fmt.Errorf("ScstDelIniGroupInitiator: cannot remove %s from group %s of target %s: %w", initiator, group, wwn, err)
+	}
+	return
+}
+
+func ScstMapLun(wwn string, group string, devId string, lun int) (err error) {
 	var (
-		lunPathMgmt string
-		wwn         string
-		targets     []string
+		scstCmd string = "add"
 	)
-	if targets, err = ScstGetIscsiTargets(); err != nil {
-		log.Println(err.Error())
+	if group != "" {
+		if err = ScstCreateIniGroup(wwn, group); err != nil {
+			return
+		}
+	}
+	lunsPath := scstLunsPath(wwn, group)
+	if scstExists(path.Join(lunsPath, strconv.Itoa(lun))) {
+		scstCmd = "replace"
+	}
+	if err = scstMgmtCmd(path.Join(lunsPath, "mgmt"), fmt.Sprintf("%s %s %d", scstCmd, devId, lun)); err != nil {
+		err = fmt.Errorf("ScstMapLun: cannot export device %s via target %s: %w", devId, wwn, err)
 	} else {
-		for _, v := range targets {
-			if strings.Contains(v, devId) {
-				wwn = v
-				break
+		log.Printf("LUN %d with device %s exported via target %s\n", lun, devId, wwn)
+	}
+	return
+}
+
+func ScstUnmapLun(wwn string, group string, lun int) (err error) {
+	if err = scstMgmtCmd(path.Join(scstLunsPath(wwn, group), "mgmt"), fmt.Sprintf("del %d", lun)); err != nil {
+		err = fmt.Errorf("ScstUnmapLun: cannot remove LUN %d from target %s: %w", lun, wwn, err)
+	} else {
+		log.Printf("LUN %d removed from target %s\n", lun, wwn)
+	}
+	return
+}
+
+func ScstAddLun(wwn string, devId string, lun int) (err error) {
+	return ScstMapLun(wwn, SYSFS_SCST_INI_GROUP, devId, lun)
+}
+
+// ScstCreateLun adds device devId and exports it as LUN lun of target wwn,
+// creating the target when it does not exist. When a step fails the ones
+// already done are undone in reverse order.
+func ScstCreateLun(handler string, devId string, wwn string, relTgtId string, lun int, params map[string]string, attrs map[string]string) (err error) {
+	var (
+		targets []string
+		exists  bool
+		undo    []func() error
+	)
+	defer func() {
+		if err == nil {
+			return
+		}
+		for i := len(undo) - 1; i >= 0; i-- {
+			if undoErr := undo[i](); undoErr != nil {
+				log.Errorf("ScstCreateLun: rollback: %v", undoErr)
 			}
 		}
-		if wwn != "" {
-			if mgmt, err := os.OpenFile(SYSFS_SCST_DEV_MGMT, os.O_WRONLY, 0644); err != nil {
-				err = errors.New("cannot open SCST device management interface")
-				log.Println(err.Error())
-			} else {
-				defer mgmt.Close()
-				scstCmd := "add_device " + devId + " filename=" + fileName + "; nv_cache=1; rotational=0"
-				if _, err := mgmt.Write([]byte(scstCmd)); err != nil {
-					log.Println(err.Error())
-				} else {
-					log.Printf("Device %s backed by %s added\n", devId, fileName)
-					lunPathMgmt = SCST_ISCSI_TARGETS + "/" + wwn + SYSFS_SCST_LUNS_MGMT
-					if mgmt, err = os.OpenFile(lunPathMgmt, os.O_WRONLY, 0644); err != nil {
-						log.Println(err.Error())
-					} else {
-						defer mgmt.Close()
-						scstCmd = "add " + devId + " 0"
-						if _, err := mgmt.Write([]byte(scstCmd)); err != nil {
-							log.Println(err.Error())
-						} else {
-							log.Printf("LUN 0 with device %s exported via target %s\n", devId, wwn)
-							if err = scstSetDeviceParam(devId, "t10_vend_id", "FREE_TT"); err != nil {
-								log.Println(err.Error())
-							}
-						}
-					}
+	}()
+	if targets, err = ScstGetIscsiTargets(); err != nil {
+		return
+	}
+	for _, v := range targets {
+		if v == wwn {
+			exists = true
+			break
+		}
+	}
+	if err = ScstAddDevice(handler, devId, params); err != nil {
+		return
+	}
+	undo = append(undo, func() error { return ScstDeleteDevice(devId) })
+	if !exists {
+		if err = ScstAddIscsiTarget(wwn); err != nil {
+			return
+		}
+		undo = append(undo, func() error { return ScstDeleteIscsiTarget(wwn) })
+	} else if relTgtId != "" {
+		enabled := ScstIscsiTargetEnabled(wwn)
+		oldRelTgtId, _ := ScstGetIscsiTargetParam(wwn, "rel_tgt_id")
+		if err = ScstDisableIscsiTarget(wwn); err != nil {
+			return
+		}
+		undo = append(undo, func() (err error) {
+			if oldRelTgtId != "" && oldRelTgtId != relTgtId {
+				if err = ScstSetIscsiTargetParam(wwn, "rel_tgt_id", oldRelTgtId); err != nil {
+					return
 				}
 			}
-		} else {
-			err = fmt.Errorf("target %s not found", devId)
-			log.Println(err.Error())
+			if enabled {
+				err = ScstEnableIscsiTarget(wwn)
+			}
+			return
+		})
+	}
+	if relTgtId != "" {
+		if err = ScstSetIscsiTargetParam(wwn, "rel_tgt_id", relTgtId); err != nil {
+			return
 		}
 	}
-	return err
+	prevDevice, prevErr := ScstGetLunDevice(wwn, lun)
+	if err = ScstAddLun(wwn, devId, lun); err != nil {
+		return
+	}
+	undo = append(undo, func() error {
+		if prevErr == nil {
+			return ScstAddLun(wwn, prevDevice.Name, lun)
+		}
+		return ScstUnmapLun(wwn, SYSFS_SCST_INI_GROUP, lun)
+	})
+	for attr, val := range attrs {
+		if err = ScstSetDeviceParam(devId, attr, val); err != nil {
+			return
+		}
+	}
+	if err = ScstEnableIscsiTarget(wwn); err != nil {
+		return
+	}
+	err = ScstActivateDevice(devId)
+	return
 }
 
 func ScstListIscsiSessions(target string) (res []string, err error) {
@@ -335,37 +569,125 @@ func ScstListIscsiSessions(target string) (res []string, err error) {
 		sessionsPath string
 		wwn          string
 	)
-	if wwn, err = ScstFindWwn(target); err != nil {
-		log.Println(err.Error())
-	} else {
+	if wwn, err = ScstFindWwn(target); err == nil {
 		sessionsPath = path.Join(SCST_ISCSI_TARGETS, wwn, "sessions")
-		if res, err = ReadFromDir(sessionsPath); err != nil {
-			log.Println(err.Error())
-		}
+		res, err = ReadFromDir(sessionsPath)
 	}
 
 	return
 }
 
 func ScstGetLunDevice(target string, lun int) (device ScstBlockDevice, err error) {
-	lunPath := path.Join(SCST_ISCSI_TARGETS, target, fmt.Sprintf("ini_groups/allowed_ini/luns/%d/device", lun))
-	if lunDevice, err := filepath.EvalSymlinks(lunPath); err != nil {
-		fmt.Printf("error resolving LUN %d path for %s", lun, target)
+	return ScstGetGroupLunDevice(target, SYSFS_SCST_INI_GROUP, lun)
+}
+
+func ScstGetGroupLunDevice(target string, group string, lun int) (device ScstBlockDevice, err error) {
+	var (
+		lunDevice   string
+		lunFilename []byte
+	)
+	lunPath := path.Join(scstLunsPath(target, group), strconv.Itoa(lun), "device")
+	if lunDevice, err = scstEvalSymlinks(lunPath); err != nil {
+		err = fmt.Errorf("ScstGetGroupLunDevice: error resolving LUN %d path for %s: %w", lun, target, err)
 	} else {
-		if lunFile, err := os.Open(path.Join(lunDevice, "filename")); err != nil {
-			fmt.Printf("error opening %s\n", lunDevice)
+		// vdisk_nullio devices have no backing file.
+		if lunFilename, err = scstReadFile(path.Join(lunDevice, "filename")); errors.Is(err, fs.ErrNotExist) {
+			err = nil
+		}
+		if err != nil {
+			err = fmt.Errorf("ScstGetGroupLunDevice: error reading filename of %s: %w", lunDevice, err)
+		} else {
+			device.Name = path.Base(lunDevice)
+			if len(string(lunFilename)) > 0 {
+				device.Filename = strings.Split(string(lunFilename), "\n")[0]
+			}
+		}
+	}
+	return
+}
+
+func ScstGetGroupLuns(target string, group string) (res []ScstLun, err error) {
+	var (
+		entries []fs.DirEntry
+	)
+	lunsPath := scstLunsPath(target, group)
+	if entries, err = scstReadDir(lunsPath); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			err = nil
 		} else {
-			if lunFilename, err := io.ReadAll(lunFile); err != nil {
-				fmt.Printf("error opening %s\n %s\n", lunFile.Name(), err.Error())
+			err = fmt.Errorf("ScstGetGroupLuns: cannot read LUNs of target %s: %w", target, err)
+		}
+		return
+	}
+	for _, entry := range entries {
+		if lun, err := strconv.Atoi(entry.Name()); err == nil && entry.IsDir() {
+			if device, err := ScstGetGroupLunDevice(target, group, lun); err != nil {
+				log.Error(err.Error())
 			} else {
-				//filename = strings.Split(string(lunFilename), "\n")[0]
-				device.Name = filepath.Base(lunDevice)
-				if len(string(lunFilename)) > 0 {
-					device.Filename = strings.Split(string(lunFilename), "\n")[0]
-				}
+				res = append(res, ScstLun{Lun: lun, Device: device})
 			}
 		}
 	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Lun < res[j].Lun })
+	return
+}
+
+// ScstGetLuns returns the LUNs target exports: the ones of its allowed_ini
+// group, then the ones of its default LUN table, which initiators outside
+// the group see, at numbers the group does not use.
+func ScstGetLuns(target string) (res []ScstLun, err error) {
+	var (
+		defaultLuns []ScstLun
+	)
+	if res, err = ScstGetGroupLuns(target, SYSFS_SCST_INI_GROUP); err != nil {
+		return
+	}
+	if defaultLuns, err = ScstGetGroupLuns(target, ""); err != nil {
+		return
+	}
+	grouped := map[int]bool{}
+	for _, lun := range res {
+		grouped[lun.Lun] = true
+	}
+	for _, lun := range defaultLuns {
+		if !grouped[lun.Lun] {
+			res = append(res, lun)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Lun < res[j].Lun })
+	return
+}
+
+type ScstExport struct {
+	Target string
+	Group  string
+	Lun    int
+}
+
+func ScstGetDeviceExports(device string) (res []ScstExport, err error) {
+	var (
+		entries []fs.DirEntry
+	)
+	exportedPath := path.Join(SCST_DEVICES, device, "exported")
+	if entries, err = scstReadDir(exportedPath); err != nil {
+		err = fmt.Errorf("ScstGetDeviceExports: cannot read exports of device %s: %w", device, err)
+		return
+	}
+	for _, entry := range entries {
+		lunPath, err := scstEvalSymlinks(path.Join(exportedPath, entry.Name()))
+		if err != nil || !strings.HasPrefix(lunPath, SCST_ISCSI_TARGETS+"/") {
+			continue
+		}
+		parts := strings.Split(strings.TrimPrefix(lunPath, SCST_ISCSI_TARGETS+"/"), "/")
+		export := ScstExport{Target: parts[0]}
+		if export.Lun, err = strconv.Atoi(parts[len(parts)-1]); err != nil {
+			continue
+		}
+		if len(parts) == 5 && parts[1] == "ini_groups" {
+			export.Group = parts[2]
+		}
+		res = append(res, export)
+	}
 	return
 }
 
@@ -379,3 +701,91 @@ func ScstGetIscsiTargetSessions(target string) (sessions []string) {
 	}
 	return
 }
+
+type ScstIscsiConnection struct {
+	Name  string
+	Cid   string
+	Ip    string
+	State string
+}
+
+type ScstIscsiSession struct {
+	Name          string
+	Target        string
+	InitiatorName string
+	Sid           string
+	Params        map[string]string
+	Connections   []ScstIscsiConnection
+}
+
+func ScstGetIscsiSession(target string, session string) (res ScstIscsiSession, err error) {
+	var (
+		connections []string
+	)
+	sessionPath := path.Join(SCST_ISCSI_TARGETS, target, "sessions", session)
+	res.Name = session
+	res.Target = target
+	if res.Params, err = readParamsFromDir(sessionPath); err != nil {
+		err = fmt.Errorf("ScstGetIscsiSession: cannot read session %s of target %s: %w", session, target, err)
+		return
+	}
+	res.InitiatorName = res.Params["initiator_name"]
+	if res.InitiatorName == "" {
+		res.InitiatorName = session
+	}
+	res.Sid = res.Params["sid"]
+	if connections, err = listSubDirs(sessionPath); err != nil {
+		err = fmt.Errorf("ScstGetIscsiSession: cannot list connections of session %s: %w", session, err)
+	} else {
+		for _, connection := range connections {
+			if params, err := readParamsFromDir(path.Join(sessionPath, connection)); err != nil {
+				log.Errorf("ScstGetIscsiSession: cannot read connection %s of session %s: %v", connection, session, err)
+			} else {
+				conn := ScstIscsiConnection{
+					Name:  connection,
+					Cid:   params["cid"],
+					Ip:    params["ip"],
+					State: params["state"],
+				}
+				if conn.Ip == "" {
+					conn.Ip = connection
+				}
+				res.Connections = append(res.Connections, conn)
+			}
+		}
+	}
+	return
+}
+
+func ScstGetIscsiSessions(target string) (res []ScstIscsiSession, err error) {
+	for _, name := range ScstGetIscsiTargetSessions(target) {
+		if session, err := ScstGetIscsiSession(target, name); err != nil {
+			log.Error(err.Error())
+		} else {
+			res = append(res, session)
+		}
+	}
+	return
+}
+
+func ScstCloseIscsiSession(target string, session string, timeout time.Duration) (err error) {
+	sessionPath := path.Join(SCST_ISCSI_TARGETS, target, "sessions", session)
+	if err = scstWriteAttr(path.Join(sessionPath, "force_close"), "1"); err != nil {
+		err = fmt.Errorf("ScstCloseIscsiSession: cannot close session %s of target %s: %w", session, target, err)
+		return
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		if !scstExists(sessionPath) {
+			err = nil
+			log.Printf("Session %s of target %s closed\n", session, target)
+			break
+		}
+		if time.Now().After(deadline) {
+			err = fmt.Errorf("ScstCloseIscsiSession: session %s of target %s still exists after %s: %w", session, target, timeout, syscall.EBUSY)
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return
+}
@@ -0,0 +1,448 @@
+package pk_scst
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const SCST_HANDLER_PARAMS_HELP string = "The following parameters available:"
+
+// ScstConfWrite is a single write to the SCST tree, either a command for a
+// mgmt file or the new value of an attribute.
+type ScstConfWrite struct {
+	Path  string
+	Value string
+}
+
+var scstShellQuoter = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`")
+
+// String renders the write as a shell command on the absolute path of the
+// attribute in the SCST tree in use.
+func (w ScstConfWrite) String() string {
+	name := filepath.Join(ScstRootDir(), filepath.FromSlash(w.Path))
+	return fmt.Sprintf(`echo "%s" >"%s"`, scstShellQuoter.Replace(w.Value), scstShellQuoter.Replace(name))
+}
+
+// scstConfPlan collects the writes by stage: everything that goes away is
+// removed before devices are replaced, targets are set up once their devices
+// exist and switched on last.
+type scstConfPlan struct {
+	remove     []ScstConfWrite
+	delDevices []ScstConfWrite
+	devices    []ScstConfWrite
+	targets    []ScstConfWrite
+	enable     []ScstConfWrite
+}
+
+func scstConfWrite(stage *[]ScstConfWrite, name string, format string, args ...interface{}) {
+	*stage = append(*stage, ScstConfWrite{Path: name, Value: fmt.Sprintf(format, args...)})
+}
+
+func (p *scstConfPlan) writes() (res []ScstConfWrite) {
+	for _, stage := range [][]ScstConfWrite{p.remove, p.delDevices, p.devices, p.targets, p.enable} {
+		res = append(res, stage...)
+	}
+	return
+}
+
+// ScstGetHandlerParams lists the parameters add_device of a handler takes,
+// as announced by the help text of its mgmt file.
+func ScstGetHandlerParams(handler string) (res []string, err error) {
+	var (
+		data []byte
+	)
+	if data, err = scstReadFile(ScstHandlerMgmt(handler)); err != nil {
+		return nil, fmt.Errorf("ScstGetHandlerParams: handler %s is not available: %w", handler, err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if params, found := strings.CutPrefix(strings.TrimSpace(line), SCST_HANDLER_PARAMS_HELP); found {
+			for _, param := range strings.Split(params, ",") {
+				if param = strings.TrimSpace(param); param != "" {
+					res = append(res, param)
+				}
+			}
+		}
+	}
+	return
+}
+
+func scstAttrValue(name string) (val string, ok bool) {
+	if data, err := scstReadFile(name); err == nil {
+		return strings.Split(string(data), "\n")[0], true
+	}
+	return
+}
+
+func scstWritable(name string) bool {
+	info, err := scstFs.Lstat(name)
+	return err == nil && info.Mode().Perm()&0200 != 0
+}
+
+// attr plans setting an attribute of an existing object when it differs.
+func (p *scstConfPlan) attr(stage *[]ScstConfWrite, name string, val string) (err error) {
+	if cur, ok := scstAttrValue(name); !ok {
+		err = fmt.Errorf("attribute %s does not exist", name)
+	} else if cur != val {
+		if !scstWritable(name) {
+			err = fmt.Errorf("attribute %s is read-only, it is %s and cannot be set to %s", name, cur, val)
+		} else {
+			scstConfWrite(stage, name, "%s", val)
+		}
+	}
+	return
+}
+
+func scstConfHasAttr(attrs []ScstConfAttr, name string) bool {
+	for _, attr := range attrs {
+		if attr.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func scstConfContains(list []string, val string) bool {
+	for _, v := range list {
+		if v == val {
+			return true
+		}
+	}
+	return false
+}
+
+// sameLunAttrs compares the attributes of a mapping, the ones SCST does not
+// list are at their default of 0.
+func sameLunAttrs(have []ScstConfAttr, want []ScstConfAttr) bool {
+	haveAttrs := map[string]string{}
+	for _, attr := range have {
+		haveAttrs[attr.Name] = attr.Value
+	}
+	for _, attr := range want {
+		val, ok := haveAttrs[attr.Name]
+		if !ok {
+			val = "0"
+		}
+		if val != attr.Value {
+			return false
+		}
+		delete(haveAttrs, attr.Name)
+	}
+	return len(haveAttrs) == 0
+}
+
+// luns plans the LUN changes of a target or group. Mappings of devices in
+// gone disappear with the device and are not removed on their own.
+func (p *scstConfPlan) luns(lunsPath string, have []ScstConfLun, want []ScstConfLun, gone map[string]bool) {
+	var (
+		params []string
+	)
+	mgmt := path.Join(lunsPath, "mgmt")
+	haveLuns := map[int]ScstConfLun{}
+	for _, lun := range have {
+		if !gone[lun.Device] {
+			haveLuns[lun.Lun] = lun
+		}
+	}
+	wantLuns := map[int]bool{}
+	for _, lun := range want {
+		wantLuns[lun.Lun] = true
+	}
+	for _, lun := range have {
+		if _, ok := haveLuns[lun.Lun]; ok && !wantLuns[lun.Lun] {
+			scstConfWrite(&p.remove, mgmt, "del %d", lun.Lun)
+		}
+	}
+	for _, lun := range want {
+		params = nil
+		for _, attr := range lun.Attrs {
+			params = append(params, attr.Name+"="+attr.Value)
+		}
+		cmd := strings.TrimSpace(fmt.Sprintf("%s %d %s", lun.Device, lun.Lun, strings.Join(params, " ")))
+		if cur, ok := haveLuns[lun.Lun]; !ok {
+			scstConfWrite(&p.targets, mgmt, "add %s", cmd)
+		} else if cur.Device != lun.Device || !sameLunAttrs(cur.Attrs, lun.Attrs) {
+			scstConfWrite(&p.targets, mgmt, "replace %s", cmd)
+		}
+	}
+}
+
+func (p *scstConfPlan) device(handler string, params []string, device *ScstConfDevice, have *ScstConfDevice, haveHandler string) (gone bool, err error) {
+	var (
+		create []string
+		stage  []ScstConfWrite
+	)
+	devPath := path.Join(SCST_DEVICES, device.Name)
+	if have != nil && haveHandler == handler {
+		values, _ := readParamsFromDir(devPath)
+		for _, attr := range device.Attrs {
+			if cur, ok := values[attr.Name]; ok && strings.Split(cur, "\n")[0] == attr.Value {
+				continue
+			} else if ok && scstWritable(path.Join(devPath, attr.Name)) {
+				scstConfWrite(&stage, path.Join(devPath, attr.Name), "%s", attr.Value)
+			} else if scstConfContains(params, attr.Name) {
+				gone = true
+			} else if err = p.attr(&stage, path.Join(devPath, attr.Name), attr.Value); err != nil {
+				return
+			}
+		}
+		// A creation parameter dropped from the configuration is back to its
+		// default only on a new device.
+		for _, attr := range have.Attrs {
+			if scstConfContains(params, attr.Name) && !scstConfHasAttr(device.Attrs, attr.Name) && !scstWritable(path.Join(devPath, attr.Name)) {
+				gone = true
+			}
+		}
+		if !gone {
+			p.devices = append(p.devices, stage...)
+			return
+		}
+	}
+	if have != nil {
+		gone = true
+		scstConfWrite(&p.delDevices, ScstHandlerMgmt(haveHandler), "del_device %s", device.Name)
+	}
+	for _, attr := range device.Attrs {
+		if scstConfContains(params, attr.Name) {
+			create = append(create, attr.Name+"="+attr.Value)
+		}
+	}
+	scstConfWrite(&p.devices, ScstHandlerMgmt(handler), "add_device %s %s", device.Name, strings.Join(create, "; "))
+	for _, attr := range device.Attrs {
+		if !scstConfContains(params, attr.Name) {
+			scstConfWrite(&p.devices, path.Join(devPath, attr.Name), "%s", attr.Value)
+		}
+	}
+	return
+}
+
+func scstConfMultiValue(name string) bool {
+	return scstConfContains(ScstMultiValueTargetAttrs, name)
+}
+
+func (p *scstConfPlan) target(target *ScstConfTarget, have *ScstConfTarget, gone map[string]bool) (err error) {
+	var (
+		enabled, wantEnabled string
+		haveValues           []ScstConfAttr
+	)
+	tgtPath := path.Join(SCST_ISCSI_TARGETS, target.Name)
+	created := have == nil
+	if created {
+		scstConfWrite(&p.targets, SCST_ISCSI_TARGETS_MGMT, "add_target %s", target.Name)
+		enabled = "0"
+		have = &ScstConfTarget{}
+	} else {
+		enabled, _ = scstAttrValue(path.Join(tgtPath, "enabled"))
+	}
+	wasEnabled := enabled
+	for _, attr := range have.Attrs {
+		if scstConfMultiValue(attr.Name) {
+			haveValues = append(haveValues, attr)
+		}
+	}
+	for _, attr := range target.Attrs {
+		switch {
+		case attr.Name == "enabled":
+			wantEnabled = attr.Value
+		case scstConfMultiValue(attr.Name):
+			continue
+		case created:
+			scstConfWrite(&p.targets, path.Join(tgtPath, attr.Name), "%s", attr.Value)
+		default:
+			if cur, _ := scstAttrValue(path.Join(tgtPath, attr.Name)); attr.Name == "rel_tgt_id" && cur != attr.Value && enabled == "1" {
+				// SCST only takes a new rel_tgt_id while the target is off.
+				scstConfWrite(&p.targets, path.Join(tgtPath, "enabled"), "0")
+				enabled = "0"
+			}
+			if err = p.attr(&p.targets, path.Join(tgtPath, attr.Name), attr.Value); err != nil {
+				return
+			}
+		}
+	}
+
+	// Values are matched whole, a changed secret is a remove and an add.
+	for _, attr := range haveValues {
+		if !scstConfHasValue(target.Attrs, attr) {
+			scstConfWrite(&p.remove, SCST_ISCSI_TARGETS_MGMT, "del_target_attribute %s %s %s", target.Name, attr.Name, strings.SplitN(attr.Value, " ", 2)[0])
+		}
+	}
+	for _, attr := range target.Attrs {
+		if scstConfMultiValue(attr.Name) && !scstConfHasValue(haveValues, attr) {
+			scstConfWrite(&p.targets, SCST_ISCSI_TARGETS_MGMT, "add_target_attribute %s %s %s", target.Name, attr.Name, attr.Value)
+		}
+	}
+
+	p.luns(path.Join(tgtPath, "luns"), have.Luns, target.Luns, gone)
+	groupsMgmt := path.Join(tgtPath, SYSFS_SCST_INI_GROUPS_MGMT)
+	haveGroups := map[string]*ScstConfGroup{}
+	for _, group := range have.Groups {
+		haveGroups[group.Name] = group
+	}
+	for _, group := range target.Groups {
+		haveGroup, ok := haveGroups[group.Name]
+		if !ok {
+			scstConfWrite(&p.targets, groupsMgmt, "create %s", group.Name)
+			haveGroup = &ScstConfGroup{}
+		}
+		delete(haveGroups, group.Name)
+		p.luns(scstLunsPath(target.Name, group.Name), haveGroup.Luns, group.Luns, gone)
+		initiatorsMgmt := path.Join(tgtPath, "ini_groups", group.Name, "initiators", "mgmt")
+		for _, initiator := range haveGroup.Initiators {
+			if !scstConfContains(group.Initiators, initiator) {
+				scstConfWrite(&p.remove, initiatorsMgmt, "del %s", initiator)
+			}
+		}
+		for _, initiator := range group.Initiators {
+			if !scstConfContains(haveGroup.Initiators, initiator) {
+				scstConfWrite(&p.targets, initiatorsMgmt, "add %s", initiator)
+			}
+		}
+	}
+	for _, group := range have.Groups {
+		if _, ok := haveGroups[group.Name]; ok {
+			scstConfWrite(&p.remove, groupsMgmt, "del %s", group.Name)
+		}
+	}
+
+	if wantEnabled == "" {
+		wantEnabled = wasEnabled
+	}
+	if wantEnabled != enabled {
+		scstConfWrite(&p.enable, path.Join(tgtPath, "enabled"), "%s", wantEnabled)
+	}
+	return
+}
+
+func scstConfHasValue(attrs []ScstConfAttr, want ScstConfAttr) bool {
+	for _, attr := range attrs {
+		if attr.Name == want.Name && strings.Join(strings.Fields(attr.Value), " ") == strings.Join(strings.Fields(want.Value), " ") {
+			return true
+		}
+	}
+	return false
+}
+
+// ScstPlanConfig works out the writes that turn the running SCST into conf.
+// Missing objects are created, differing ones changed and the ones conf
+// does not have removed. Devices are only removed from handlers conf
+// declares, the ones of other handlers, passthrough devices among them, are
+// left alone. Attributes conf does not mention are left as they are, unless
+// they can only be reset by creating the device again.
+func ScstPlanConfig(conf *ScstConfig) (writes []ScstConfWrite, err error) {
+	var (
+		have   *ScstConfig
+		plan   scstConfPlan
+		params []string
+		gone   bool
+	)
+	if have, err = ScstReadConfig(); err != nil {
+		return
+	}
+	for _, attr := range conf.Attrs {
+		if err = plan.attr(&plan.devices, attr.Name, attr.Value); err != nil {
+			return nil, fmt.Errorf("ScstPlanConfig: %w", err)
+		}
+	}
+
+	haveDevices := map[string]*ScstConfDevice{}
+	haveHandlers := map[string]string{}
+	for _, handler := range have.Handlers {
+		for _, device := range handler.Devices {
+			haveDevices[device.Name] = device
+			haveHandlers[device.Name] = handler.Name
+		}
+	}
+	wantDevices := map[string]bool{}
+	goneDevices := map[string]bool{}
+	declared := map[string]bool{}
+	for _, handler := range conf.Handlers {
+		declared[handler.Name] = true
+	}
+	for _, handler := range conf.Handlers {
+		if params, err = ScstGetHandlerParams(handler.Name); err != nil {
+			return nil, fmt.Errorf("ScstPlanConfig: %w", err)
+		}
+		for _, device := range handler.Devices {
+			wantDevices[device.Name] = true
+			if gone, err = plan.device(handler.Name, params, device, haveDevices[device.Name], haveHandlers[device.Name]); err != nil {
+				return nil, fmt.Errorf("ScstPlanConfig: device %s: %w", device.Name, err)
+			}
+			goneDevices[device.Name] = gone
+		}
+	}
+	var names []string
+	for name := range haveDevices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !wantDevices[name] && declared[haveHandlers[name]] {
+			goneDevices[name] = true
+			scstConfWrite(&plan.delDevices, ScstHandlerMgmt(haveHandlers[name]), "del_device %s", name)
+		}
+	}
+
+	haveTargets := map[string]*ScstConfTarget{}
+	for _, driver := range have.Drivers {
+		for _, target := range driver.Targets {
+			haveTargets[target.Name] = target
+		}
+	}
+	wantTargets := map[string]bool{}
+	for _, driver := range conf.Drivers {
+		if driver.Name != SCST_ISCSI_DRIVER {
+			return nil, fmt.Errorf("ScstPlanConfig: target driver %s is not supported", driver.Name)
+		}
+		for _, target := range driver.Targets {
+			luns := target.Luns
+			for _, group := range target.Groups {
+				luns = append(luns, group.Luns...)
+			}
+			for _, lun := range luns {
+				if kept := haveDevices[lun.Device] != nil && !declared[haveHandlers[lun.Device]]; !wantDevices[lun.Device] && !kept {
+					return nil, fmt.Errorf("ScstPlanConfig: target %s: LUN %d: device %s is not in the configuration", target.Name, lun.Lun, lun.Device)
+				}
+			}
+			wantTargets[target.Name] = true
+			if err = plan.target(target, haveTargets[target.Name], goneDevices); err != nil {
+				return nil, fmt.Errorf("ScstPlanConfig: target %s: %w", target.Name, err)
+			}
+		}
+		for _, attr := range driver.Attrs {
+			stage := &plan.targets
+			if attr.Name == "enabled" {
+				stage = &plan.enable
+			}
+			if err = plan.attr(stage, path.Join(SCST_ISCSI_TARGETS, attr.Name), attr.Value); err != nil {
+				return nil, fmt.Errorf("ScstPlanConfig: target driver %s: %w", driver.Name, err)
+			}
+		}
+	}
+	for _, driver := range have.Drivers {
+		for _, target := range driver.Targets {
+			if !wantTargets[target.Name] {
+				scstConfWrite(&plan.remove, SCST_ISCSI_TARGETS_MGMT, "del_target %s", target.Name)
+			}
+		}
+	}
+	return plan.writes(), nil
+}
+
+// ScstApplyConfig performs planned writes in order and calls report after
+// each one that succeeded.
+func ScstApplyConfig(writes []ScstConfWrite, report func(w ScstConfWrite)) (err error) {
+	for _, w := range writes {
+		if path.Base(w.Path) == "mgmt" {
+			err = scstMgmtCmd(w.Path, w.Value)
+		} else if err = scstWriteAttr(w.Path, w.Value); err != nil {
+			err = fmt.Errorf("cannot write \"%s\" to %s: %w", w.Value, w.Path, err)
+		}
+		if err != nil {
+			return fmt.Errorf("ScstApplyConfig: %w", err)
+		}
+		report(w)
+	}
+	return
+}
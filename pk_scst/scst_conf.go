@@ -0,0 +1,558 @@
+package pk_scst
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const SCST_ISCSI_DRIVER string = "iscsi"
+
+// Target attributes that can be set several times, SCST keeps them in
+// attr, attr1, attr2 and so on.
+var ScstMultiValueTargetAttrs = []string{"IncomingUser", "OutgoingUser", "allowed_portal"}
+
+type ScstConfAttr struct {
+	Name  string
+	Value string
+}
+
+type ScstConfDevice struct {
+	Name  string
+	Attrs []ScstConfAttr
+}
+
+type ScstConfHandler struct {
+	Name    string
+	Devices []*ScstConfDevice
+}
+
+type ScstConfLun struct {
+	Lun    int
+	Device string
+	Attrs  []ScstConfAttr
+}
+
+type ScstConfGroup struct {
+	Name       string
+	Luns       []ScstConfLun
+	Initiators []string
+}
+
+type ScstConfTarget struct {
+	Name   string
+	Attrs  []ScstConfAttr
+	Luns   []ScstConfLun
+	Groups []*ScstConfGroup
+}
+
+type ScstConfDriver struct {
+	Name    string
+	Attrs   []ScstConfAttr
+	Targets []*ScstConfTarget
+}
+
+// ScstConfig is the configuration scstadmin keeps in scst.conf.
+type ScstConfig struct {
+	Attrs    []ScstConfAttr
+	Handlers []*ScstConfHandler
+	Drivers  []*ScstConfDriver
+}
+
+// readKeyAttrs returns the attributes of dirpath that SCST marks with
+// [key], the ones that differ from the defaults and go to scst.conf.
+func readKeyAttrs(dirpath string) (res map[string]string, err error) {
+	var (
+		entries []fs.DirEntry
+		data    []byte
+	)
+	res = map[string]string{}
+	if entries, err = scstReadDir(dirpath); err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || entry.Type()&fs.ModeSymlink != 0 {
+			continue
+		}
+		if data, err = scstReadFile(path.Join(dirpath, entry.Name())); err != nil {
+			err = nil
+			continue
+		}
+		if lines := strings.Split(string(data), "\n"); len(lines) > 1 && lines[1] == "[key]" {
+			res[entry.Name()] = lines[0]
+		}
+	}
+	return
+}
+
+func scstConfAttrs(attrs map[string]string) (res []ScstConfAttr) {
+	var (
+		names []string
+	)
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		res = append(res, ScstConfAttr{Name: name, Value: attrs[name]})
+	}
+	return
+}
+
+func scstConfLuns(wwn string, group string, luns []ScstLun) (res []ScstConfLun) {
+	for _, lun := range luns {
+		attrs, _ := readKeyAttrs(path.Join(scstLunsPath(wwn, group), strconv.Itoa(lun.Lun)))
+		res = append(res, ScstConfLun{Lun: lun.Lun, Device: lun.Device.Name, Attrs: scstConfAttrs(attrs)})
+	}
+	return
+}
+
+// ScstReadConfig walks the handlers, devices, iSCSI targets, initiator
+// groups and LUN mappings of the running SCST.
+func ScstReadConfig() (conf *ScstConfig, err error) {
+	var (
+		handlers []string
+		entries  []fs.DirEntry
+		targets  []string
+		groups   []string
+		attrs    map[string]string
+	)
+	conf = &ScstConfig{}
+	if attrs, err = readKeyAttrs(""); err != nil {
+		return nil, fmt.Errorf("ScstReadConfig: cannot read SCST attributes: %w", err)
+	}
+	conf.Attrs = scstConfAttrs(attrs)
+	if handlers, err = listSubDirs(SCST_HANDLERS); err != nil {
+		return nil, fmt.Errorf("ScstReadConfig: cannot read handlers: %w", err)
+	}
+	for _, name := range handlers {
+		handler := &ScstConfHandler{Name: name}
+		if entries, err = scstReadDir(path.Join(SCST_HANDLERS, name)); err != nil {
+			return nil, fmt.Errorf("ScstReadConfig: cannot read handler %s: %w", name, err)
+		}
+		for _, entry := range entries {
+			if entry.Type()&fs.ModeSymlink == 0 {
+				continue
+			}
+			if attrs, err = readKeyAttrs(path.Join(SCST_DEVICES, entry.Name())); err != nil {
+				return nil, fmt.Errorf("ScstReadConfig: cannot read device %s: %w", entry.Name(), err)
+			}
+			handler.Devices = append(handler.Devices, &ScstConfDevice{Name: entry.Name(), Attrs: scstConfAttrs(attrs)})
+		}
+		if len(handler.Devices) > 0 {
+			conf.Handlers = append(conf.Handlers, handler)
+		}
+	}
+
+	driver := &ScstConfDriver{Name: SCST_ISCSI_DRIVER}
+	if enabled, err := scstReadFile(path.Join(SCST_ISCSI_TARGETS, "enabled")); err == nil {
+		driver.Attrs = append(driver.Attrs, ScstConfAttr{Name: "enabled", Value: strings.Split(string(enabled), "\n")[0]})
+	}
+	if targets, err = ScstGetIscsiTargets(); err != nil {
+		return nil, fmt.Errorf("ScstReadConfig: %w", err)
+	}
+	for _, wwn := range targets {
+		target := &ScstConfTarget{Name: wwn}
+		if attrs, err = readKeyAttrs(path.Join(SCST_ISCSI_TARGETS, wwn)); err != nil {
+			return nil, fmt.Errorf("ScstReadConfig: cannot read target %s: %w", wwn, err)
+		}
+		for name := range attrs {
+			for _, multi := range ScstMultiValueTargetAttrs {
+				if n := strings.TrimPrefix(name, multi); n != name {
+					if _, err := strconv.Atoi(n); n == "" || err == nil {
+						delete(attrs, name)
+					}
+				}
+			}
+		}
+		// LUN IDs follow rel_tgt_id, keep it even when SCST picked it.
+		for _, name := range []string{"enabled", "rel_tgt_id"} {
+			if val, err := ScstGetIscsiTargetParam(wwn, name); err == nil && val != "" {
+				attrs[name] = val
+			}
+		}
+		target.Attrs = scstConfAttrs(attrs)
+		for _, multi := range ScstMultiValueTargetAttrs {
+			values, _ := ScstGetIscsiTargetAttrValues(wwn, multi)
+			for _, val := range values {
+				target.Attrs = append(target.Attrs, ScstConfAttr{Name: multi, Value: val})
+			}
+		}
+		if luns, err := ScstGetGroupLuns(wwn, ""); err != nil {
+			return nil, fmt.Errorf("ScstReadConfig: %w", err)
+		} else {
+			target.Luns = scstConfLuns(wwn, "", luns)
+		}
+		if groups, err = listSubDirs(path.Join(SCST_ISCSI_TARGETS, wwn, "ini_groups")); err != nil {
+			return nil, fmt.Errorf("ScstReadConfig: cannot read groups of target %s: %w", wwn, err)
+		}
+		for _, name := range groups {
+			group := &ScstConfGroup{Name: name}
+			if luns, err := ScstGetGroupLuns(wwn, name); err != nil {
+				return nil, fmt.Errorf("ScstReadConfig: %w", err)
+			} else {
+				group.Luns = scstConfLuns(wwn, name, luns)
+			}
+			if group.Initiators, err = ScstGetIniGroupInitiators(wwn, name); err != nil {
+				return nil, fmt.Errorf("ScstReadConfig: %w", err)
+			}
+			sort.Strings(group.Initiators)
+			target.Groups = append(target.Groups, group)
+		}
+		driver.Targets = append(driver.Targets, target)
+	}
+	conf.Drivers = append(conf.Drivers, driver)
+	return
+}
+
+// scstConfValue quotes values scstadmin would otherwise split.
+func scstConfValue(val string) string {
+	if val == "" || strings.ContainsAny(val, " \t#{}\"") {
+		return strconv.Quote(val)
+	}
+	return val
+}
+
+func writeScstConfAttrs(w io.Writer, indent string, attrs []ScstConfAttr) {
+	for _, attr := range attrs {
+		fmt.Fprintf(w, "%s%s %s\n", indent, attr.Name, scstConfValue(attr.Value))
+	}
+}
+
+func writeScstConfLuns(w io.Writer, indent string, luns []ScstConfLun) {
+	for _, lun := range luns {
+		if len(lun.Attrs) == 0 {
+			fmt.Fprintf(w, "%sLUN %d %s\n", indent, lun.Lun, lun.Device)
+		} else {
+			fmt.Fprintf(w, "%sLUN %d %s {\n", indent, lun.Lun, lun.Device)
+			writeScstConfAttrs(w, indent+"\t", lun.Attrs)
+			fmt.Fprintf(w, "%s}\n", indent)
+		}
+	}
+}
+
+// Write writes the configuration in the scst.conf format read by
+// scstadmin -config.
+func (conf *ScstConfig) Write(w io.Writer) (err error) {
+	var (
+		b strings.Builder
+	)
+	fmt.Fprintf(&b, "# Automatically generated by ctladm.\n")
+	if len(conf.Attrs) > 0 {
+		b.WriteString("\n")
+		writeScstConfAttrs(&b, "", conf.Attrs)
+	}
+	for _, handler := range conf.Handlers {
+		fmt.Fprintf(&b, "\nHANDLER %s {\n", handler.Name)
+		for i, device := range handler.Devices {
+			if i > 0 {
+				b.WriteString("\n")
+			}
+			fmt.Fprintf(&b, "\tDEVICE %s {\n", device.Name)
+			writeScstConfAttrs(&b, "\t\t", device.Attrs)
+			b.WriteString("\t}\n")
+		}
+		b.WriteString("}\n")
+	}
+	for _, driver := range conf.Drivers {
+		fmt.Fprintf(&b, "\nTARGET_DRIVER %s {\n", driver.Name)
+		writeScstConfAttrs(&b, "\t", driver.Attrs)
+		for _, target := range driver.Targets {
+			fmt.Fprintf(&b, "\n\tTARGET %s {\n", target.Name)
+			writeScstConfAttrs(&b, "\t\t", target.Attrs)
+			if len(target.Luns) > 0 {
+				b.WriteString("\n")
+				writeScstConfLuns(&b, "\t\t", target.Luns)
+			}
+			for _, group := range target.Groups {
+				fmt.Fprintf(&b, "\n\t\tGROUP %s {\n", group.Name)
+				writeScstConfLuns(&b, "\t\t\t", group.Luns)
+				if len(group.Luns) > 0 && len(group.Initiators) > 0 {
+					b.WriteString("\n")
+				}
+				for _, initiator := range group.Initiators {
+					fmt.Fprintf(&b, "\t\t\tINITIATOR %s\n", initiator)
+				}
+				b.WriteString("\t\t}\n")
+			}
+			b.WriteString("\t}\n")
+		}
+		b.WriteString("}\n")
+	}
+	_, err = io.WriteString(w, b.String())
+	return
+}
+
+// scstConfLine is one statement of scst.conf, open is set when it starts a
+// { block and close for the lone } ending one.
+type scstConfLine struct {
+	num    int
+	fields []string
+	open   bool
+	close  bool
+}
+
+// splitScstConfLine splits a line into words. "Quoted" values keep their
+// blanks and # starts a comment.
+func splitScstConfLine(num int, text string) (line scstConfLine, err error) {
+	line.num = num
+	for i := 0; i < len(text); {
+		switch c := text[i]; {
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#':
+			i = len(text)
+		case line.open || line.close:
+			return line, fmt.Errorf("line %d: unexpected %q after brace", num, text[i:])
+		case c == '{':
+			if len(line.fields) == 0 {
+				return line, fmt.Errorf("line %d: { must follow the statement it opens", num)
+			}
+			line.open = true
+			i++
+		case c == '}':
+			if len(line.fields) > 0 {
+				return line, fmt.Errorf("line %d: } must be on its own line", num)
+			}
+			line.close = true
+			i++
+		case c == '"':
+			j := i + 1
+			for ; j < len(text) && text[j] != '"'; j++ {
+				if text[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(text) {
+				return line, fmt.Errorf("line %d: unterminated quoted string", num)
+			}
+			if val, err := strconv.Unquote(text[i : j+1]); err != nil {
+				return line, fmt.Errorf("line %d: bad quoted string %s", num, text[i:j+1])
+			} else {
+				line.fields = append(line.fields, val)
+			}
+			i = j + 1
+		default:
+			j := i
+			for j < len(text) && !strings.ContainsRune(" \t\r#\"{}", rune(text[j])) {
+				j++
+			}
+			line.fields = append(line.fields, text[i:j])
+			i = j
+		}
+	}
+	return
+}
+
+type scstConfParser struct {
+	lines []scstConfLine
+	pos   int
+}
+
+// block hands the statements of the block opened by line to fn. Statements
+// without a block are fine, they just have nothing inside.
+func (p *scstConfParser) block(line scstConfLine, fn func(l scstConfLine) error) (err error) {
+	if !line.open {
+		return
+	}
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		p.pos++
+		if l.close {
+			return
+		}
+		if err = fn(l); err != nil {
+			return
+		}
+	}
+	return fmt.Errorf("line %d: %s block is not closed", line.num, line.fields[0])
+}
+
+func scstConfAttr(l scstConfLine) (attr ScstConfAttr, err error) {
+	if l.open {
+		return attr, fmt.Errorf("line %d: unexpected block after %s", l.num, l.fields[0])
+	}
+	return ScstConfAttr{Name: l.fields[0], Value: strings.Join(l.fields[1:], " ")}, nil
+}
+
+// scstConfName checks that a keyword is followed by exactly count words.
+func scstConfName(l scstConfLine, count int) (err error) {
+	if len(l.fields) != count+1 {
+		err = fmt.Errorf("line %d: %s takes %d arguments", l.num, l.fields[0], count)
+	}
+	return
+}
+
+func (p *scstConfParser) lun(l scstConfLine, luns []ScstConfLun) (res []ScstConfLun, err error) {
+	var (
+		lun ScstConfLun
+	)
+	if err = scstConfName(l, 2); err != nil {
+		return
+	}
+	if lun.Lun, err = strconv.Atoi(l.fields[1]); err != nil || lun.Lun < 0 {
+		return nil, fmt.Errorf("line %d: bad LUN number %s", l.num, l.fields[1])
+	}
+	for _, other := range luns {
+		if other.Lun == lun.Lun {
+			return nil, fmt.Errorf("line %d: LUN %d is defined twice", l.num, lun.Lun)
+		}
+	}
+	lun.Device = l.fields[2]
+	err = p.block(l, func(l scstConfLine) (err error) {
+		var (
+			attr ScstConfAttr
+		)
+		if attr, err = scstConfAttr(l); err == nil {
+			lun.Attrs = append(lun.Attrs, attr)
+		}
+		return
+	})
+	return append(luns, lun), err
+}
+
+func (p *scstConfParser) group(l scstConfLine, target *ScstConfTarget) (err error) {
+	if err = scstConfName(l, 1); err != nil {
+		return
+	}
+	for _, other := range target.Groups {
+		if other.Name == l.fields[1] {
+			return fmt.Errorf("line %d: group %s is defined twice", l.num, l.fields[1])
+		}
+	}
+	group := &ScstConfGroup{Name: l.fields[1]}
+	target.Groups = append(target.Groups, group)
+	return p.block(l, func(l scstConfLine) (err error) {
+		switch l.fields[0] {
+		case "LUN":
+			group.Luns, err = p.lun(l, group.Luns)
+		case "INITIATOR":
+			if err = scstConfName(l, 1); err == nil {
+				group.Initiators = append(group.Initiators, l.fields[1])
+			}
+		default:
+			err = fmt.Errorf("line %d: unknown group statement %s", l.num, l.fields[0])
+		}
+		return
+	})
+}
+
+func (p *scstConfParser) target(l scstConfLine, driver *ScstConfDriver) (err error) {
+	if err = scstConfName(l, 1); err != nil {
+		return
+	}
+	target := &ScstConfTarget{Name: l.fields[1]}
+	driver.Targets = append(driver.Targets, target)
+	return p.block(l, func(l scstConfLine) (err error) {
+		var (
+			attr ScstConfAttr
+		)
+		switch l.fields[0] {
+		case "LUN":
+			target.Luns, err = p.lun(l, target.Luns)
+		case "GROUP":
+			err = p.group(l, target)
+		default:
+			if attr, err = scstConfAttr(l); err == nil {
+				target.Attrs = append(target.Attrs, attr)
+			}
+		}
+		return
+	})
+}
+
+// ParseScstConfig reads a configuration in the scst.conf format written by
+// scstadmin -write_config.
+func ParseScstConfig(data []byte) (conf *ScstConfig, err error) {
+	var (
+		p       scstConfParser
+		line    scstConfLine
+		devices = map[string]bool{}
+		targets = map[string]bool{}
+	)
+	for i, text := range strings.Split(string(data), "\n") {
+		if line, err = splitScstConfLine(i+1, text); err != nil {
+			return
+		}
+		if len(line.fields) > 0 || line.close {
+			p.lines = append(p.lines, line)
+		}
+	}
+	conf = &ScstConfig{}
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		p.pos++
+		switch {
+		case l.close:
+			err = fmt.Errorf("line %d: unexpected }", l.num)
+		case l.fields[0] == "HANDLER":
+			if err = scstConfName(l, 1); err != nil {
+				break
+			}
+			handler := &ScstConfHandler{Name: l.fields[1]}
+			conf.Handlers = append(conf.Handlers, handler)
+			err = p.block(l, func(l scstConfLine) (err error) {
+				if l.fields[0] != "DEVICE" {
+					return fmt.Errorf("line %d: unknown handler statement %s", l.num, l.fields[0])
+				}
+				if err = scstConfName(l, 1); err != nil {
+					return
+				}
+				if devices[l.fields[1]] {
+					return fmt.Errorf("line %d: device %s is defined twice", l.num, l.fields[1])
+				}
+				devices[l.fields[1]] = true
+				device := &ScstConfDevice{Name: l.fields[1]}
+				handler.Devices = append(handler.Devices, device)
+				return p.block(l, func(l scstConfLine) (err error) {
+					var (
+						attr ScstConfAttr
+					)
+					if attr, err = scstConfAttr(l); err == nil {
+						device.Attrs = append(device.Attrs, attr)
+					}
+					return
+				})
+			})
+		case l.fields[0] == "TARGET_DRIVER":
+			if err = scstConfName(l, 1); err != nil {
+				break
+			}
+			driver := &ScstConfDriver{Name: l.fields[1]}
+			conf.Drivers = append(conf.Drivers, driver)
+			err = p.block(l, func(l scstConfLine) (err error) {
+				var (
+					attr ScstConfAttr
+				)
+				if l.fields[0] == "TARGET" {
+					if len(l.fields) > 1 && targets[driver.Name+"/"+l.fields[1]] {
+						return fmt.Errorf("line %d: target %s is defined twice", l.num, l.fields[1])
+					}
+					if err = p.target(l, driver); err == nil {
+						targets[driver.Name+"/"+l.fields[1]] = true
+					}
+				} else if attr, err = scstConfAttr(l); err == nil {
+					driver.Attrs = append(driver.Attrs, attr)
+				}
+				return
+			})
+		case l.fields[0] == "DEVICE_GROUP":
+			err = fmt.Errorf("line %d: %s is not supported", l.num, l.fields[0])
+		default:
+			var (
+				attr ScstConfAttr
+			)
+			if attr, err = scstConfAttr(l); err == nil {
+				conf.Attrs = append(conf.Attrs, attr)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return
+}
@@ -0,0 +1,158 @@
+package pk_scst
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ScstFS is the view of the SCST sysfs tree used by the library. Names are
+// slash separated and relative to the SCST root, e.g. "devices/disk1/size".
+// Readlink returns the raw link target, relative targets are resolved
+// against the directory of the link.
+type ScstFS interface {
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte) error
+	ReadDir(name string) ([]fs.DirEntry, error)
+	Lstat(name string) (fs.FileInfo, error)
+	Readlink(name string) (string, error)
+}
+
+type ScstOsFS struct {
+	Root string
+}
+
+func NewScstOsFS(root string) *ScstOsFS {
+	return &ScstOsFS{Root: root}
+}
+
+// Dir returns the directory the tree lives in.
+func (f *ScstOsFS) Dir() string {
+	return f.Root
+}
+
+func (f *ScstOsFS) path(name string) string {
+	return filepath.Join(f.Root, filepath.FromSlash(name))
+}
+
+func (f *ScstOsFS) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(f.path(name))
+}
+
+func (f *ScstOsFS) WriteFile(name string, data []byte) (err error) {
+	var (
+		attr *os.File
+	)
+	if attr, err = os.OpenFile(f.path(name), os.O_WRONLY, 0644); err == nil {
+		defer attr.Close()
+		_, err = attr.Write(data)
+	}
+	return
+}
+
+func (f *ScstOsFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(f.path(name))
+}
+
+func (f *ScstOsFS) Lstat(name string) (fs.FileInfo, error) {
+	return os.Lstat(f.path(name))
+}
+
+func (f *ScstOsFS) Readlink(name string) (res string, err error) {
+	if res, err = os.Readlink(f.path(name)); err == nil && filepath.IsAbs(res) {
+		if res, err = filepath.Rel(f.Root, res); err != nil {
+			err = &fs.PathError{Op: "readlink", Path: name, Err: err}
+		} else {
+			res = "/" + filepath.ToSlash(res)
+		}
+	}
+	return filepath.ToSlash(res), err
+}
+
+var scstFs ScstFS = NewScstOsFS(SCST_ROOT_PATH)
+
+func ScstSetFS(f ScstFS) {
+	scstFs = f
+}
+
+func ScstGetFS() ScstFS {
+	return scstFs
+}
+
+func ScstSetRoot(root string) {
+	scstFs = NewScstOsFS(root)
+}
+
+// ScstRootDir returns the directory of the SCST tree in use, SCST_ROOT_PATH
+// when the tree does not live in a directory.
+func ScstRootDir() string {
+	if f, ok := scstFs.(interface{ Dir() string }); ok {
+		return f.Dir()
+	}
+	return SCST_ROOT_PATH
+}
+
+func scstReadFile(name string) ([]byte, error) {
+	return scstFs.ReadFile(name)
+}
+
+func scstReadDir(name string) ([]fs.DirEntry, error) {
+	return scstFs.ReadDir(name)
+}
+
+func scstExists(name string) bool {
+	_, err := scstFs.Lstat(name)
+	return err == nil
+}
+
+// scstEvalSymlinks resolves every link in name. Absolute link targets are
+// taken relative to the SCST root, links leaving the root are an error.
+func scstEvalSymlinks(name string) (res string, err error) {
+	var (
+		info   fs.FileInfo
+		target string
+	)
+	pending := strings.Split(path.Clean(name), "/")
+	for hops := 0; len(pending) > 0; {
+		elem := pending[0]
+		pending = pending[1:]
+		switch elem {
+		case "", ".":
+			continue
+		case "..":
+			if res == "" || res == ".." || strings.HasSuffix(res, "/..") {
+				return "", &fs.PathError{Op: "evalsymlinks", Path: name, Err: fs.ErrNotExist}
+			}
+			res = path.Dir(res)
+			if res == "." {
+				res = ""
+			}
+			continue
+		}
+		next := path.Join(res, elem)
+		if info, err = scstFs.Lstat(next); err != nil {
+			return "", err
+		}
+		if info.Mode()&fs.ModeSymlink == 0 {
+			res = next
+			continue
+		}
+		if hops++; hops > 255 {
+			return "", &fs.PathError{Op: "evalsymlinks", Path: name, Err: errors.New("too many links")}
+		}
+		if target, err = scstFs.Readlink(next); err != nil {
+			return "", err
+		}
+		if strings.HasPrefix(target, "/") {
+			res = ""
+		}
+		pending = append(strings.Split(target, "/"), pending...)
+	}
+	if res == "" {
+		res = "."
+	}
+	return
+}
@@ -0,0 +1,531 @@
+#!/bin/sh
+# End to end checks of ctladm against the SCST simulator.
+# Usage: pk_scstsim/integration.sh [path to ctladm built with -tags scstsim]
+
+set -u
+
+WORK=$(mktemp -d)
+trap 'rm -rf "$WORK"' EXIT
+FAILED=0
+
+if [ $# -gt 0 ]; then
+	CTLADM=$1
+else
+	CTLADM=$WORK/ctladm
+	(cd "$(dirname "$0")/.." && go build -tags scstsim -o "$CTLADM" .) || exit 1
+fi
+SCSTSIM=$WORK/scstsim
+(cd "$(dirname "$0")/.." && go build -o "$SCSTSIM" ./scstsim) || exit 1
+
+export CTLADM_SCST_ROOT=$WORK/scst
+export CTLADM_CONFIG=$WORK/ctladm.conf
+export CTLADM_DEBUG=true
+IQN=iqn.2022-10.net.playkey.sds
+cd "$WORK" || exit 1
+mkdir vol
+truncate -s 10M vol/disk1
+truncate -s 20M vol/disk2
+
+# run <expected exit code> <ctladm args...>, output is left in $WORK/out
+run() {
+	expected=$1
+	shift
+	"$CTLADM" "$@" >out 2>err
+	rc=$?
+	if [ "$rc" -ne "$expected" ]; then
+		echo "FAIL: ctladm $*: exit code $rc, expected $expected"
+		cat out err
+		FAILED=1
+	fi
+}
+
+expect_out() {
+	if ! printf '%s\n' "$1" | cmp -s - out; then
+		echo "FAIL: unexpected output of ctladm $2"
+		printf '%s\n' "$1" | diff - out
+		FAILED=1
+	fi
+}
+
+expect_grep() {
+	if ! grep -qF -- "$1" "$2"; then
+		echo "FAIL: $2 does not contain \"$1\""
+		cat "$2"
+		FAILED=1
+	fi
+}
+
+expect_attr() {
+	val=$(head -n 1 "$CTLADM_SCST_ROOT/$1" 2>/dev/null)
+	if [ "$val" != "$2" ]; then
+		echo "FAIL: $1 is \"$val\", expected \"$2\""
+		FAILED=1
+	fi
+}
+
+run 0 create -o file="$WORK/vol/disk1" -o serial_number=SN1
+expect_grep "LUN created successfully" out
+expect_grep "LUN ID:        1" out
+expect_attr "targets/iscsi/$IQN:disk1/rel_tgt_id" 1
+expect_attr "targets/iscsi/$IQN:disk1/enabled" 1
+expect_attr "devices/disk1/active" 1
+
+run 0 create -o file="$WORK/vol/disk2" -o ctld_name="$IQN:disk2,lun,0" -l 5
+expect_attr "targets/iscsi/$IQN:disk2/rel_tgt_id" 5
+
+run 75 create -o file="$WORK/vol/disk2" -d disk3 -l 5
+expect_grep "LUN creation error: requested LUN ID 5 is already in use" err
+run 66 create -o file="$WORK/vol/missing"
+run 64 create -b ramdisk -o file="$WORK/vol/disk1"
+
+# a failed create leaves SCST as it was, a value SCST refuses is not a usage error
+run 1 create -o file="$WORK/vol/disk2" -d disk3 -o num_threads=-1
+if [ -e "$CTLADM_SCST_ROOT/devices/disk3" ] || [ -e "$CTLADM_SCST_ROOT/targets/iscsi/$IQN:disk3" ]; then
+	echo "FAIL: device or target of a failed create left behind"
+	FAILED=1
+fi
+run 64 create -o file="$WORK/vol/disk2" -d disk3 -o num_thread=4
+expect_grep "option num_thread is not supported by vdisk_blockio" err
+if [ -e "$CTLADM_SCST_ROOT/devices/disk3" ]; then
+	echo "FAIL: device created with an unknown option"
+	FAILED=1
+fi
+run 1 create -o file="$WORK/vol/disk2" -d disk3 -o ctld_name="$IQN:disk1,lun,0" -l 7 -o num_threads=-1
+expect_attr "targets/iscsi/$IQN:disk1/rel_tgt_id" 1
+expect_attr "targets/iscsi/$IQN:disk1/enabled" 1
+if [ "$(basename "$(readlink "$CTLADM_SCST_ROOT/targets/iscsi/$IQN:disk1/ini_groups/allowed_ini/luns/0/device")")" != disk1 ]; then
+	echo "FAIL: LUN 0 of $IQN:disk1 not restored after a failed create"
+	FAILED=1
+fi
+
+run 0 devlist
+expect_out "$(printf '1\tblock\t20480\t512\tSN1\tdisk1\t%s\t%s\t1\t0\n5\tblock\t40960\t512\t%s\tdisk2\t%s\t%s\t1\t0' \
+	"$WORK/vol/disk1" "$IQN:disk1" "$(head -n 1 "$CTLADM_SCST_ROOT/devices/disk2/usn")" "$WORK/vol/disk2" "$IQN:disk2")" devlist
+
+run 0 devlist -x
+expect_grep '<lun id="1">' out
+expect_grep "<file>$WORK/vol/disk2</file>" out
+expect_grep "<ctld_name>$IQN:disk2,lun,0</ctld_name>" out
+expect_grep "<vendor>FREE_TT</vendor>" out
+expect_grep "<product>disk2</product>" out
+if grep -q "<nv_cache>" out; then
+	echo "FAIL: devlist -x prints options other than vendor, product and revision"
+	FAILED=1
+fi
+run 0 devlist -x -v
+for element in size blocksize serial_number device_id file; do
+	if [ "$(grep -c "<$element>" out)" -ne 2 ]; then
+		echo "FAIL: devlist -x -v repeats <$element>"
+		FAILED=1
+	fi
+done
+expect_grep "<vendor>FREE_TT</vendor>" out
+
+run 0 portlist
+expect_grep "$IQN:disk1,t,0x0101" out
+run 0 portlist -l -p 5
+expect_grep "LUN 0: 5" out
+run 0 portlist -x
+expect_grep "<target>$IQN:disk2</target>" out
+
+run 0 devlist --json
+expect_grep '"size": 40960,' out
+expect_grep "\"ctld_name\": \"$IQN:disk2,lun,0\"" out
+run 0 portlist --format json -p 5
+expect_grep '"online": true,' out
+expect_grep '"lun": 0,' out
+run 0 islist --json
+expect_out '{
+  "sessions": []
+}' "islist --json"
+run 64 devlist -x --json
+run 0 devlist --template '{{.Id}} {{.File}} {{human (bytes .Size .Blocksize)}} {{index .Options "vendor"}}'
+expect_out "$(printf '1 %s 10M FREE_TT\n5 %s 20M FREE_TT' "$WORK/vol/disk1" "$WORK/vol/disk2")" "devlist --template"
+printf '{{.Target}}\t{{join .Luns ","}}\n' >tmpl
+run 0 portlist --template-file tmpl
+expect_out "$(printf '%s\t0:1\n%s\t0:5' "$IQN:disk1" "$IQN:disk2")" "portlist --template-file"
+run 64 portlist --template '{{.Bogus}}'
+run 64 devlist --json --template '{{.Id}}'
+
+# initiators logged into the simulator
+"$SCSTSIM" login "$IQN:disk1" iqn.1994-09.org.freebsd:host1 10.0.0.11 >/dev/null || FAILED=1
+"$SCSTSIM" login "$IQN:disk2" iqn.1994-09.org.freebsd:host2 10.0.0.12 >/dev/null || FAILED=1
+run 0 islist
+expect_grep "iqn.1994-09.org.freebsd:host1" out
+expect_grep "10.0.0.12" out
+run 0 islist -l 5
+if grep -q "host1" out; then
+	echo "FAIL: islist -l 5 lists a session of another port"
+	FAILED=1
+fi
+expect_grep "iqn.1994-09.org.freebsd:host2" out
+run 0 portlist -i -p 1
+expect_grep "iqn.1994-09.org.freebsd:host1,i,0x" out
+run 0 islogout -i iqn.1994-09.org.freebsd:host1
+expect_grep "iSCSI logout requests completed" out
+if [ -e "$CTLADM_SCST_ROOT/targets/iscsi/$IQN:disk1/sessions/iqn.1994-09.org.freebsd:host1" ]; then
+	echo "FAIL: islogout left the session of host1"
+	FAILED=1
+fi
+run 66 islogout -i iqn.1994-09.org.freebsd:host1
+expect_grep "No matching connections found" err
+
+run 0 modify -l 1 -o size=15M
+expect_grep "LUN modified successfully" out
+expect_attr "devices/disk1/size" 15728640
+if [ "$(wc -c <"$WORK/vol/disk1")" -ne 15728640 ]; then
+	echo "FAIL: modify -o size did not grow $WORK/vol/disk1"
+	FAILED=1
+fi
+run 64 modify -l 1 -o size=5M
+run 64 modify -l 1 -o num_threads=4 -o bogus=1
+expect_grep "option bogus is not supported by vdisk_blockio" err
+expect_attr "devices/disk1/threads_num" 1
+run 64 modify -l 1 -o readonly=on
+expect_grep "option readonly can only be set when the LUN is created" err
+
+run 0 remove -b block -l 1
+expect_grep "LUN 1 (disk1) deactivated" out
+expect_attr "devices/disk1/active" 0
+
+run 0 remove -b block -l 5 --purge --delete-target
+expect_grep "LUN 5 removed successfully" out
+expect_grep "(iqn.1994-09.org.freebsd:host2) on $IQN:disk2 closed" out
+if [ -e "$CTLADM_SCST_ROOT/devices/disk2" ] || [ -e "$CTLADM_SCST_ROOT/targets/iscsi/$IQN:disk2" ]; then
+	echo "FAIL: device or target of LUN 5 left behind"
+	FAILED=1
+fi
+
+run 66 remove -b block -l 9
+expect_grep "ctladm: LUN removal error: LUN 9 is not managed by the block backend" err
+run 64 remove -b block
+
+run 0 devlist
+expect_out "$(printf '1\tblock\t30720\t512\tSN1\tdisk1\t%s\t%s\t1\t0' "$WORK/vol/disk1" "$IQN:disk1")" devlist
+
+# LUN IDs of devices without a LUN 0 export stay put when targets are added
+export CTLADM_SCST_ROOT=$WORK/scst-ids
+truncate -s 10M vol/id1 vol/id2 vol/id3
+run 0 create -o file="$WORK/vol/id1"
+run 0 create -o file="$WORK/vol/id2" -o ctld_name="$IQN:id1,lun,1"
+expect_grep "LUN ID:        2" out
+expect_attr "devices/id2/vend_specific_id" ctl-lun-2
+run 0 create -o file="$WORK/vol/id3" -l 7
+run 0 devlist --template '{{.Id}} {{.DeviceId}}'
+expect_out "$(printf '1 id1\n2 id2\n7 id3')" "devlist after adding a target"
+run 0 modify -l 2 -o num_threads=2
+expect_attr "devices/id2/threads_num" 2
+# a device exported as LUN 0 of several targets answers to all their IDs
+run 0 lunmap -p 7 -l 0 -L 1
+run 0 modify -l 7 -o num_threads=3
+expect_attr "devices/id1/threads_num" 3
+# a LUN other than LUN 0 of a new target keeps the requested ID
+truncate -s 10M vol/id4
+run 0 create -o file="$WORK/vol/id4" -o ctld_name="$IQN:id4,lun,1" -l 5
+expect_grep "LUN ID:        5" out
+run 0 devlist --template '{{.Id}} {{.DeviceId}}'
+expect_grep "5 id4" out
+run 0 modify -l 5 -o num_threads=4
+expect_attr "devices/id4/threads_num" 4
+# LUNs mapped into the default LUN table of a target are listed
+run 0 lunmap -p 7 -l 3 -L 2 -g ""
+run 0 portlist -l -p 7
+expect_grep "LUN 3: 2" out
+run 0 lunmap -p 7 -l 3 -g ""
+run 0 portlist -l -p 7
+if grep -q "LUN 3:" out; then
+	echo "FAIL: portlist -l lists a LUN unmapped from the default LUN table"
+	FAILED=1
+fi
+
+# import of a FreeBSD devlist -x dump into an empty SCST tree
+export CTLADM_SCST_ROOT=$WORK/scst-import
+mkdir -p vol/b
+truncate -s 10M vol/zvol1 vol/b/zvol1
+cat >devlist.xml <<EOF
+<ctllunlist>
+<lun id="3">
+	<backend_type>block</backend_type>
+	<lun_type>0</lun_type>
+	<size>20480</size>
+	<blocksize>512</blocksize>
+	<serial_number>FBSD3</serial_number>
+	<device_id>zvol1</device_id>
+	<num_threads>14</num_threads>
+	<file>$WORK/vol/zvol1</file>
+	<ctld_name>$IQN:zvol1,lun,0</ctld_name>
+	<vendor>FREEBSD</vendor>
+	<pblocksize>4096</pblocksize>
+</lun>
+<lun id="4">
+	<backend_type>ramdisk</backend_type>
+	<lun_type>0</lun_type>
+	<size>2048</size>
+	<blocksize>512</blocksize>
+	<ctld_name>$IQN:ram,lun,0</ctld_name>
+</lun>
+<lun id="5">
+	<backend_type>block</backend_type>
+	<lun_type>0</lun_type>
+	<size>20480</size>
+	<blocksize>512</blocksize>
+	<file>$WORK/vol/b/zvol1</file>
+	<ctld_name>$IQN:b-zvol1,lun,0</ctld_name>
+</lun>
+</ctllunlist>
+EOF
+run 0 import --from-xml devlist.xml --dry-run
+expect_grep "cannot import: LUN 3: option pblocksize has no SCST equivalent" out
+expect_grep "cannot import: LUN 4: backend ramdisk needs a device_id to name its device" out
+expect_grep "cannot import: LUN 5: device zvol1 is already used by LUN 3" out
+expect_grep "would create target $IQN:zvol1 with rel_tgt_id 3" out
+if [ -e "$CTLADM_SCST_ROOT/devices/zvol1" ]; then
+	echo "FAIL: import --dry-run created a device"
+	FAILED=1
+fi
+run 1 import --from-xml devlist.xml
+run 0 import --from-xml devlist.xml --partial
+expect_grep "Import completed" out
+expect_attr "devices/zvol1/t10_vend_id" FREEBSD
+expect_attr "targets/iscsi/$IQN:zvol1/rel_tgt_id" 3
+run 0 devlist
+expect_out "$(printf '3\tblock\t20480\t512\tFBSD3\tzvol1\t%s\t%s\t14\t0' "$WORK/vol/zvol1" "$IQN:zvol1")" "devlist after import"
+
+# apply-ctlconf converges an empty SCST tree to a ctl.conf and prunes
+export CTLADM_SCST_ROOT=$WORK/scst-ctlconf
+truncate -s 10M vol/conf1 vol/conf2
+cat >ctl.conf <<EOF
+auth-group ag0 {
+	chap user1 secret123456
+	initiator-name iqn.1994-05.com.example:host1
+}
+portal-group pg0 {
+	listen 192.0.2.1
+}
+lun shared {
+	path $WORK/vol/conf2
+	option vendor PLAYKEY
+}
+target $IQN:conf1 {
+	auth-group ag0
+	portal-group pg0
+	lun 0 {
+		path $WORK/vol/conf1
+		serial CONF1
+	}
+	lun 1 shared
+}
+target $IQN:conf2 {
+	auth-group no-authentication
+	lun 0 shared
+}
+EOF
+run 0 apply-ctlconf ctl.conf --dry-run
+expect_grep "would create device conf1 backed by $WORK/vol/conf1" out
+if [ -e "$CTLADM_SCST_ROOT/devices/conf1" ]; then
+	echo "FAIL: apply-ctlconf --dry-run created a device"
+	FAILED=1
+fi
+run 0 apply-ctlconf ctl.conf
+expect_grep "Configuration applied, 12 actions" out
+expect_attr "devices/conf1/usn" CONF1
+expect_attr "devices/conf2/t10_vend_id" PLAYKEY
+expect_attr "targets/iscsi/$IQN:conf1/IncomingUser" "user1 secret123456"
+expect_attr "targets/iscsi/$IQN:conf1/allowed_portal" 192.0.2.1
+expect_attr "targets/iscsi/$IQN:conf1/enabled" 1
+if [ ! -e "$CTLADM_SCST_ROOT/targets/iscsi/$IQN:conf1/ini_groups/allowed_ini/initiators/iqn.1994-05.com.example:host1" ]; then
+	echo "FAIL: apply-ctlconf did not add the initiator"
+	FAILED=1
+fi
+if [ ! -e "$CTLADM_SCST_ROOT/targets/iscsi/$IQN:conf2/luns/0" ]; then
+	echo "FAIL: apply-ctlconf did not map the LUN of an open target for every initiator"
+	FAILED=1
+fi
+run 0 portlist -l
+expect_out "$(printf '1\tYES\tiscsi\tiscsi\t%s,t,0x0101\t%s\n      LUN 0: 1\n      LUN 1: 2\n2\tYES\tiscsi\tiscsi\t%s,t,0x0101\t%s\n      LUN 0: 2' "$IQN:conf1" "$IQN:conf1" "$IQN:conf2" "$IQN:conf2")" "portlist after apply-ctlconf"
+run 0 apply-ctlconf ctl.conf
+expect_grep "Configuration applied, 0 actions" out
+sed -e 's/secret123456/secret654321/' -e '/lun 1 shared/d' ctl.conf | awk "/^target $IQN:conf2/ { skip = 1 } !skip" >ctl2.conf
+run 0 apply-ctlconf ctl2.conf
+expect_grep "note: target $IQN:conf2 is not in the configuration, kept" out
+expect_attr "targets/iscsi/$IQN:conf1/IncomingUser" "user1 secret654321"
+run 0 apply-ctlconf ctl2.conf --prune
+expect_grep "delete target $IQN:conf2" out
+expect_grep "delete device conf2" out
+if [ -e "$CTLADM_SCST_ROOT/devices/conf2" ] || [ -e "$CTLADM_SCST_ROOT/targets/iscsi/$IQN:conf1/luns/1" ]; then
+	echo "FAIL: apply-ctlconf --prune left conf2 behind"
+	FAILED=1
+fi
+printf 'target %s {\n\tlun 0 {\n\t\tpath %s\n\t}\n\tinitiator-portal 192.0.2.0/24\n}\n' "$IQN:conf3" "$WORK/vol/conf1" >ctl3.conf
+run 1 apply-ctlconf ctl3.conf
+expect_grep "cannot apply: target $IQN:conf3: initiator-portal 192.0.2.0/24 cannot be enforced by SCST" out
+printf 'target %s {\n\tbogus\n}\n' "$IQN:conf3" >ctl4.conf
+run 64 apply-ctlconf ctl4.conf
+expect_grep "line 2: unknown target statement bogus" err
+
+# export writes what apply-ctlconf built, and the ctl.conf reproduces it
+run 0 export --format scst.conf
+cp out scst-export.conf
+expect_grep "	DEVICE conf1 {" out
+expect_grep "		usn CONF1" out
+expect_grep "		IncomingUser \"user1 secret654321\"" out
+expect_grep "		rel_tgt_id 1" out
+expect_grep "			INITIATOR iqn.1994-05.com.example:host1" out
+run 0 export -f ctl.conf -o exported.conf
+expect_grep "chap user1 secret654321" exported.conf
+run 0 apply-ctlconf exported.conf
+expect_grep "Configuration applied, 0 actions" out
+export CTLADM_SCST_ROOT=$WORK/scst-export
+run 0 apply-ctlconf exported.conf
+run 0 export --format scst.conf
+if ! cmp -s out scst-export.conf; then
+	echo "FAIL: exported ctl.conf does not reproduce the configuration"
+	diff scst-export.conf out
+	FAILED=1
+fi
+run 64 export --format xml
+echo 0 >"$CTLADM_SCST_ROOT/targets/iscsi/$IQN:conf1/enabled"
+run 0 export -f ctl.conf -o disabled.conf
+expect_grep "note: target $IQN:conf1 is disabled, exported with auth-group no-access" err
+expect_grep "# disabled in SCST, auth-group $IQN:conf1 has its auth settings" disabled.conf
+expect_grep "auth-group no-access" disabled.conf
+expect_grep "chap user1 secret654321" disabled.conf
+expect_grep "initiator-name iqn.1994-05.com.example:host1" disabled.conf
+run 0 apply-ctlconf disabled.conf --prune
+expect_grep "Configuration applied, 0 actions" out
+expect_attr "targets/iscsi/$IQN:conf1/IncomingUser" "user1 secret654321"
+if [ ! -e "$CTLADM_SCST_ROOT/targets/iscsi/$IQN:conf1/ini_groups/allowed_ini/initiators/iqn.1994-05.com.example:host1" ]; then
+	echo "FAIL: apply-ctlconf --prune removed the initiators of a disabled target"
+	FAILED=1
+fi
+expect_attr "targets/iscsi/$IQN:conf1/enabled" 0
+
+# scst-apply rebuilds the exported scst.conf and only writes what differs
+export CTLADM_SCST_ROOT=$WORK/scst-apply
+run 0 scst-apply --dry-run scst-export.conf
+expect_grep "echo \"add_target $IQN:conf1\" >\"$CTLADM_SCST_ROOT/targets/iscsi/mgmt\"" out
+if [ -e "$CTLADM_SCST_ROOT/devices/conf1" ]; then
+	echo "FAIL: scst-apply --dry-run created a device"
+	FAILED=1
+fi
+run 0 scst-apply scst-export.conf
+expect_grep "Configuration applied, 11 writes" out
+run 0 export --format scst.conf
+if ! cmp -s out scst-export.conf; then
+	echo "FAIL: scst-apply does not reproduce the configuration"
+	diff scst-export.conf out
+	FAILED=1
+fi
+run 0 scst-apply scst-export.conf
+expect_grep "Configuration applied, 0 writes" out
+sed -e 's/usn CONF1/usn CONF2/' -e 's/secret654321/secret111111/' -e 's/rel_tgt_id 1/rel_tgt_id 7/' -e '/INITIATOR/d' scst-export.conf >scst2.conf
+run 0 scst-apply scst2.conf
+expect_out "$(printf '%s\n' \
+	"echo \"del_target_attribute $IQN:conf1 IncomingUser user1\" >\"$CTLADM_SCST_ROOT/targets/iscsi/mgmt\"" \
+	"echo \"del iqn.1994-05.com.example:host1\" >\"$CTLADM_SCST_ROOT/targets/iscsi/$IQN:conf1/ini_groups/allowed_ini/initiators/mgmt\"" \
+	"echo \"CONF2\" >\"$CTLADM_SCST_ROOT/devices/conf1/usn\"" \
+	"echo \"0\" >\"$CTLADM_SCST_ROOT/targets/iscsi/$IQN:conf1/enabled\"" \
+	"echo \"7\" >\"$CTLADM_SCST_ROOT/targets/iscsi/$IQN:conf1/rel_tgt_id\"" \
+	"echo \"add_target_attribute $IQN:conf1 IncomingUser user1 secret111111\" >\"$CTLADM_SCST_ROOT/targets/iscsi/mgmt\"" \
+	"echo \"1\" >\"$CTLADM_SCST_ROOT/targets/iscsi/$IQN:conf1/enabled\"" \
+	"Configuration applied, 7 writes")" "scst-apply scst2.conf"
+expect_attr "targets/iscsi/$IQN:conf1/enabled" 1
+sed -e 's/nv_cache 1/nv_cache 0/' scst2.conf >scst3.conf
+run 0 scst-apply --dry-run scst3.conf
+expect_grep "echo \"del_device conf1\" >\"$CTLADM_SCST_ROOT/handlers/vdisk_blockio/mgmt\"" out
+expect_grep "echo \"add conf1 0\" >\"$CTLADM_SCST_ROOT/targets/iscsi/$IQN:conf1/ini_groups/allowed_ini/luns/mgmt\"" out
+# devices of handlers the file does not declare are kept
+run 0 create -b ramdisk -d keep1 -s 1M
+run 0 scst-apply scst2.conf
+expect_grep "echo \"del_target $IQN:keep1\" >\"$CTLADM_SCST_ROOT/targets/iscsi/mgmt\"" out
+if grep -q "del_device keep1" out || [ ! -e "$CTLADM_SCST_ROOT/devices/keep1" ]; then
+	echo "FAIL: scst-apply deleted a device of a handler scst.conf does not declare"
+	FAILED=1
+fi
+printf 'HANDLER vdisk_blockio {\n\tDEVICE conf1 {\n\t\tfilename %s\n\t}\n' "$WORK/vol/conf1" >scst4.conf
+run 64 scst-apply scst4.conf
+expect_grep "line 1: HANDLER block is not closed" err
+
+# file, ramdisk and CD-ROM LUNs go to vdisk_fileio, vdisk_nullio and vcdrom
+export CTLADM_SCST_ROOT=$WORK/scst-handlers
+truncate -s 10M vol/image1
+truncate -s 4M vol/game.iso
+truncate -s 6M vol/game2.iso
+run 0 create -b file -o file="$WORK/vol/image1"
+expect_grep "backend:       file" out
+expect_attr "devices/image1/t10_vend_id" FREE_TT
+run 0 create -b ramdisk -d null1 -s 1G
+expect_grep "LUN size:      1073741824 bytes" out
+run 0 create -t 5 -o file="$WORK/vol/game.iso"
+expect_grep "device type:   5" out
+expect_attr "devices/game.iso/filename" "$WORK/vol/game.iso"
+if [ ! -L "$CTLADM_SCST_ROOT/handlers/vcdrom/game.iso" ] || [ ! -L "$CTLADM_SCST_ROOT/handlers/vdisk_nullio/null1" ]; then
+	echo "FAIL: devices not created by their handlers"
+	FAILED=1
+fi
+run 0 devlist
+expect_out "$(printf '3\tblock\t2048\t2048\t%s\tgame.iso\t%s\t%s\t1\t0\n1\tfile\t20480\t512\t%s\timage1\t%s\t%s\t1\t0\n2\tramdisk\t2097152\t512\t%s\tnull1\t\t%s\t1\t0' \
+	"$(head -n 1 "$CTLADM_SCST_ROOT/devices/game.iso/usn")" "$WORK/vol/game.iso" "$IQN:game.iso" \
+	"$(head -n 1 "$CTLADM_SCST_ROOT/devices/image1/usn")" "$WORK/vol/image1" "$IQN:image1" \
+	"$(head -n 1 "$CTLADM_SCST_ROOT/devices/null1/usn")" "$IQN:null1")" "devlist of other handlers"
+run 0 devlist -x
+expect_grep "<backend_type>ramdisk</backend_type>" out
+expect_grep "<lun_type>5</lun_type>" out
+run 64 create -b ramdisk -d null2
+expect_grep "LUN creation error: size of the ramdisk LUN not specified" err
+run 64 create -b ramdisk -t 5 -d null2 -s 1M
+expect_grep "device type 5 is not supported by backend ramdisk" err
+run 64 create -b tape -o file="$WORK/vol/image1"
+expect_grep "backend \"tape\" not found" err
+run 0 export --format scst.conf
+expect_grep "HANDLER vdisk_nullio {" out
+expect_grep "		size 1073741824" out
+run 0 export --format ctl.conf -o handlers.conf
+expect_grep "	device-type cd" handlers.conf
+export CTLADM_SCST_ROOT=$WORK/scst-handlers2
+run 0 apply-ctlconf handlers.conf
+run 0 export --format ctl.conf
+if ! cmp -s out handlers.conf; then
+	echo "FAIL: ctl.conf with file, ramdisk and CD-ROM LUNs does not round trip"
+	diff handlers.conf out
+	FAILED=1
+fi
+export CTLADM_SCST_ROOT=$WORK/scst-handlers
+run 0 modify -l 3 -o file="$WORK/vol/game2.iso"
+expect_attr "devices/game.iso/size" 6291456
+run 64 modify -l 1 -o file="$WORK/vol/game2.iso"
+run 64 modify -l 2 -o size=2G
+expect_grep "LUN 2 has no backing file to resize" err
+run 64 remove -b block -l 1 --purge
+expect_grep "ctladm: LUN removal error: LUN 1 is not managed by the block backend, it is a file LUN" err
+expect_attr "devices/image1/active" 1
+run 64 remove -b tape -l 1
+expect_grep "backend \"tape\" not found" err
+run 64 modify -b ramdisk -l 3 -o file="$WORK/vol/game.iso"
+expect_grep "LUN 3 is not managed by the ramdisk backend, it is a block LUN" err
+run 66 remove -l 9
+expect_grep "ctladm: LUN removal error: LUN 9 not found" err
+run 0 remove -b ramdisk -l 2 --purge --delete-target
+if [ -e "$CTLADM_SCST_ROOT/devices/null1" ] || [ -e "$CTLADM_SCST_ROOT/handlers/vdisk_nullio/null1" ]; then
+	echo "FAIL: ramdisk LUN left behind"
+	FAILED=1
+fi
+
+# errors the SCST layer handles itself go to the log file, not stderr
+export CTLADM_SCST_ROOT=$WORK/scst-log
+truncate -s 10M vol/log1
+run 0 create -o file="$WORK/vol/log1"
+rm -rf "$CTLADM_SCST_ROOT/devices/log1"
+run 0 devlist
+if grep -v "^WARNING! Running in development environment$" err | grep -q .; then
+	echo "FAIL: devlist logged to stderr:"
+	cat err
+	FAILED=1
+fi
+expect_grep "ScstGetGroupLunDevice: error resolving LUN 0 path for $IQN:log1" ctladm.log
+
+if [ "$FAILED" -ne 0 ]; then
+	echo "integration: FAILED"
+	exit 1
+fi
+echo "integration: ok"
@@ -0,0 +1,859 @@
+package pk_scstsim
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	scst "github.com/Tualua/pk_ctladm/pk_scst"
+)
+
+const SCST_SIM_VERSION string = "3.7.0"
+const SCST_SIM_LAST_MGMT_RES string = "last_sysfs_mgmt_res"
+const SCST_SIM_DISK_TYPE string = "0 - Direct-access device (e.g., magnetic disk)"
+
+// Devices of the nullio handler are this big unless add_device says
+// otherwise.
+const SCST_SIM_NULLIO_SIZE int64 = 3 << 40 >> 1
+
+var scstSimDiskParams = []string{
+	"active", "blocksize", "cluster_mode", "filename", "nv_cache", "o_direct",
+	"read_only", "removable", "rotational", "thin_provisioned", "write_through",
+}
+
+type scstSimHandler struct {
+	params []string
+	vendor string
+	kind   string
+}
+
+// scstSimHandlers lists the dev handlers of the simulated kernel with their
+// add_device parameters, t10_vend_id and SCSI device type.
+var scstSimHandlers = map[string]scstSimHandler{
+	scst.SCST_HANDLER_BLOCKIO: {scstSimDiskParams, "SCST_BIO", SCST_SIM_DISK_TYPE},
+	scst.SCST_HANDLER_FILEIO:  {scstSimDiskParams, "SCST_FIO", SCST_SIM_DISK_TYPE},
+	scst.SCST_HANDLER_NULLIO:  {[]string{"active", "blocksize", "read_only", "removable", "rotational", "size"}, "SCST_NULL", SCST_SIM_DISK_TYPE},
+	scst.SCST_HANDLER_CDROM:   {nil, "SCST_CDR", "5 - CD-ROM device"},
+}
+
+func simHandlerPath(handler string) string {
+	return path.Join(scst.SCST_HANDLERS, handler)
+}
+
+// ScstSim emulates the SCST sysfs tree of a kernel with the iSCSI target and
+// the vdisk_blockio, vdisk_fileio, vdisk_nullio and vcdrom handlers loaded.
+// The tree lives in a plain directory, reads go straight to it while writes
+// to mgmt files and attributes are interpreted the way the kernel does. All state is kept in the tree, so several
+// processes can share one simulated root.
+type ScstSim struct {
+	*scst.ScstOsFS
+	mu   sync.Mutex
+	temp bool
+}
+
+type scstSimFile struct {
+	name string
+	mode fs.FileMode
+	val  string
+}
+
+func New(root string) (sim *ScstSim, err error) {
+	sim = &ScstSim{ScstOsFS: scst.NewScstOsFS(root)}
+	if err = sim.init(); err != nil {
+		sim = nil
+	}
+	return
+}
+
+func NewTemp() (sim *ScstSim, err error) {
+	var (
+		root string
+	)
+	if root, err = os.MkdirTemp("", "scstsim"); err != nil {
+		return
+	}
+	if sim, err = New(root); err != nil {
+		os.RemoveAll(root)
+	} else {
+		sim.temp = true
+	}
+	return
+}
+
+func (s *ScstSim) Close() (err error) {
+	if s.temp {
+		err = os.RemoveAll(s.Root)
+	}
+	return
+}
+
+func (s *ScstSim) init() (err error) {
+	var (
+		files []scstSimFile
+	)
+	for _, dir := range []string{scst.SCST_DEVICES, scst.SCST_ISCSI_TARGETS} {
+		if err = os.MkdirAll(s.path(dir), 0755); err != nil {
+			return
+		}
+	}
+	for name, handler := range scstSimHandlers {
+		if err = os.MkdirAll(s.path(simHandlerPath(name)), 0755); err != nil {
+			return
+		}
+		usage := "Usage: echo \"add_device device_name [parameters]\" >mgmt\n       echo \"del_device device_name\" >mgmt"
+		if len(handler.params) > 0 {
+			usage += "\n" + scst.SCST_HANDLER_PARAMS_HELP + " " + strings.Join(handler.params, ", ")
+		}
+		files = append(files,
+			scstSimFile{path.Join(simHandlerPath(name), "mgmt"), 0644, usage},
+			scstSimFile{path.Join(simHandlerPath(name), "type"), 0444, handler.kind})
+	}
+	return s.createFiles("", append(files, []scstSimFile{
+		{"version", 0444, SCST_SIM_VERSION},
+		{SCST_SIM_LAST_MGMT_RES, 0444, "0"},
+		{scst.SCST_ISCSI_TARGETS_MGMT, 0644, "Usage: echo \"add_target target_name [parameters]\" >mgmt\n       echo \"del_target target_name\" >mgmt\n       echo \"add_target_attribute target_name <attribute> <value>\" >mgmt\n       echo \"del_target_attribute target_name <attribute> <value>\" >mgmt"},
+		{path.Join(scst.SCST_ISCSI_TARGETS, "enabled"), 0644, "1"},
+	}...))
+}
+
+func (s *ScstSim) path(name string) string {
+	return filepath.Join(s.Root, filepath.FromSlash(name))
+}
+
+func (s *ScstSim) createFiles(dir string, files []scstSimFile) (err error) {
+	for _, file := range files {
+		filePath := s.path(path.Join(dir, file.name))
+		if _, err = os.Lstat(filePath); err == nil {
+			continue
+		}
+		if err = os.WriteFile(filePath, []byte(file.val+"\n"), file.mode); err != nil {
+			return
+		}
+		if err = os.Chmod(filePath, file.mode); err != nil {
+			return
+		}
+	}
+	return nil
+}
+
+func (s *ScstSim) setAttr(name string, val string) (err error) {
+	var (
+		info fs.FileInfo
+	)
+	attrPath := s.path(name)
+	if info, err = os.Lstat(attrPath); err != nil {
+		return
+	}
+	if err = os.Chmod(attrPath, info.Mode().Perm()|0200); err != nil {
+		return
+	}
+	defer os.Chmod(attrPath, info.Mode().Perm())
+	return os.WriteFile(attrPath, []byte(val+"\n"), info.Mode().Perm())
+}
+
+func (s *ScstSim) getAttr(name string) string {
+	val, _ := os.ReadFile(s.path(name))
+	return strings.Split(string(val), "\n")[0]
+}
+
+func (s *ScstSim) exists(name string) bool {
+	_, err := os.Lstat(s.path(name))
+	return err == nil
+}
+
+func (s *ScstSim) symlink(name string, target string) error {
+	rel, err := filepath.Rel(path.Dir(name), target)
+	if err != nil {
+		return err
+	}
+	return os.Symlink(rel, s.path(name))
+}
+
+func simError(op string, name string, errno syscall.Errno) error {
+	return &fs.PathError{Op: op, Path: name, Err: errno}
+}
+
+// ReadFile refuses write-only attributes like sysfs does.
+func (s *ScstSim) ReadFile(name string) ([]byte, error) {
+	if info, err := os.Stat(s.path(name)); err == nil && info.Mode().IsRegular() && info.Mode().Perm()&0444 == 0 {
+		return nil, simError("open", name, syscall.EACCES)
+	}
+	return s.ScstOsFS.ReadFile(name)
+}
+
+func (s *ScstSim) WriteFile(name string, data []byte) (err error) {
+	var (
+		info fs.FileInfo
+	)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name = path.Clean(name)
+	val := strings.TrimSpace(string(data))
+	if info, err = os.Stat(s.path(name)); err != nil {
+		return simError("open", name, syscall.ENOENT)
+	}
+	if info.IsDir() {
+		return simError("open", name, syscall.EISDIR)
+	}
+	if info.Mode().Perm()&0200 == 0 {
+		return simError("open", name, syscall.EACCES)
+	}
+	if path.Base(name) == "mgmt" {
+		err = s.mgmt(path.Dir(name), val)
+		res := "0"
+		var errno syscall.Errno
+		if errors.As(err, &errno) {
+			res = fmt.Sprintf("-%d", int(errno))
+		} else if err != nil {
+			res = fmt.Sprintf("-%d", int(syscall.EINVAL))
+		}
+		s.setAttr(SCST_SIM_LAST_MGMT_RES, res)
+		if err != nil && !errors.As(err, new(*fs.PathError)) {
+			err = &fs.PathError{Op: "write", Path: name, Err: err}
+		}
+		return
+	}
+	if err = s.attr(name, val); err != nil && !errors.As(err, new(*fs.PathError)) {
+		err = &fs.PathError{Op: "write", Path: name, Err: err}
+	}
+	return
+}
+
+func (s *ScstSim) mgmt(dir string, cmd string) error {
+	fields := strings.Fields(cmd)
+	if len(fields) == 0 {
+		return syscall.EINVAL
+	}
+	args := fields[1:]
+	switch {
+	case path.Dir(dir) == scst.SCST_HANDLERS:
+		switch fields[0] {
+		case "add_device":
+			if len(args) < 1 {
+				return syscall.EINVAL
+			}
+			_, params, _ := strings.Cut(strings.TrimSpace(strings.TrimPrefix(cmd, fields[0])), args[0])
+			return s.addDevice(path.Base(dir), args[0], params)
+		case "del_device":
+			if len(args) != 1 {
+				return syscall.EINVAL
+			}
+			return s.delDevice(args[0])
+		}
+	case dir == scst.SCST_ISCSI_TARGETS:
+		switch fields[0] {
+		case "add_target":
+			if len(args) < 1 {
+				return syscall.EINVAL
+			}
+			return s.addTarget(args[0])
+		case "del_target":
+			if len(args) != 1 {
+				return syscall.EINVAL
+			}
+			return s.delTarget(args[0])
+		case "add_target_attribute":
+			if len(args) < 3 {
+				return syscall.EINVAL
+			}
+			return s.addTargetAttr(args[0], args[1], strings.Join(args[2:], " "))
+		case "del_target_attribute":
+			if len(args) != 3 {
+				return syscall.EINVAL
+			}
+			return s.delTargetAttr(args[0], args[1], args[2])
+		}
+	case path.Base(dir) == "luns":
+		return s.lunsMgmt(dir, fields[0], args)
+	case path.Base(dir) == "ini_groups":
+		switch fields[0] {
+		case "create":
+			if len(args) != 1 {
+				return syscall.EINVAL
+			}
+			return s.createGroup(dir, args[0])
+		case "del":
+			if len(args) != 1 {
+				return syscall.EINVAL
+			}
+			return s.delGroup(dir, args[0])
+		}
+	case path.Base(dir) == "initiators":
+		return s.initiatorsMgmt(dir, fields[0], args)
+	}
+	return syscall.EINVAL
+}
+
+func parseDeviceParams(params string, allowed []string) (res map[string]string, err error) {
+	res = map[string]string{}
+	for _, param := range strings.Split(params, ";") {
+		if param = strings.TrimSpace(param); param == "" {
+			continue
+		}
+		name, val, found := strings.Cut(param, "=")
+		name = strings.TrimSpace(name)
+		if !found || !simContains(allowed, name) {
+			return nil, syscall.EINVAL
+		}
+		res[name] = strings.TrimSpace(val)
+	}
+	return
+}
+
+func simBool(val string) (res string, err error) {
+	switch val {
+	case "0", "1":
+		res = val
+	default:
+		err = syscall.EINVAL
+	}
+	return
+}
+
+func simUsn(device string) string {
+	var (
+		hash uint32 = 2166136261
+	)
+	for _, c := range []byte(device) {
+		hash ^= uint32(c)
+		hash *= 16777619
+	}
+	return fmt.Sprintf("%08x", hash)
+}
+
+func simContains(list []string, val string) bool {
+	for _, v := range list {
+		if v == val {
+			return true
+		}
+	}
+	return false
+}
+
+// addDevice creates a device the way handler does. Disks need a filename,
+// nullio devices have a size instead and vcdrom starts with no medium, one
+// is loaded by writing its filename attribute.
+func (s *ScstSim) addDevice(handler string, device string, params string) (err error) {
+	var (
+		devParams map[string]string
+		info      fs.FileInfo
+		size      int64
+	)
+	devPath := path.Join(scst.SCST_DEVICES, device)
+	if s.exists(devPath) {
+		return syscall.EEXIST
+	}
+	h := scstSimHandlers[handler]
+	if devParams, err = parseDeviceParams(params, h.params); err != nil {
+		return
+	}
+	filename, ok := devParams["filename"]
+	switch handler {
+	case scst.SCST_HANDLER_NULLIO:
+		size = SCST_SIM_NULLIO_SIZE
+		if val, ok := devParams["size"]; ok {
+			if size, err = strconv.ParseInt(val, 10, 64); err != nil || size < 0 {
+				return syscall.EINVAL
+			}
+		}
+	case scst.SCST_HANDLER_CDROM:
+	default:
+		if !ok || filename == "" {
+			return syscall.EINVAL
+		}
+		if info, err = os.Stat(filename); err != nil {
+			return syscall.ENOENT
+		}
+		size = info.Size()
+	}
+	prodId := device
+	if len(prodId) > 16 {
+		prodId = prodId[:16]
+	}
+	blocksize := 512
+	if handler == scst.SCST_HANDLER_CDROM {
+		blocksize = 2048
+	}
+	if val, ok := devParams["blocksize"]; ok {
+		if blocksize, err = strconv.Atoi(val); err != nil || blocksize < 512 || blocksize&(blocksize-1) != 0 {
+			return syscall.EINVAL
+		}
+	}
+	sizeVal := strconv.FormatInt(size, 10)
+	if _, given := devParams["size"]; given {
+		sizeVal += "\n[key]"
+	}
+	files := []scstSimFile{
+		{"size", 0444, sizeVal},
+		{"size_mb", 0444, strconv.FormatInt(size>>20, 10)},
+		{"t10_dev_id", 0644, device},
+		{"t10_vend_id", 0644, h.vendor},
+		{"usn", 0644, simUsn(device)},
+		{"vend_specific_id", 0644, device},
+		{"prod_id", 0644, prodId},
+		{"prod_rev_lvl", 0644, " 370"},
+		{"threads_num", 0644, "1"},
+		{"threads_pool_type", 0644, "per_initiator"},
+		{"type", 0444, h.kind},
+	}
+	switch handler {
+	case scst.SCST_HANDLER_NULLIO:
+	case scst.SCST_HANDLER_CDROM:
+		files = append(files, scstSimFile{"filename", 0644, ""})
+	default:
+		files = append(files, scstSimFile{"filename", 0444, filename + "\n[key]"}, scstSimFile{"resync_size", 0200, ""})
+	}
+	for _, name := range []string{"blocksize", "read_only", "thin_provisioned", "rotational", "nv_cache", "write_through", "removable", "o_direct", "active"} {
+		val, given := devParams[name]
+		switch {
+		case name == "blocksize":
+			val = strconv.Itoa(blocksize)
+		case handler == scst.SCST_HANDLER_CDROM && (name == "read_only" || name == "removable"):
+			val = "1"
+		case !given && (name == "rotational" || name == "active"):
+			val = "1"
+		case !given:
+			val = "0"
+		default:
+			if val, err = simBool(val); err != nil {
+				return
+			}
+		}
+		mode := fs.FileMode(0444)
+		if name == "active" {
+			mode = 0644
+		}
+		if given {
+			val += "\n[key]"
+		}
+		files = append(files, scstSimFile{name, mode, val})
+	}
+	if err = os.MkdirAll(s.path(path.Join(devPath, "exported")), 0755); err != nil {
+		return
+	}
+	if err = s.createFiles(devPath, files); err != nil {
+		return
+	}
+	if err = s.symlink(path.Join(devPath, "handler"), simHandlerPath(handler)); err != nil {
+		return
+	}
+	return s.symlink(path.Join(simHandlerPath(handler), device), devPath)
+}
+
+func (s *ScstSim) delDevice(device string) (err error) {
+	var (
+		exports []fs.DirEntry
+	)
+	devPath := path.Join(scst.SCST_DEVICES, device)
+	if !s.exists(devPath) {
+		return syscall.ENOENT
+	}
+	if exports, err = os.ReadDir(s.path(path.Join(devPath, "exported"))); err != nil {
+		return
+	}
+	for _, export := range exports {
+		exportPath := path.Join(devPath, "exported", export.Name())
+		if target, err := os.Readlink(s.path(exportPath)); err == nil {
+			os.RemoveAll(s.path(path.Join(path.Dir(exportPath), target)))
+		}
+	}
+	if handler, err := os.Readlink(s.path(path.Join(devPath, "handler"))); err == nil {
+		os.Remove(s.path(path.Join(devPath, handler, device)))
+	}
+	return os.RemoveAll(s.path(devPath))
+}
+
+func (s *ScstSim) targetRelIds() (res map[int]string) {
+	res = map[int]string{}
+	if targets, err := os.ReadDir(s.path(scst.SCST_ISCSI_TARGETS)); err == nil {
+		for _, target := range targets {
+			if !target.IsDir() {
+				continue
+			}
+			if id, err := strconv.Atoi(s.getAttr(path.Join(scst.SCST_ISCSI_TARGETS, target.Name(), "rel_tgt_id"))); err == nil {
+				res[id] = target.Name()
+			}
+		}
+	}
+	return
+}
+
+func (s *ScstSim) addTarget(target string) (err error) {
+	tgtPath := path.Join(scst.SCST_ISCSI_TARGETS, target)
+	if s.exists(tgtPath) {
+		return syscall.EEXIST
+	}
+	relIds := s.targetRelIds()
+	relId := 1
+	for relIds[relId] != "" {
+		relId++
+	}
+	for _, dir := range []string{"luns", "ini_groups", "sessions"} {
+		if err = os.MkdirAll(s.path(path.Join(tgtPath, dir)), 0755); err != nil {
+			return
+		}
+	}
+	return s.createFiles(tgtPath, []scstSimFile{
+		{"enabled", 0644, "0"},
+		{"rel_tgt_id", 0644, strconv.Itoa(relId)},
+		{"tid", 0444, strconv.Itoa(relId)},
+		{"luns/mgmt", 0644, "Usage: echo \"add H:C:I:L lun [parameters]\" >mgmt"},
+		{"ini_groups/mgmt", 0644, "Usage: echo \"create GROUP_NAME\" >mgmt"},
+	})
+}
+
+func (s *ScstSim) delTarget(target string) (err error) {
+	tgtPath := path.Join(scst.SCST_ISCSI_TARGETS, target)
+	if !s.exists(tgtPath) {
+		return syscall.ENOENT
+	}
+	s.clearLuns(path.Join(tgtPath, "luns"))
+	if groups, err := os.ReadDir(s.path(path.Join(tgtPath, "ini_groups"))); err == nil {
+		for _, group := range groups {
+			if group.IsDir() {
+				s.clearLuns(path.Join(tgtPath, "ini_groups", group.Name(), "luns"))
+			}
+		}
+	}
+	return os.RemoveAll(s.path(tgtPath))
+}
+
+// targetAttrFiles lists the files of a multi-value target attribute, attr
+// followed by attr1, attr2 and so on.
+func (s *ScstSim) targetAttrFiles(target string, attr string) (res []string) {
+	if entries, err := os.ReadDir(s.path(path.Join(scst.SCST_ISCSI_TARGETS, target))); err == nil {
+		for _, entry := range entries {
+			if n := strings.TrimPrefix(entry.Name(), attr); n != entry.Name() {
+				if _, err := strconv.Atoi(n); n == "" || err == nil {
+					res = append(res, entry.Name())
+				}
+			}
+		}
+	}
+	return
+}
+
+func (s *ScstSim) addTargetAttr(target string, attr string, val string) (err error) {
+	tgtPath := path.Join(scst.SCST_ISCSI_TARGETS, target)
+	if !s.exists(tgtPath) {
+		return syscall.ENOENT
+	}
+	switch attr {
+	case "IncomingUser", "OutgoingUser":
+		if len(strings.Fields(val)) != 2 {
+			return syscall.EINVAL
+		}
+	case "allowed_portal":
+		if len(strings.Fields(val)) != 1 {
+			return syscall.EINVAL
+		}
+	default:
+		return syscall.EINVAL
+	}
+	files := s.targetAttrFiles(target, attr)
+	key := strings.Fields(val)[0]
+	for _, file := range files {
+		if strings.Fields(s.getAttr(path.Join(tgtPath, file)))[0] == key {
+			return syscall.EEXIST
+		}
+	}
+	if attr == "OutgoingUser" && len(files) > 0 {
+		return syscall.EEXIST
+	}
+	name := attr
+	for i := 1; s.exists(path.Join(tgtPath, name)); i++ {
+		name = attr + strconv.Itoa(i)
+	}
+	return s.createFiles(tgtPath, []scstSimFile{{name, 0644, val + "\n[key]"}})
+}
+
+func (s *ScstSim) delTargetAttr(target string, attr string, key string) (err error) {
+	tgtPath := path.Join(scst.SCST_ISCSI_TARGETS, target)
+	for _, file := range s.targetAttrFiles(target, attr) {
+		if strings.Fields(s.getAttr(path.Join(tgtPath, file)))[0] == key {
+			return os.Remove(s.path(path.Join(tgtPath, file)))
+		}
+	}
+	return syscall.ENOENT
+}
+
+func (s *ScstSim) createGroup(dir string, group string) (err error) {
+	groupPath := path.Join(dir, group)
+	if s.exists(groupPath) {
+		return syscall.EEXIST
+	}
+	for _, sub := range []string{"luns", "initiators"} {
+		if err = os.MkdirAll(s.path(path.Join(groupPath, sub)), 0755); err != nil {
+			return
+		}
+	}
+	return s.createFiles(groupPath, []scstSimFile{
+		{"luns/mgmt", 0644, "Usage: echo \"add H:C:I:L lun [parameters]\" >mgmt"},
+		{"initiators/mgmt", 0644, "Usage: echo \"add INITIATOR_NAME\" >mgmt"},
+	})
+}
+
+func (s *ScstSim) delGroup(dir string, group string) (err error) {
+	groupPath := path.Join(dir, group)
+	if !s.exists(groupPath) {
+		return syscall.ENOENT
+	}
+	s.clearLuns(path.Join(groupPath, "luns"))
+	return os.RemoveAll(s.path(groupPath))
+}
+
+func (s *ScstSim) initiatorsMgmt(dir string, cmd string, args []string) (err error) {
+	switch cmd {
+	case "add":
+		if len(args) != 1 {
+			return syscall.EINVAL
+		}
+		if s.exists(path.Join(dir, args[0])) {
+			return syscall.EEXIST
+		}
+		return s.createFiles(dir, []scstSimFile{{args[0], 0444, ""}})
+	case "del":
+		if len(args) != 1 {
+			return syscall.EINVAL
+		}
+		if !s.exists(path.Join(dir, args[0])) {
+			return syscall.ENOENT
+		}
+		return os.Remove(s.path(path.Join(dir, args[0])))
+	case "clear":
+		if entries, err := os.ReadDir(s.path(dir)); err == nil {
+			for _, entry := range entries {
+				if entry.Name() != "mgmt" {
+					os.Remove(s.path(path.Join(dir, entry.Name())))
+				}
+			}
+		}
+		return nil
+	}
+	return syscall.EINVAL
+}
+
+func (s *ScstSim) lunsMgmt(dir string, cmd string, args []string) (err error) {
+	switch cmd {
+	case "add", "replace":
+		if len(args) < 2 {
+			return syscall.EINVAL
+		}
+		lun, err := strconv.Atoi(args[1])
+		if err != nil || lun < 0 {
+			return syscall.EINVAL
+		}
+		devPath := path.Join(scst.SCST_DEVICES, args[0])
+		if !s.exists(devPath) {
+			return syscall.ENOENT
+		}
+		readOnly := "0"
+		for _, param := range args[2:] {
+			switch name, val, _ := strings.Cut(param, "="); name {
+			case "read_only":
+				if readOnly, err = simBool(val); err != nil {
+					return err
+				}
+				readOnly += "\n[key]"
+			default:
+				return syscall.EINVAL
+			}
+		}
+		lunPath := path.Join(dir, strconv.Itoa(lun))
+		if s.exists(lunPath) {
+			if cmd == "add" {
+				return syscall.EEXIST
+			}
+			s.unmapLun(lunPath)
+		}
+		return s.mapLun(lunPath, devPath, readOnly)
+	case "del":
+		if len(args) != 1 {
+			return syscall.EINVAL
+		}
+		lun, err := strconv.Atoi(args[0])
+		if err != nil {
+			return syscall.EINVAL
+		}
+		lunPath := path.Join(dir, strconv.Itoa(lun))
+		if !s.exists(lunPath) {
+			return syscall.ENOENT
+		}
+		return s.unmapLun(lunPath)
+	case "clear":
+		s.clearLuns(dir)
+		return nil
+	}
+	return syscall.EINVAL
+}
+
+func (s *ScstSim) mapLun(lunPath string, devPath string, readOnly string) (err error) {
+	if err = os.MkdirAll(s.path(lunPath), 0755); err != nil {
+		return
+	}
+	if err = s.createFiles(lunPath, []scstSimFile{{"read_only", 0444, readOnly}}); err != nil {
+		return
+	}
+	if err = s.symlink(path.Join(lunPath, "device"), devPath); err != nil {
+		return
+	}
+	for i := 0; ; i++ {
+		exportPath := path.Join(devPath, "exported", fmt.Sprintf("export%d", i))
+		if !s.exists(exportPath) {
+			return s.symlink(exportPath, lunPath)
+		}
+	}
+}
+
+func (s *ScstSim) unmapLun(lunPath string) (err error) {
+	if device, err := os.Readlink(s.path(path.Join(lunPath, "device"))); err == nil {
+		exportedPath := path.Join(lunPath, device, "exported")
+		if exports, err := os.ReadDir(s.path(exportedPath)); err == nil {
+			for _, export := range exports {
+				target, err := os.Readlink(s.path(path.Join(exportedPath, export.Name())))
+				if err == nil && path.Join(exportedPath, target) == lunPath {
+					os.Remove(s.path(path.Join(exportedPath, export.Name())))
+				}
+			}
+		}
+	}
+	return os.RemoveAll(s.path(lunPath))
+}
+
+func (s *ScstSim) clearLuns(dir string) {
+	if entries, err := os.ReadDir(s.path(dir)); err == nil {
+		for _, entry := range entries {
+			if _, err := strconv.Atoi(entry.Name()); err == nil && entry.IsDir() {
+				s.unmapLun(path.Join(dir, entry.Name()))
+			}
+		}
+	}
+}
+
+func (s *ScstSim) attr(name string, val string) (err error) {
+	dir, attr := path.Split(name)
+	dir = path.Clean(dir)
+	switch attr {
+	case "active", "enabled":
+		if val, err = simBool(val); err != nil {
+			return
+		}
+	case "threads_num":
+		if n, err := strconv.Atoi(val); err != nil || n < 0 {
+			return syscall.EINVAL
+		}
+	case "filename":
+		// Only vcdrom lets the medium change, an empty name ejects it.
+		size := int64(0)
+		if val != "" {
+			if info, err := os.Stat(val); err != nil {
+				return syscall.ENOENT
+			} else {
+				size = info.Size()
+			}
+		}
+		s.setAttr(path.Join(dir, "size"), strconv.FormatInt(size, 10))
+		s.setAttr(path.Join(dir, "size_mb"), strconv.FormatInt(size>>20, 10))
+		if val == "" {
+			return s.setAttr(name, val)
+		}
+	case "resync_size":
+		if info, err := os.Stat(s.getAttr(path.Join(dir, "filename"))); err != nil {
+			return syscall.EIO
+		} else {
+			s.setAttr(path.Join(dir, "size"), strconv.FormatInt(info.Size(), 10))
+			s.setAttr(path.Join(dir, "size_mb"), strconv.FormatInt(info.Size()>>20, 10))
+		}
+		return
+	case "rel_tgt_id":
+		relId, err := strconv.Atoi(val)
+		if err != nil || relId < 1 || relId > 65535 {
+			return syscall.EINVAL
+		}
+		if s.getAttr(path.Join(dir, "enabled")) == "1" {
+			return syscall.EBUSY
+		}
+		if owner := s.targetRelIds()[relId]; owner != "" && owner != path.Base(dir) {
+			return syscall.EINVAL
+		}
+		val = strconv.Itoa(relId)
+	case "force_close":
+		if path.Base(path.Dir(dir)) != "sessions" {
+			return syscall.EINVAL
+		}
+		return os.RemoveAll(s.path(dir))
+	}
+	if path.Dir(dir) == scst.SCST_DEVICES || attr == "rel_tgt_id" {
+		val += "\n[key]"
+	}
+	return s.setAttr(name, val)
+}
+
+// AddSession logs an initiator into target from ip, the way a login from
+// the network would. It returns the session name.
+func (s *ScstSim) AddSession(target string, initiator string, ip string) (session string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sessionsPath := path.Join(scst.SCST_ISCSI_TARGETS, target, "sessions")
+	if !s.exists(sessionsPath) {
+		return "", simError("login", target, syscall.ENOENT)
+	}
+	session = initiator
+	for i := 1; s.exists(path.Join(sessionsPath, session)); i++ {
+		session = fmt.Sprintf("%s_%d", initiator, i)
+	}
+	sessionPath := path.Join(sessionsPath, session)
+	// SCST keeps the ISID in the upper 48 bits of the session id and the
+	// TSIH in the lower 16, number the ISIDs the way iscsid does.
+	sid := fmt.Sprintf("%x", uint64(0x23d000000+len(s.Sessions(""))+1)<<16|1)
+	if err = os.MkdirAll(s.path(path.Join(sessionPath, ip)), 0755); err != nil {
+		return
+	}
+	if err = s.createFiles(sessionPath, []scstSimFile{
+		{"initiator_name", 0444, initiator},
+		{"sid", 0444, sid},
+		{"force_close", 0200, ""},
+		{"InitialR2T", 0444, "No"},
+		{"ImmediateData", 0444, "Yes"},
+		{"MaxRecvDataSegmentLength", 0444, "1048576"},
+		{path.Join(ip, "cid"), 0444, "0"},
+		{path.Join(ip, "ip"), 0444, ip},
+		{path.Join(ip, "state"), 0444, "established"},
+	}); err != nil {
+		os.RemoveAll(s.path(sessionPath))
+	}
+	return
+}
+
+// Sessions lists the sessions of target, or of every target when target is
+// empty, as target/session names.
+func (s *ScstSim) Sessions(target string) (res []string) {
+	targets := []string{target}
+	if target == "" {
+		targets = nil
+		if entries, err := os.ReadDir(s.path(scst.SCST_ISCSI_TARGETS)); err == nil {
+			for _, entry := range entries {
+				if entry.IsDir() {
+					targets = append(targets, entry.Name())
+				}
+			}
+		}
+	}
+	for _, tgt := range targets {
+		if entries, err := os.ReadDir(s.path(path.Join(scst.SCST_ISCSI_TARGETS, tgt, "sessions"))); err == nil {
+			for _, entry := range entries {
+				res = append(res, tgt+"/"+entry.Name())
+			}
+		}
+	}
+	sort.Strings(res)
+	return
+}
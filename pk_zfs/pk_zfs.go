@@ -1,15 +1,69 @@
 package pk_zfs
 
 import (
+	"errors"
 	"fmt"
-	"log"
 	"os"
-	"strconv"
+	"path"
 	"strings"
 
-	zfs "github.com/bicomsystems/go-libzfs"
+	"github.com/sirupsen/logrus"
 )
 
+var log = logrus.StandardLogger()
+
+// SetLogger makes the package log through l instead of the standard logrus
+// logger.
+func SetLogger(l *logrus.Logger) {
+	log = l
+}
+
+var (
+	ErrNotFound = errors.New("dataset does not exist")
+	ErrExists   = errors.New("dataset already exists")
+	ErrBusy     = errors.New("dataset is busy")
+)
+
+type ZfsError struct {
+	Kind error
+	Err  error
+}
+
+func (e *ZfsError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ZfsError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ZfsError) Is(target error) bool {
+	return target == e.Kind
+}
+
+// zfsError classifies err by the messages of zfs(8), which the fake backend
+// reproduces.
+func zfsError(err error) error {
+	var (
+		kind error
+	)
+	if err == nil {
+		return nil
+	}
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "does not exist"):
+		kind = ErrNotFound
+	case strings.Contains(msg, "already exists"):
+		kind = ErrExists
+	case strings.Contains(msg, "busy"), strings.Contains(msg, "has dependent clones"), strings.Contains(msg, "clones of previous snapshots exist"):
+		kind = ErrBusy
+	default:
+		return err
+	}
+	return &ZfsError{Kind: kind, Err: err}
+}
+
 type ZfsEntity struct {
 	Name       string `json:"name"`
 	Used       string `json:"used"`
@@ -18,241 +72,94 @@ type ZfsEntity struct {
 	MountPoint string `json:"mountpoint"`
 }
 
-func zfsGetZvolFullPath(dataset string) (res string) {
-	res = fmt.Sprintf("/dev/zvol/%s", dataset)
-	return
+type ZfsBackend interface {
+	ListAll() ([]ZfsEntity, error)
+	CreateSnapshot(snapsource string, snapname string) error
+	GetLastSnapshot(dataset string) (string, error)
+	GetCloneInfo(clone string) (map[string]string, error)
+	DestroyDataset(dataset string) error
+	Clone(origin string, dataset string) error
+	CloneLast(origin string, dataset string) error
+	Rollback(snapshot string) error
+	CheckDatasetExists(dataset string) (bool, error)
+	GetProperty(dataset string, prop string) (string, error)
+	SetProperty(dataset string, prop string, val string) error
 }
 
-func zfsGetProperties(ds *zfs.Dataset) ZfsEntity {
-	var (
-		res ZfsEntity
-	)
-	if prop, err := ds.GetProperty(zfs.DatasetPropName); err != nil {
-		fmt.Println(err)
-	} else {
-		res.Name = prop.Value
-	}
-	if prop, err := ds.GetProperty(zfs.DatasetPropUsed); err != nil {
-		fmt.Println(err)
-	} else {
-		res.Used = prop.Value
-	}
-	if prop, err := ds.GetProperty(zfs.DatasetPropAvailable); err != nil {
-		res.Avail = "-"
-	} else {
-		res.Avail = prop.Value
-	}
-	if prop, err := ds.GetProperty(zfs.DatasetPropReferenced); err != nil {
-		fmt.Println(err)
-	} else {
-		res.Refer = prop.Value
-	}
-	if prop, err := ds.GetProperty(zfs.DatasetPropMountpoint); err != nil {
-		res.MountPoint = "-"
-	} else {
-		res.MountPoint = prop.Value
-	}
-	return res
+var zfsBackend ZfsBackend = NewZfsCmdBackend()
+
+func ZfsSetBackend(backend ZfsBackend) {
+	zfsBackend = backend
 }
 
-func zfsGetChildren(ds *zfs.Dataset) []*zfs.Dataset {
-	var (
-		res []*zfs.Dataset
-	)
-	if len(ds.Children) == 0 {
-		return append(res, ds)
-	} else {
-		res = append(res, ds)
-		for _, v := range ds.Children {
-			res = append(res, zfsGetChildren(&v)...)
-		}
-	}
+func ZfsGetBackend() ZfsBackend {
+	return zfsBackend
+}
+
+const ZFS_ZVOL_DEV_PATH string = "/dev/zvol"
+
+var zvolDevPath string = ZFS_ZVOL_DEV_PATH
+
+func ZfsSetZvolPath(devPath string) {
+	zvolDevPath = devPath
+}
 
-	return res
+func ZfsGetZvolPath() string {
+	return zvolDevPath
+}
+
+func zfsGetZvolFullPath(dataset string) (res string) {
+	res = path.Join(zvolDevPath, dataset)
+	return
 }
 
 func ZfsListAll() ([]ZfsEntity, error) {
-	var (
-		ds  []*zfs.Dataset
-		res []ZfsEntity
-		err error
-	)
-	if datasets, err := zfs.DatasetOpenAll(); err != nil {
-		log.Println(err.Error())
-	} else {
-		for _, v := range datasets {
-			ds = append(ds, zfsGetChildren(&v)...)
-		}
-		for _, v := range ds {
-			res = append(res, zfsGetProperties(v))
-		}
-		zfs.DatasetCloseAll(datasets)
-	}
-	return res, err
+	return zfsBackend.ListAll()
 }
 
 func ZfsCreateSnapshot(snapsource string, snapname string) error {
-	var (
-		err error
-		rd  zfs.Dataset
-	)
-	props := make(map[zfs.Prop]zfs.Property)
-
-	if rd, err = zfs.DatasetSnapshot(fmt.Sprintf("%s@%s", snapsource, snapname), false, props); err != nil {
-		log.Println(err.Error())
-	} else {
-		path, _ := rd.Path()
-		log.Printf("Snapshot %s created\n", path)
-	}
-	return err
+	return zfsBackend.CreateSnapshot(snapsource, snapname)
 }
 
 func ZfsGetLastSnapshot(DsPath string) (string, error) {
-	var (
-		res   string
-		err   error
-		maxTs int64 = 0
-		ds    zfs.Dataset
-	)
-
-	if ds, err = zfs.DatasetOpen(DsPath); err != nil {
-		log.Println(err.Error())
-	} else {
-		if dsSnapshots, err := ds.Snapshots(); err != nil {
-			log.Println(err.Error())
-		} else {
-			for _, s := range dsSnapshots {
-				path, _ := s.Path()
-				creation, _ := s.GetProperty(zfs.DatasetPropCreation)
-				ts, _ := strconv.ParseInt(creation.Value, 10, 64)
-				if ts >= maxTs {
-					maxTs = ts
-					res = path
-				}
-			}
-		}
-	}
-
-	return res, err
+	return zfsBackend.GetLastSnapshot(DsPath)
 }
 
 func ZfsGetCloneInfo(ClonePath string) (map[string]string, error) {
-	var (
-		res map[string]string
-		err error
-		ds  zfs.Dataset
-	)
-	res = make(map[string]string)
-	if ds, err = zfs.DatasetOpenSingle(ClonePath); err != nil {
-		log.Println(err.Error())
-	} else {
-		propOrigin, _ := ds.GetProperty(zfs.DatasetPropOrigin)
-		res["origin"] = propOrigin.Value
-		propWritten, _ := ds.GetProperty(zfs.DatasetPropWritten)
-		res["written"] = propWritten.Value
-	}
-	return res, err
+	return zfsBackend.GetCloneInfo(ClonePath)
 }
 
-func ZfsDestroyDataset(dataset string) (err error) {
-	var (
-		ds zfs.Dataset
-	)
-	if ds, err = zfs.DatasetOpenSingle(dataset); err != nil {
-		log.Println(err.Error())
-	} else {
-		if err = ds.DestroyRecursive(); err != nil {
-			log.Println(err.Error())
-		}
-		ds.Close()
-	}
-	return err
+func ZfsDestroyDataset(dataset string) error {
+	return zfsBackend.DestroyDataset(dataset)
 }
 
-func ZfsClone(origin string, dataset string) (err error) {
-	var (
-		ds_origin, ds_target zfs.Dataset
-	)
-	if ds_origin, err = zfs.DatasetOpenSingle(origin); err != nil {
-		log.Println(err.Error())
-	} else {
-		props := make(map[zfs.Prop]zfs.Property)
-		if ds_target, err = ds_origin.Clone(dataset, props); err != nil {
-			log.Println(err.Error())
-		}
-	}
-	ds_origin.Close()
-	ds_target.Close()
+func ZfsClone(origin string, dataset string) error {
+	return zfsBackend.Clone(origin, dataset)
+}
 
-	return
+func ZfsCloneLast(origin string, dataset string) error {
+	return zfsBackend.CloneLast(origin, dataset)
 }
 
-func ZfsCloneLast(origin string, dataset string) (err error) {
-	var (
-		ds_origin, ds_target zfs.Dataset
-		lastSnapshot         string
-	)
+func ZfsRollback(snapshot string) error {
+	return zfsBackend.Rollback(snapshot)
+}
 
-	if lastSnapshot, err = ZfsGetLastSnapshot(origin); err != nil {
-		log.Println(err.Error())
-	} else {
-		if ds_origin, err = zfs.DatasetOpenSingle(lastSnapshot); err != nil {
-			log.Println(err.Error())
-		} else {
-			props := make(map[zfs.Prop]zfs.Property)
-			if ds_target, err = ds_origin.Clone(dataset, props); err != nil {
-				log.Println(err.Error())
-			}
-		}
-	}
-	ds_origin.Close()
-	ds_target.Close()
+func ZfsCheckDatasetExists(dataset string) (bool, error) {
+	return zfsBackend.CheckDatasetExists(dataset)
+}
 
-	return
+func ZfsGetProperty(dataset string, prop string) (string, error) {
+	return zfsBackend.GetProperty(dataset, prop)
 }
 
-func ZfsRollback(snapshot string) (err error) {
-	var (
-		ds, ds_snap zfs.Dataset
-	)
-	ds_path := strings.Split(snapshot, "@")[0]
-	if ds, err = zfs.DatasetOpenSingle(ds_path); err != nil {
-		log.Println(err.Error())
-	} else {
-		if ds_snap, err = zfs.DatasetOpenSingle(snapshot); err != nil {
-			log.Println(err.Error())
-		} else {
-			if err = ds.Rollback(&ds_snap, true); err != nil {
-				log.Println(err.Error())
-			}
-		}
-	}
-	ds_snap.Close()
-	ds.Close()
-	return
+func ZfsSetProperty(dataset string, prop string, val string) error {
+	return zfsBackend.SetProperty(dataset, prop, val)
 }
 
 func ZfsCheckZvol(dataset string) (err error) {
-	if _, err = os.Open(zfsGetZvolFullPath(dataset)); err != nil {
-		err = fmt.Errorf("%s not found in /dev/zvol", dataset)
+	if _, err = os.Stat(zfsGetZvolFullPath(dataset)); err != nil {
+		err = &ZfsError{Kind: ErrNotFound, Err: fmt.Errorf("%s not found in %s", dataset, zvolDevPath)}
 	}
 	return err
 }
-
-func ZfsCheckDatasetExists(dataset string) (res bool, err error) {
-	var (
-		ds zfs.Dataset
-	)
-	if ds, err = zfs.DatasetOpenSingle(dataset); err != nil {
-		if strings.Contains(err.Error(), "dataset does not exist") {
-			res = false
-			err = nil
-		} else {
-			log.Println(err.Error())
-		}
-	} else {
-		res = true
-	}
-	ds.Close()
-	return
-}
@@ -0,0 +1,263 @@
+//go:build libzfs
+
+package pk_zfs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	zfs "github.com/bicomsystems/go-libzfs"
+)
+
+// ZfsLibBackend talks to ZFS through libzfs. It is only built with the
+// libzfs tag and then replaces the zfs command backend as the default.
+type ZfsLibBackend struct{}
+
+func init() {
+	zfsBackend = &ZfsLibBackend{}
+}
+
+func zfsGetProperties(ds *zfs.Dataset) ZfsEntity {
+	var (
+		res ZfsEntity
+	)
+	if prop, err := ds.GetProperty(zfs.DatasetPropName); err != nil {
+		log.Errorf("zfsGetProperties: %v", err)
+	} else {
+		res.Name = prop.Value
+	}
+	if prop, err := ds.GetProperty(zfs.DatasetPropUsed); err != nil {
+		log.Errorf("zfsGetProperties: %v", err)
+	} else {
+		res.Used = prop.Value
+	}
+	if prop, err := ds.GetProperty(zfs.DatasetPropAvailable); err != nil {
+		res.Avail = "-"
+	} else {
+		res.Avail = prop.Value
+	}
+	if prop, err := ds.GetProperty(zfs.DatasetPropReferenced); err != nil {
+		log.Errorf("zfsGetProperties: %v", err)
+	} else {
+		res.Refer = prop.Value
+	}
+	if prop, err := ds.GetProperty(zfs.DatasetPropMountpoint); err != nil {
+		res.MountPoint = "-"
+	} else {
+		res.MountPoint = prop.Value
+	}
+	return res
+}
+
+func zfsGetChildren(ds *zfs.Dataset) []*zfs.Dataset {
+	var (
+		res []*zfs.Dataset
+	)
+	if len(ds.Children) == 0 {
+		return append(res, ds)
+	} else {
+		res = append(res, ds)
+		for _, v := range ds.Children {
+			res = append(res, zfsGetChildren(&v)...)
+		}
+	}
+
+	return res
+}
+
+func (b *ZfsLibBackend) ListAll() ([]ZfsEntity, error) {
+	var (
+		ds  []*zfs.Dataset
+		res []ZfsEntity
+		err error
+	)
+	if datasets, err := zfs.DatasetOpenAll(); err != nil {
+		return res, zfsError(err)
+	} else {
+		for _, v := range datasets {
+			ds = append(ds, zfsGetChildren(&v)...)
+		}
+		for _, v := range ds {
+			res = append(res, zfsGetProperties(v))
+		}
+		zfs.DatasetCloseAll(datasets)
+	}
+	return res, err
+}
+
+func (b *ZfsLibBackend) CreateSnapshot(snapsource string, snapname string) error {
+	var (
+		err error
+		rd  zfs.Dataset
+	)
+	props := make(map[zfs.Prop]zfs.Property)
+
+	if rd, err = zfs.DatasetSnapshot(fmt.Sprintf("%s@%s", snapsource, snapname), false, props); err == nil {
+		path, _ := rd.Path()
+		log.Printf("Snapshot %s created\n", path)
+	}
+	return zfsError(err)
+}
+
+func (b *ZfsLibBackend) GetLastSnapshot(DsPath string) (string, error) {
+	var (
+		res   string
+		err   error
+		maxTs int64 = 0
+		ds    zfs.Dataset
+	)
+
+	if ds, err = zfs.DatasetOpen(DsPath); err == nil {
+		if dsSnapshots, err := ds.Snapshots(); err != nil {
+			return res, zfsError(err)
+		} else {
+			for _, s := range dsSnapshots {
+				path, _ := s.Path()
+				creation, _ := s.GetProperty(zfs.DatasetPropCreation)
+				ts, _ := strconv.ParseInt(creation.Value, 10, 64)
+				if ts >= maxTs {
+					maxTs = ts
+					res = path
+				}
+			}
+		}
+	}
+
+	return res, zfsError(err)
+}
+
+func (b *ZfsLibBackend) GetCloneInfo(ClonePath string) (map[string]string, error) {
+	var (
+		res map[string]string
+		err error
+		ds  zfs.Dataset
+	)
+	res = make(map[string]string)
+	if ds, err = zfs.DatasetOpenSingle(ClonePath); err == nil {
+		propOrigin, _ := ds.GetProperty(zfs.DatasetPropOrigin)
+		res["origin"] = propOrigin.Value
+		propWritten, _ := ds.GetProperty(zfs.DatasetPropWritten)
+		res["written"] = propWritten.Value
+	}
+	return res, zfsError(err)
+}
+
+func (b *ZfsLibBackend) DestroyDataset(dataset string) (err error) {
+	var (
+		ds zfs.Dataset
+	)
+	if ds, err = zfs.DatasetOpenSingle(dataset); err == nil {
+		err = ds.DestroyRecursive()
+		ds.Close()
+	}
+	return zfsError(err)
+}
+
+func (b *ZfsLibBackend) Clone(origin string, dataset string) (err error) {
+	var (
+		ds_origin, ds_target zfs.Dataset
+	)
+	if ds_origin, err = zfs.DatasetOpenSingle(origin); err == nil {
+		props := make(map[zfs.Prop]zfs.Property)
+		ds_target, err = ds_origin.Clone(dataset, props)
+	}
+	ds_origin.Close()
+	ds_target.Close()
+
+	return zfsError(err)
+}
+
+func (b *ZfsLibBackend) CloneLast(origin string, dataset string) (err error) {
+	var (
+		ds_origin, ds_target zfs.Dataset
+		lastSnapshot         string
+	)
+
+	if lastSnapshot, err = b.GetLastSnapshot(origin); err == nil {
+		if ds_origin, err = zfs.DatasetOpenSingle(lastSnapshot); err == nil {
+			props := make(map[zfs.Prop]zfs.Property)
+			ds_target, err = ds_origin.Clone(dataset, props)
+		}
+	}
+	ds_origin.Close()
+	ds_target.Close()
+
+	return zfsError(err)
+}
+
+func (b *ZfsLibBackend) Rollback(snapshot string) (err error) {
+	var (
+		ds, ds_snap zfs.Dataset
+	)
+	ds_path := strings.Split(snapshot, "@")[0]
+	if ds, err = zfs.DatasetOpenSingle(ds_path); err == nil {
+		if ds_snap, err = zfs.DatasetOpenSingle(snapshot); err == nil {
+			err = ds.Rollback(&ds_snap, true)
+		}
+	}
+	ds_snap.Close()
+	ds.Close()
+	return zfsError(err)
+}
+
+func (b *ZfsLibBackend) CheckDatasetExists(dataset string) (res bool, err error) {
+	var (
+		ds zfs.Dataset
+	)
+	if ds, err = zfs.DatasetOpenSingle(dataset); err != nil {
+		if strings.Contains(err.Error(), "dataset does not exist") {
+			res = false
+			err = nil
+		} else {
+			err = zfsError(err)
+		}
+	} else {
+		res = true
+	}
+	ds.Close()
+	return
+}
+
+func zfsPropByName(name string) (prop zfs.Prop, ok bool) {
+	for prop = zfs.DatasetPropType; prop < zfs.DatasetNumProps; prop++ {
+		if zfs.DatasetPropertyToName(prop) == name {
+			return prop, true
+		}
+	}
+	return
+}
+
+func (b *ZfsLibBackend) GetProperty(dataset string, name string) (res string, err error) {
+	var (
+		ds zfs.Dataset
+	)
+	if ds, err = zfs.DatasetOpenSingle(dataset); err == nil {
+		var prop zfs.Property
+		if p, ok := zfsPropByName(name); ok {
+			prop, err = ds.GetProperty(p)
+		} else {
+			prop, err = ds.GetUserProperty(name)
+		}
+		if err == nil {
+			res = prop.Value
+		}
+		ds.Close()
+	}
+	return res, zfsError(err)
+}
+
+func (b *ZfsLibBackend) SetProperty(dataset string, name string, val string) (err error) {
+	var (
+		ds zfs.Dataset
+	)
+	if ds, err = zfs.DatasetOpenSingle(dataset); err == nil {
+		if p, ok := zfsPropByName(name); ok {
+			err = ds.SetProperty(p, val)
+		} else {
+			err = ds.SetUserProperty(name, val)
+		}
+		ds.Close()
+	}
+	return zfsError(err)
+}
@@ -0,0 +1,38 @@
+package pk_zfs
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestZfsError(t *testing.T) {
+	for _, c := range []struct {
+		msg  string
+		want error
+	}{
+		{"cannot open 'tank/vol1': dataset does not exist", ErrNotFound},
+		{"cannot create 'tank/a/vol1': parent does not exist", ErrNotFound},
+		{"cannot create 'tank/vol1': dataset already exists", ErrExists},
+		{"cannot destroy 'tank/vol1': dataset is busy", ErrBusy},
+		{"cannot destroy 'tank/vol1': pool or dataset is busy", ErrBusy},
+		{"cannot destroy 'tank/vol1': volume has dependent clones\nuse '-R' to destroy the following datasets:\ntank/vol2", ErrBusy},
+		{"cannot destroy 'tank/games': filesystem has dependent clones", ErrBusy},
+		{"cannot destroy 'tank/vol1@v1': snapshot has dependent clones", ErrBusy},
+		{"cannot rollback to 'tank/vol1@v1': clones of previous snapshots exist", ErrBusy},
+		{"cannot set property for 'tank/vol1': 'origin' is readonly", nil},
+		{"cannot clone 'tank/vol1': not a snapshot", nil},
+	} {
+		err := zfsError(errors.New(c.msg))
+		for _, kind := range []error{ErrNotFound, ErrExists, ErrBusy} {
+			if got := errors.Is(err, kind); got != (kind == c.want) {
+				t.Errorf("%q: errors.Is(%v) = %v", c.msg, kind, got)
+			}
+		}
+		if err.Error() != c.msg {
+			t.Errorf("%q: message changed to %q", c.msg, err.Error())
+		}
+	}
+	if zfsError(nil) != nil {
+		t.Errorf("zfsError(nil) is not nil")
+	}
+}
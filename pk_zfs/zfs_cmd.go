@@ -0,0 +1,151 @@
+package pk_zfs
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// ZfsCmdBackend drives the zfs command and parses its -Hp output, so it
+// needs neither cgo nor a particular libzfs ABI.
+type ZfsCmdBackend struct {
+	Zfs string
+}
+
+func NewZfsCmdBackend() *ZfsCmdBackend {
+	return &ZfsCmdBackend{Zfs: "zfs"}
+}
+
+// run returns the output of zfs, on failure only the error with what zfs
+// printed to stderr.
+func (b *ZfsCmdBackend) run(args ...string) (res string, err error) {
+	var (
+		stderr bytes.Buffer
+		out    []byte
+	)
+	cmd := exec.Command(b.Zfs, args...)
+	cmd.Stderr = &stderr
+	if out, err = cmd.Output(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		return "", zfsError(fmt.Errorf("zfs %s: %s", strings.Join(args, " "), msg))
+	}
+	res = strings.TrimSpace(string(out))
+	return
+}
+
+func (b *ZfsCmdBackend) lines(args ...string) (res [][]string, err error) {
+	var (
+		out string
+	)
+	if out, err = b.run(args...); err == nil && out != "" {
+		for _, line := range strings.Split(out, "\n") {
+			res = append(res, strings.Split(line, "\t"))
+		}
+	}
+	return
+}
+
+func (b *ZfsCmdBackend) ListAll() (res []ZfsEntity, err error) {
+	var (
+		lines [][]string
+	)
+	if lines, err = b.lines("list", "-Hp", "-t", "filesystem,volume,snapshot", "-o", "name,used,avail,refer,mountpoint"); err == nil {
+		for _, fields := range lines {
+			if len(fields) == 5 {
+				res = append(res, ZfsEntity{
+					Name:       fields[0],
+					Used:       fields[1],
+					Avail:      fields[2],
+					Refer:      fields[3],
+					MountPoint: fields[4],
+				})
+			}
+		}
+	}
+	return
+}
+
+func (b *ZfsCmdBackend) CreateSnapshot(snapsource string, snapname string) (err error) {
+	snapshot := fmt.Sprintf("%s@%s", snapsource, snapname)
+	if _, err = b.run("snapshot", snapshot); err == nil {
+		log.Printf("Snapshot %s created\n", snapshot)
+	}
+	return
+}
+
+func (b *ZfsCmdBackend) GetLastSnapshot(dataset string) (res string, err error) {
+	var (
+		lines [][]string
+	)
+	if lines, err = b.lines("list", "-Hp", "-t", "snapshot", "-d", "1", "-s", "creation", "-o", "name", dataset); err == nil && len(lines) > 0 {
+		res = lines[len(lines)-1][0]
+	}
+	return
+}
+
+func (b *ZfsCmdBackend) GetCloneInfo(clone string) (res map[string]string, err error) {
+	var (
+		lines [][]string
+	)
+	res = make(map[string]string)
+	if lines, err = b.lines("get", "-Hp", "-o", "property,value", "origin,written", clone); err == nil {
+		for _, fields := range lines {
+			if len(fields) == 2 {
+				res[fields[0]] = fields[1]
+			}
+		}
+	}
+	return
+}
+
+func (b *ZfsCmdBackend) DestroyDataset(dataset string) (err error) {
+	_, err = b.run("destroy", "-r", dataset)
+	return
+}
+
+func (b *ZfsCmdBackend) Clone(origin string, dataset string) (err error) {
+	_, err = b.run("clone", origin, dataset)
+	return
+}
+
+func (b *ZfsCmdBackend) CloneLast(origin string, dataset string) (err error) {
+	var (
+		lastSnapshot string
+	)
+	if lastSnapshot, err = b.GetLastSnapshot(origin); err == nil {
+		if lastSnapshot == "" {
+			err = &ZfsError{Kind: ErrNotFound, Err: fmt.Errorf("%s has no snapshots", origin)}
+		} else {
+			err = b.Clone(lastSnapshot, dataset)
+		}
+	}
+	return
+}
+
+func (b *ZfsCmdBackend) Rollback(snapshot string) (err error) {
+	_, err = b.run("rollback", "-r", snapshot)
+	return
+}
+
+func (b *ZfsCmdBackend) CheckDatasetExists(dataset string) (res bool, err error) {
+	if _, err = b.run("list", "-H", "-o", "name", dataset); err == nil {
+		res = true
+	} else if strings.Contains(err.Error(), "dataset does not exist") {
+		err = nil
+	}
+	return
+}
+
+func (b *ZfsCmdBackend) GetProperty(dataset string, prop string) (res string, err error) {
+	res, err = b.run("get", "-Hp", "-o", "value", prop, dataset)
+	return
+}
+
+func (b *ZfsCmdBackend) SetProperty(dataset string, prop string, val string) (err error) {
+	_, err = b.run("set", prop+"="+val, dataset)
+	return
+}
@@ -0,0 +1,67 @@
+package pk_zfs
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+)
+
+// stubZfs returns a backend running a script that prints stdout and
+// stderr and exits with code instead of zfs.
+func stubZfs(t *testing.T, stdout string, stderr string, code int) *ZfsCmdBackend {
+	t.Helper()
+	dir := t.TempDir()
+	script := "#!/bin/sh\ncat " + path.Join(dir, "stdout") + "\ncat " + path.Join(dir, "stderr") + " >&2\nexit " + strconv.Itoa(code) + "\n"
+	for name, data := range map[string]string{"stdout": stdout, "stderr": stderr, "zfs": script} {
+		if err := os.WriteFile(path.Join(dir, name), []byte(data), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &ZfsCmdBackend{Zfs: path.Join(dir, "zfs")}
+}
+
+func TestZfsCmdGetProperty(t *testing.T) {
+	b := stubZfs(t, "10737418240\n", "", 0)
+	if val, err := b.GetProperty("tank/vol1", "volsize"); err != nil || val != "10737418240" {
+		t.Errorf("GetProperty = %q, %v", val, err)
+	}
+
+	b = stubZfs(t, "", "cannot open 'tank/vol1': dataset does not exist\n", 1)
+	val, err := b.GetProperty("tank/vol1", "volsize")
+	if val != "" {
+		t.Errorf("GetProperty of a missing dataset returned value %q", val)
+	}
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetProperty of a missing dataset returned %v", err)
+	}
+
+	// Warnings on stderr are not part of the value.
+	b = stubZfs(t, "-\n", "warning: something\n", 0)
+	if val, err := b.GetProperty("tank/vol1", "origin"); err != nil || val != "-" {
+		t.Errorf("GetProperty with a warning = %q, %v", val, err)
+	}
+}
+
+func TestZfsCmdErrorKinds(t *testing.T) {
+	for _, c := range []struct {
+		stderr string
+		do     func(b *ZfsCmdBackend) error
+		want   error
+	}{
+		{"cannot destroy 'tank/vol1': volume has dependent clones\n", func(b *ZfsCmdBackend) error {
+			return b.DestroyDataset("tank/vol1")
+		}, ErrBusy},
+		{"cannot rollback to 'tank/vol1@v1': clones of previous snapshots exist\n", func(b *ZfsCmdBackend) error {
+			return b.Rollback("tank/vol1@v1")
+		}, ErrBusy},
+		{"cannot create 'tank/vol2': dataset already exists\n", func(b *ZfsCmdBackend) error {
+			return b.Clone("tank/vol1@v1", "tank/vol2")
+		}, ErrExists},
+	} {
+		if err := c.do(stubZfs(t, "", c.stderr, 1)); !errors.Is(err, c.want) {
+			t.Errorf("%q: got %v, want kind %v", c.stderr, err, c.want)
+		}
+	}
+}
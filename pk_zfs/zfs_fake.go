@@ -0,0 +1,538 @@
+package pk_zfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ZFS_FAKE_FILESYSTEM string = "filesystem"
+	ZFS_FAKE_VOLUME     string = "volume"
+	ZFS_FAKE_SNAPSHOT   string = "snapshot"
+)
+
+var zfsFakeReadOnlyProps = map[string]bool{
+	"name":       true,
+	"type":       true,
+	"used":       true,
+	"available":  true,
+	"referenced": true,
+	"written":    true,
+	"origin":     true,
+	"creation":   true,
+	"createtxg":  true,
+	"clones":     true,
+}
+
+type zfsFakeDataset struct {
+	name      string
+	kind      string
+	creation  int64
+	createtxg uint64
+	origin    string
+	volsize   uint64
+	refer     uint64
+	own       uint64
+	written   uint64
+	props     map[string]string
+}
+
+// ZfsFake is an in-memory ZfsBackend. Volumes get a sparse file of their
+// volsize under DevRoot, laid out like /dev/zvol, when DevRoot is set.
+//
+// Writes are modelled as new blocks: they grow referenced, used and written
+// of the dataset, so snapshots never own space of their own. A clone starts
+// out sharing everything with its origin and is only charged for what is
+// written to it.
+type ZfsFake struct {
+	DevRoot string
+	Now     func() time.Time
+	mu      sync.Mutex
+	txg     uint64
+	pools   map[string]uint64
+	ds      map[string]*zfsFakeDataset
+}
+
+func NewZfsFake(devRoot string) *ZfsFake {
+	return &ZfsFake{
+		DevRoot: devRoot,
+		Now:     time.Now,
+		pools:   map[string]uint64{},
+		ds:      map[string]*zfsFakeDataset{},
+	}
+}
+
+func zfsFakeError(kind error, format string, args ...interface{}) error {
+	return &ZfsError{Kind: kind, Err: fmt.Errorf(format, args...)}
+}
+
+func zfsFakePool(name string) string {
+	return strings.SplitN(strings.SplitN(name, "@", 2)[0], "/", 2)[0]
+}
+
+func zfsFakeParent(name string) string {
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		return name[:i]
+	}
+	return ""
+}
+
+func (f *ZfsFake) add(name string, kind string) (ds *zfsFakeDataset, err error) {
+	if _, isPool := f.pools[name]; kind != ZFS_FAKE_SNAPSHOT && !isPool && !strings.Contains(name, "/") {
+		return nil, fmt.Errorf("cannot create '%s': missing dataset name", name)
+	}
+	if _, ok := f.ds[name]; ok {
+		return nil, zfsFakeError(ErrExists, "cannot create '%s': dataset already exists", name)
+	}
+	parent := zfsFakeParent(strings.SplitN(name, "@", 2)[0])
+	if kind == ZFS_FAKE_SNAPSHOT {
+		parent = strings.SplitN(name, "@", 2)[0]
+	}
+	if parent != "" {
+		if p, ok := f.ds[parent]; !ok {
+			return nil, zfsFakeError(ErrNotFound, "cannot create '%s': parent does not exist", name)
+		} else if p.kind != ZFS_FAKE_FILESYSTEM && kind != ZFS_FAKE_SNAPSHOT {
+			return nil, fmt.Errorf("cannot create '%s': parent is not a filesystem", name)
+		}
+	}
+	f.txg++
+	ds = &zfsFakeDataset{
+		name:      name,
+		kind:      kind,
+		creation:  f.Now().Unix(),
+		createtxg: f.txg,
+		props:     map[string]string{},
+	}
+	f.ds[name] = ds
+	return
+}
+
+func (f *ZfsFake) devPath(name string) string {
+	return filepath.Join(f.DevRoot, filepath.FromSlash(name))
+}
+
+func (f *ZfsFake) syncDev(ds *zfsFakeDataset) (err error) {
+	if f.DevRoot == "" || ds.kind != ZFS_FAKE_VOLUME {
+		return
+	}
+	devPath := f.devPath(ds.name)
+	if err = os.MkdirAll(filepath.Dir(devPath), 0755); err != nil {
+		return
+	}
+	if file, err := os.OpenFile(devPath, os.O_CREATE|os.O_WRONLY, 0660); err != nil {
+		return err
+	} else {
+		defer file.Close()
+		return file.Truncate(int64(ds.volsize))
+	}
+}
+
+func (f *ZfsFake) removeDev(ds *zfsFakeDataset) {
+	if f.DevRoot != "" && ds.kind == ZFS_FAKE_VOLUME {
+		os.Remove(f.devPath(ds.name))
+	}
+}
+
+// CreatePool creates the root filesystem of a pool with size bytes of space.
+func (f *ZfsFake) CreatePool(name string, size uint64) (err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if strings.ContainsAny(name, "/@") {
+		return fmt.Errorf("cannot create '%s': invalid pool name", name)
+	}
+	if _, ok := f.pools[name]; ok {
+		return zfsFakeError(ErrExists, "cannot create '%s': pool already exists", name)
+	}
+	f.pools[name] = size
+	if _, err = f.add(name, ZFS_FAKE_FILESYSTEM); err != nil {
+		delete(f.pools, name)
+	}
+	return
+}
+
+func (f *ZfsFake) CreateFilesystem(name string) (err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, err = f.add(name, ZFS_FAKE_FILESYSTEM)
+	return
+}
+
+func (f *ZfsFake) CreateVolume(name string, size uint64) (err error) {
+	var (
+		ds *zfsFakeDataset
+	)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if ds, err = f.add(name, ZFS_FAKE_VOLUME); err == nil {
+		ds.volsize = size
+		if err = f.syncDev(ds); err != nil {
+			delete(f.ds, name)
+		}
+	}
+	return
+}
+
+// Write accounts n bytes of new data written to a filesystem or volume.
+func (f *ZfsFake) Write(name string, n uint64) (err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ds, ok := f.ds[name]
+	if !ok {
+		return zfsFakeError(ErrNotFound, "cannot open '%s': dataset does not exist", name)
+	}
+	if ds.kind == ZFS_FAKE_SNAPSHOT {
+		return fmt.Errorf("cannot write to '%s': snapshots are read-only", name)
+	}
+	if ds.kind == ZFS_FAKE_VOLUME && ds.refer+n > ds.volsize {
+		n = ds.volsize - ds.refer
+	}
+	if avail := f.available(name); n > avail {
+		return fmt.Errorf("cannot write to '%s': out of space", name)
+	}
+	ds.refer += n
+	ds.own += n
+	ds.written += n
+	return
+}
+
+func (f *ZfsFake) snapshots(name string) (res []*zfsFakeDataset) {
+	for _, ds := range f.ds {
+		if ds.kind == ZFS_FAKE_SNAPSHOT && strings.HasPrefix(ds.name, name+"@") {
+			res = append(res, ds)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].creation != res[j].creation {
+			return res[i].creation < res[j].creation
+		}
+		return res[i].createtxg < res[j].createtxg
+	})
+	return
+}
+
+// subtree returns name with all its descendants and their snapshots, or
+// every dataset when name is empty.
+func (f *ZfsFake) subtree(name string) (res []*zfsFakeDataset) {
+	for _, ds := range f.ds {
+		if name == "" || ds.name == name || strings.HasPrefix(ds.name, name+"/") || strings.HasPrefix(ds.name, name+"@") {
+			res = append(res, ds)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].name < res[j].name })
+	return
+}
+
+func (f *ZfsFake) clones(snapshot string) (res []string) {
+	for _, ds := range f.ds {
+		if ds.origin == snapshot {
+			res = append(res, ds.name)
+		}
+	}
+	sort.Strings(res)
+	return
+}
+
+func (f *ZfsFake) used(ds *zfsFakeDataset) (res uint64) {
+	if ds.kind == ZFS_FAKE_SNAPSHOT {
+		return 0
+	}
+	res = ds.own
+	for _, child := range f.ds {
+		if child.kind != ZFS_FAKE_SNAPSHOT && zfsFakeParent(child.name) == ds.name {
+			res += f.used(child)
+		}
+	}
+	return
+}
+
+func (f *ZfsFake) available(name string) (res uint64) {
+	pool := zfsFakePool(name)
+	if root, ok := f.ds[pool]; ok {
+		if used := f.used(root); used < f.pools[pool] {
+			res = f.pools[pool] - used
+		}
+	}
+	return
+}
+
+func (f *ZfsFake) property(ds *zfsFakeDataset, prop string) (res string, ok bool) {
+	ok = true
+	switch prop {
+	case "name":
+		res = ds.name
+	case "type":
+		res = ds.kind
+	case "used":
+		res = strconv.FormatUint(f.used(ds), 10)
+	case "available":
+		res = "-"
+		if ds.kind != ZFS_FAKE_SNAPSHOT {
+			res = strconv.FormatUint(f.available(ds.name), 10)
+		}
+	case "referenced":
+		res = strconv.FormatUint(ds.refer, 10)
+	case "written":
+		res = strconv.FormatUint(ds.written, 10)
+	case "origin":
+		res = "-"
+		if ds.origin != "" {
+			res = ds.origin
+		}
+	case "creation":
+		res = strconv.FormatInt(ds.creation, 10)
+	case "createtxg":
+		res = strconv.FormatUint(ds.createtxg, 10)
+	case "clones":
+		res = strings.Join(f.clones(ds.name), ",")
+	case "volsize":
+		res = "-"
+		if ds.kind == ZFS_FAKE_VOLUME {
+			res = strconv.FormatUint(ds.volsize, 10)
+		}
+	case "mountpoint":
+		res = "-"
+		if ds.kind == ZFS_FAKE_FILESYSTEM {
+			res = "/" + ds.name
+		}
+	default:
+		res, ok = ds.props[prop]
+	}
+	return
+}
+
+func (f *ZfsFake) ListAll() (res []ZfsEntity, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, ds := range f.subtree("") {
+		res = append(res, f.entity(ds))
+	}
+	return
+}
+
+func (f *ZfsFake) entity(ds *zfsFakeDataset) ZfsEntity {
+	used, _ := f.property(ds, "used")
+	avail, _ := f.property(ds, "available")
+	refer, _ := f.property(ds, "referenced")
+	mountpoint, _ := f.property(ds, "mountpoint")
+	return ZfsEntity{Name: ds.name, Used: used, Avail: avail, Refer: refer, MountPoint: mountpoint}
+}
+
+func (f *ZfsFake) CreateSnapshot(snapsource string, snapname string) (err error) {
+	var (
+		snap *zfsFakeDataset
+	)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ds, ok := f.ds[snapsource]
+	if !ok || ds.kind == ZFS_FAKE_SNAPSHOT {
+		return zfsFakeError(ErrNotFound, "cannot open '%s': dataset does not exist", snapsource)
+	}
+	if snap, err = f.add(snapsource+"@"+snapname, ZFS_FAKE_SNAPSHOT); err == nil {
+		snap.refer = ds.refer
+		snap.own = ds.own
+		snap.volsize = ds.volsize
+		ds.written = 0
+	}
+	return
+}
+
+func (f *ZfsFake) GetLastSnapshot(dataset string) (res string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.ds[dataset]; !ok {
+		return "", zfsFakeError(ErrNotFound, "cannot open '%s': dataset does not exist", dataset)
+	}
+	if snaps := f.snapshots(dataset); len(snaps) > 0 {
+		res = snaps[len(snaps)-1].name
+	}
+	return
+}
+
+func (f *ZfsFake) GetCloneInfo(clone string) (res map[string]string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	res = make(map[string]string)
+	if ds, ok := f.ds[clone]; !ok {
+		err = zfsFakeError(ErrNotFound, "cannot open '%s': dataset does not exist", clone)
+	} else {
+		res["origin"], _ = f.property(ds, "origin")
+		res["written"], _ = f.property(ds, "written")
+	}
+	return
+}
+
+// DestroyDataset destroys dataset with its descendants and snapshots like
+// zfs destroy -r. It refuses when a snapshot in the tree has clones outside
+// of it.
+func (f *ZfsFake) DestroyDataset(dataset string) (err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.ds[dataset]; !ok {
+		return zfsFakeError(ErrNotFound, "cannot open '%s': dataset does not exist", dataset)
+	}
+	if _, ok := f.pools[dataset]; ok {
+		return fmt.Errorf("cannot destroy '%s': operation does not apply to pools", dataset)
+	}
+	tree := f.subtree(dataset)
+	if strings.Contains(dataset, "@") {
+		tree = []*zfsFakeDataset{f.ds[dataset]}
+	}
+	inTree := map[string]bool{}
+	for _, ds := range tree {
+		inTree[ds.name] = true
+	}
+	for _, ds := range tree {
+		for _, clone := range f.clones(ds.name) {
+			if !inTree[clone] {
+				return zfsFakeError(ErrBusy, "cannot destroy '%s': filesystem has dependent clones", dataset)
+			}
+		}
+	}
+	for _, ds := range tree {
+		f.removeDev(ds)
+		delete(f.ds, ds.name)
+	}
+	return
+}
+
+func (f *ZfsFake) clone(origin string, dataset string) (err error) {
+	var (
+		ds *zfsFakeDataset
+	)
+	snap, ok := f.ds[origin]
+	if !ok {
+		return zfsFakeError(ErrNotFound, "cannot open '%s': dataset does not exist", origin)
+	}
+	if snap.kind != ZFS_FAKE_SNAPSHOT {
+		return fmt.Errorf("cannot clone '%s': not a snapshot", origin)
+	}
+	kind := f.ds[strings.SplitN(origin, "@", 2)[0]].kind
+	if ds, err = f.add(dataset, kind); err == nil {
+		ds.origin = origin
+		ds.refer = snap.refer
+		ds.volsize = snap.volsize
+		if err = f.syncDev(ds); err != nil {
+			delete(f.ds, dataset)
+		}
+	}
+	return
+}
+
+func (f *ZfsFake) Clone(origin string, dataset string) (err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.clone(origin, dataset)
+}
+
+func (f *ZfsFake) CloneLast(origin string, dataset string) (err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.ds[origin]; !ok {
+		return zfsFakeError(ErrNotFound, "cannot open '%s': dataset does not exist", origin)
+	}
+	snaps := f.snapshots(origin)
+	if len(snaps) == 0 {
+		return zfsFakeError(ErrNotFound, "%s has no snapshots", origin)
+	}
+	return f.clone(snaps[len(snaps)-1].name, dataset)
+}
+
+// Rollback reverts the dataset to snapshot and destroys the snapshots taken
+// after it like zfs rollback -r. It refuses when one of them has clones.
+func (f *ZfsFake) Rollback(snapshot string) (err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	snap, ok := f.ds[snapshot]
+	if !ok || snap.kind != ZFS_FAKE_SNAPSHOT {
+		return zfsFakeError(ErrNotFound, "cannot open '%s': dataset does not exist", snapshot)
+	}
+	ds := f.ds[strings.SplitN(snapshot, "@", 2)[0]]
+	var newer []*zfsFakeDataset
+	for _, s := range f.snapshots(ds.name) {
+		if s.createtxg > snap.createtxg {
+			if len(f.clones(s.name)) > 0 {
+				return zfsFakeError(ErrBusy, "cannot rollback to '%s': clones of previous snapshots exist", snapshot)
+			}
+			newer = append(newer, s)
+		}
+	}
+	for _, s := range newer {
+		delete(f.ds, s.name)
+	}
+	ds.refer = snap.refer
+	ds.own = snap.own
+	ds.written = 0
+	return
+}
+
+func (f *ZfsFake) CheckDatasetExists(dataset string) (res bool, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, res = f.ds[dataset]
+	return
+}
+
+func (f *ZfsFake) GetProperty(dataset string, prop string) (res string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ds, ok := f.ds[dataset]
+	if !ok {
+		return "", zfsFakeError(ErrNotFound, "cannot open '%s': dataset does not exist", dataset)
+	}
+	if res, ok = f.property(ds, prop); !ok {
+		if !strings.Contains(prop, ":") {
+			return "", fmt.Errorf("bad property list: invalid property '%s'", prop)
+		}
+		res = "-"
+	}
+	return
+}
+
+func (f *ZfsFake) SetProperty(dataset string, prop string, val string) (err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ds, ok := f.ds[dataset]
+	if !ok {
+		return zfsFakeError(ErrNotFound, "cannot open '%s': dataset does not exist", dataset)
+	}
+	switch {
+	case zfsFakeReadOnlyProps[prop]:
+		return fmt.Errorf("cannot set property for '%s': '%s' is readonly", dataset, prop)
+	case prop == "volsize":
+		if ds.kind != ZFS_FAKE_VOLUME {
+			return fmt.Errorf("cannot set property for '%s': 'volsize' does not apply to datasets of this type", dataset)
+		}
+		size, err := strconv.ParseUint(val, 10, 64)
+		if err != nil || size == 0 {
+			return fmt.Errorf("cannot set property for '%s': bad numeric value '%s'", dataset, val)
+		}
+		if size > ds.volsize && size-ds.volsize > f.available(dataset) {
+			return fmt.Errorf("cannot set property for '%s': size is greater than available space", dataset)
+		}
+		ds.volsize = size
+		if ds.refer > size {
+			ds.refer = size
+		}
+		return f.syncDev(ds)
+	case ds.kind == ZFS_FAKE_SNAPSHOT && !strings.Contains(prop, ":"):
+		return fmt.Errorf("cannot set property for '%s': this property can not be modified for snapshots", dataset)
+	}
+	ds.props[prop] = val
+	return
+}
+
+// Datasets lists the names of all datasets, snapshots included.
+func (f *ZfsFake) Datasets() (res []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, ds := range f.subtree("") {
+		res = append(res, ds.name)
+	}
+	return
+}
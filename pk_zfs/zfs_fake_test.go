@@ -0,0 +1,80 @@
+package pk_zfs
+
+import (
+	"errors"
+	"testing"
+)
+
+// newFakePool returns a fake with the volume tank/vol1, its snapshots v1
+// and v2, the clone tank/clone1 of v2 and the filesystem tank/empty.
+func newFakePool(t *testing.T) (f *ZfsFake) {
+	t.Helper()
+	f = NewZfsFake(t.TempDir())
+	for _, step := range []func() error{
+		func() error { return f.CreatePool("tank", 1<<30) },
+		func() error { return f.CreateVolume("tank/vol1", 10<<20) },
+		func() error { return f.CreateFilesystem("tank/empty") },
+		func() error { return f.CreateSnapshot("tank/vol1", "v1") },
+		func() error { return f.CreateSnapshot("tank/vol1", "v2") },
+		func() error { return f.Clone("tank/vol1@v2", "tank/clone1") },
+	} {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return
+}
+
+func TestZfsFakeRefusals(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		do   func(f *ZfsFake) error
+		want error
+		// kept must still exist after the refusal.
+		kept []string
+	}{
+		{"create over an existing dataset", func(f *ZfsFake) error {
+			return f.CreateVolume("tank/vol1", 20<<20)
+		}, ErrExists, []string{"tank/vol1"}},
+		{"clone over an existing dataset", func(f *ZfsFake) error {
+			return f.Clone("tank/vol1@v1", "tank/clone1")
+		}, ErrExists, []string{"tank/clone1"}},
+		{"create with a missing parent", func(f *ZfsFake) error {
+			return f.CreateVolume("tank/missing/vol2", 10<<20)
+		}, ErrNotFound, nil},
+		{"destroy with dependent clones", func(f *ZfsFake) error {
+			return f.DestroyDataset("tank/vol1")
+		}, ErrBusy, []string{"tank/vol1", "tank/vol1@v1", "tank/vol1@v2", "tank/clone1"}},
+		{"destroy a snapshot with clones", func(f *ZfsFake) error {
+			return f.DestroyDataset("tank/vol1@v2")
+		}, ErrBusy, []string{"tank/vol1@v2"}},
+		{"rollback past clones", func(f *ZfsFake) error {
+			return f.Rollback("tank/vol1@v1")
+		}, ErrBusy, []string{"tank/vol1@v2", "tank/clone1"}},
+		{"clone the last snapshot of a dataset without snapshots", func(f *ZfsFake) error {
+			return f.CloneLast("tank/empty", "tank/clone2")
+		}, ErrNotFound, []string{"tank/empty"}},
+		{"clone the last snapshot of a missing dataset", func(f *ZfsFake) error {
+			return f.CloneLast("tank/missing", "tank/clone2")
+		}, ErrNotFound, nil},
+		{"destroy a missing dataset", func(f *ZfsFake) error {
+			return f.DestroyDataset("tank/missing")
+		}, ErrNotFound, nil},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			f := newFakePool(t)
+			err := c.do(f)
+			if !errors.Is(err, c.want) {
+				t.Fatalf("got %v, want kind %v", err, c.want)
+			}
+			for _, name := range c.kept {
+				if exists, _ := f.CheckDatasetExists(name); !exists {
+					t.Errorf("%s gone after the refusal", name)
+				}
+			}
+			if exists, _ := f.CheckDatasetExists("tank/clone2"); exists {
+				t.Errorf("tank/clone2 created by a refused clone")
+			}
+		})
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !scstsim
+
+package main
+
+import (
+	scst "github.com/Tualua/pk_ctladm/pk_scst"
+)
+
+// setScstRoot points ctladm at the SCST sysfs tree under root.
+func setScstRoot(root string) (err error) {
+	scst.ScstSetRoot(root)
+	return
+}
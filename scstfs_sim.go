@@ -0,0 +1,25 @@
+//go:build scstsim
+
+package main
+
+import (
+	"fmt"
+
+	scst "github.com/Tualua/pk_ctladm/pk_scst"
+	scstsim "github.com/Tualua/pk_ctladm/pk_scstsim"
+)
+
+// setScstRoot runs ctladm against the SCST simulator in root. Only binaries
+// built with -tags scstsim for integration.sh and the conformance harness
+// have it.
+func setScstRoot(root string) (err error) {
+	var (
+		sim *scstsim.ScstSim
+	)
+	if sim, err = scstsim.New(root); err != nil {
+		return fmt.Errorf("cannot start SCST simulator in %s: %w", root, err)
+	}
+	log.Warn("Using SCST simulator in ", root)
+	scst.ScstSetFS(sim)
+	return
+}
@@ -0,0 +1,45 @@
+// Command scstsim drives the SCST simulator from scripts. integration.sh
+// uses it to log initiators into targets, which only the network does on a
+// real SCST.
+//
+// Usage, from the repository root:
+//
+//	go run ./scstsim -root dir login target initiator ip
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	scstsim "github.com/Tualua/pk_ctladm/pk_scstsim"
+)
+
+func run(root string, args []string) (err error) {
+	var (
+		sim     *scstsim.ScstSim
+		session string
+	)
+	if len(args) != 4 || args[0] != "login" {
+		return fmt.Errorf("usage: scstsim -root dir login target initiator ip")
+	}
+	if sim, err = scstsim.New(root); err != nil {
+		return
+	}
+	if session, err = sim.AddSession(args[1], args[2], args[3]); err == nil {
+		fmt.Println(session)
+	}
+	return
+}
+
+func main() {
+	root := flag.String("root", "", "SCST simulator root, CTLADM_SCST_ROOT when empty")
+	flag.Parse()
+	if *root == "" {
+		*root = os.Getenv("CTLADM_SCST_ROOT")
+	}
+	if err := run(*root, flag.Args()); err != nil {
+		fmt.Fprintf(os.Stderr, "scstsim: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+
+	ctlcompat "github.com/Tualua/pk_ctladm/pk_ctlcompat"
+)
+
+const FORMAT_TEMPLATE string = "template"
+
+var TemplateFuncs = template.FuncMap{
+	"human": templateHuman,
+	"bytes": templateBytes,
+	"join":  templateJoin,
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+// ListTemplate parses the --template text or the --template-file contents.
+// Templates are executed once per listed item over the same model as --json.
+func ListTemplate(text string, file string) (tmpl *template.Template, err error) {
+	if text != "" && file != "" {
+		return nil, ctlcompat.CtlErrorf(ctlcompat.ErrUsage, "--template and --template-file are mutually exclusive")
+	}
+	if file != "" {
+		if data, err := os.ReadFile(file); err != nil {
+			return nil, ctlcompat.CtlErrorf(ctlcompat.ErrNotFound, "cannot read template file %s: %w", file, err)
+		} else {
+			text = string(data)
+		}
+	}
+	if text == "" {
+		return
+	}
+	if !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	if tmpl, err = template.New("list").Funcs(TemplateFuncs).Parse(text); err != nil {
+		return nil, ctlcompat.CtlErrorf(ctlcompat.ErrUsage, "invalid template: %w", err)
+	}
+	return
+}
+
+func PrintTemplate(command string, tmpl *template.Template, item interface{}) (err error) {
+	if err = tmpl.Execute(os.Stdout, item); err != nil {
+		err = ctlcompat.CtlErrorf(ctlcompat.ErrUsage, "%s: error executing template: %w", command, err)
+	}
+	return
+}
+
+func templateUint(v interface{}) (res uint64, err error) {
+	switch n := v.(type) {
+	case int:
+		res = uint64(n)
+	case uint64:
+		res = n
+	case string:
+		res, err = strconv.ParseUint(n, 10, 64)
+	default:
+		err = fmt.Errorf("%v is not a number", v)
+	}
+	return
+}
+
+// templateHuman formats a byte count the way zfs list does, 10M or 1.50G.
+func templateHuman(v interface{}) (res string, err error) {
+	var (
+		n uint64
+	)
+	if n, err = templateUint(v); err != nil {
+		return
+	}
+	units := "KMGTPE"
+	if n < 1024 {
+		return strconv.FormatUint(n, 10), nil
+	}
+	size := float64(n)
+	unit := -1
+	for size >= 1024 && unit < len(units)-1 {
+		size /= 1024
+		unit++
+	}
+	switch {
+	case size == float64(uint64(size)):
+		res = fmt.Sprintf("%d%c", uint64(size), units[unit])
+	case size < 10:
+		res = fmt.Sprintf("%.2f%c", size, units[unit])
+	case size < 100:
+		res = fmt.Sprintf("%.1f%c", size, units[unit])
+	default:
+		res = fmt.Sprintf("%.0f%c", size, units[unit])
+	}
+	return
+}
+
+// templateBytes turns a size in blocks into bytes.
+func templateBytes(blocks interface{}, blocksize interface{}) (res uint64, err error) {
+	var (
+		n  uint64
+		bs uint64
+	)
+	if n, err = templateUint(blocks); err == nil {
+		if bs, err = templateUint(blocksize); err == nil {
+			res = n * bs
+		}
+	}
+	return
+}
+
+func templateJoin(list interface{}, sep string) (res string, err error) {
+	val := reflect.ValueOf(list)
+	if val.Kind() != reflect.Slice {
+		return "", fmt.Errorf("join: %T is not a list", list)
+	}
+	items := make([]string, val.Len())
+	for i := range items {
+		items[i] = fmt.Sprint(val.Index(i).Interface())
+	}
+	res = strings.Join(items, sep)
+	return
+}